@@ -0,0 +1,169 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "github.com/maxymania/sshproxy/puzzle"
+import "crypto/rand"
+import "bytes"
+import "errors"
+import "sync"
+import "sync/atomic"
+import "time"
+
+/* Number of outstanding challenges remembered per SSH connection. */
+const maxChallenges = 16
+
+/* Default puzzle difficulty, if Server.PowBits is zero. */
+const defaultPowBits = 16
+
+/* Default limit for Client.MaxPowBits. */
+const defaultMaxPowBits = 24
+
+/*
+How often Client.openSolve solves a puzzle, before giving up. Every busy
+relay on the way may ask for one.
+*/
+const powRetries = 4
+
+var E_SOLUTIONS = errors.New("Malformed puzzle solutions")
+
+type admission struct{
+	once  sync.Once
+	slots chan struct{}
+	load  int32 /* handshakes running or waiting */
+}
+
+func (s *Server) slots() chan struct{} {
+	s.adm.once.Do(func(){
+		if s.MaxHandshakes>0 { s.adm.slots = make(chan struct{},s.MaxHandshakes) }
+	})
+	return s.adm.slots
+}
+func (s *Server) powBits() uint8 {
+	if s.PowBits<=0 { return defaultPowBits }
+	if s.PowBits>puzzle.MaxBits { return puzzle.MaxBits }
+	return uint8(s.PowBits)
+}
+
+/*
+Waits for a handshake slot. If the load is beyond PowThreshold, the
+channel must carry the solution of a puzzle, that has been handed out on
+the same SSH connection before. Otherwise a new puzzle is sent as reject
+reason and false is returned.
+
+On success, the caller must call s.leave().
+*/
+func (s *Server) enter(c *sconn, cr *anyprotocol1, nc ssh.NewChannel) bool {
+	load := int(atomic.AddInt32(&s.adm.load,1))
+	if s.PowThreshold>0 && load>s.PowThreshold && !c.redeem(cr) {
+		atomic.AddInt32(&s.adm.load,-1)
+		p,e := c.challenge(s.powBits())
+		if e!=nil {
+			nc.Reject(ssh.ResourceShortage,"Busy!")
+			return false
+		}
+		nc.Reject(ssh.ResourceShortage,p.String())
+		return false
+	}
+	slots := s.slots()
+	if slots==nil { return true }
+	if s.MaxQueue>0 && load>s.MaxHandshakes+s.MaxQueue {
+		atomic.AddInt32(&s.adm.load,-1)
+		nc.Reject(ssh.ResourceShortage,"Too many handshakes!")
+		return false
+	}
+	if s.HandshakeTimeout<=0 {
+		slots <- struct{}{}
+		return true
+	}
+	t := time.NewTimer(s.HandshakeTimeout)
+	defer t.Stop()
+	select {
+	case slots <- struct{}{}: return true
+	case <-t.C:
+	}
+	atomic.AddInt32(&s.adm.load,-1)
+	nc.Reject(ssh.ResourceShortage,"Too many handshakes!")
+	return false
+}
+func (s *Server) leave() {
+	if slots := s.slots(); slots!=nil { <-slots }
+	atomic.AddInt32(&s.adm.load,-1)
+}
+
+/* Hands out a new puzzle and remembers it. */
+func (c *sconn) challenge(b uint8) (*puzzle.Challenge,error) {
+	p,e := puzzle.New(b,rand.Reader)
+	if e!=nil { return nil,e }
+	c.cmutex.Lock(); defer c.cmutex.Unlock()
+	if len(c.challenges)>=maxChallenges {
+		n := copy(c.challenges,c.challenges[1:])
+		c.challenges = c.challenges[:n]
+	}
+	c.challenges = append(c.challenges,p)
+	return p,nil
+}
+
+/*
+Looks for the solution of a puzzle, handed out on this connection, among
+cr.Pow and removes it from there. Each puzzle can be redeemed once.
+*/
+func (c *sconn) redeem(cr *anyprotocol1) bool {
+	c.cmutex.Lock(); defer c.cmutex.Unlock()
+	for j,sol := range cr.Pow {
+		for i,p := range c.challenges {
+			if !bytes.Equal(p.Nonce[:],sol[:puzzle.NonceSize]) { continue }
+			c.challenges = append(c.challenges[:i],c.challenges[i+1:]...)
+			cr.Pow = append(cr.Pow[:j:j],cr.Pow[j+1:]...)
+			if !p.Verify(sol[puzzle.NonceSize:]) { return false }
+			cr.redeemed = p
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Makes the puzzle, cr redeemed, valid again. Used, if the circuit failed
+because of the next hop, so the originator can reuse the solution.
+*/
+func (c *sconn) restore(cr *anyprotocol1) {
+	if cr.redeemed==nil { return }
+	c.cmutex.Lock(); defer c.cmutex.Unlock()
+	if len(c.challenges)<maxChallenges { c.challenges = append(c.challenges,cr.redeemed) }
+	cr.redeemed = nil
+}
+
+/* Returns the puzzle, if e is the rejection of a busy relay. */
+func challengeOf(e error) *puzzle.Challenge {
+	oe,ok := e.(*ssh.OpenChannelError)
+	if !ok || !puzzle.Is(oe.Message) { return nil }
+	p,e := puzzle.Parse(oe.Message)
+	if e!=nil { return nil }
+	return p
+}
+
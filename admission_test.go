@@ -0,0 +1,157 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "github.com/maxymania/sshproxy/puzzle"
+import "testing"
+import "sync/atomic"
+import "time"
+
+/* A NewChannel, that records its rejection. */
+type fakeChannel struct{
+	reason ssh.RejectionReason
+	msg    string
+}
+func (f *fakeChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) { return nil,nil,ssh.ErrNoAuth }
+func (f *fakeChannel) Reject(r ssh.RejectionReason, m string) error { f.reason,f.msg = r,m; return nil }
+func (f *fakeChannel) ChannelType() string { return any_req1 }
+func (f *fakeChannel) ExtraData() []byte { return nil }
+
+/* Returns Nonce || Solution of p. */
+func solution(p *puzzle.Challenge) []byte {
+	return append(append([]byte(nil),p.Nonce[:]...),p.Solve()...)
+}
+
+func TestRedeem(t *testing.T) {
+	c := new(sconn)
+	p,e := c.challenge(4)
+	if e!=nil { t.Fatal(e) }
+	other,_ := puzzle.New(4,zeroReader{})
+	
+	cr := &anyprotocol1{Pow:[][]byte{solution(other),solution(p)}}
+	if !c.redeem(cr) { t.Fatal("solution not redeemed") }
+	if len(cr.Pow)!=1 || cr.redeemed!=p { t.Error("redeemed solution not removed",len(cr.Pow)) }
+	if c.redeem(&anyprotocol1{Pow:[][]byte{solution(p)}}) { t.Error("solution redeemed twice") }
+	
+	/* A failed circuit gives the puzzle back. */
+	c.restore(cr)
+	if cr.redeemed!=nil { t.Error("restore kept the puzzle") }
+	if !c.redeem(&anyprotocol1{Pow:[][]byte{solution(p)}}) { t.Error("restored puzzle not redeemed") }
+	
+	/* A wrong solution uses the puzzle up. */
+	p,_ = c.challenge(8)
+	wrong := solution(p)
+	for p.Verify(wrong[puzzle.NonceSize:]) { wrong[len(wrong)-1]++ }
+	if c.redeem(&anyprotocol1{Pow:[][]byte{wrong}}) { t.Error("wrong solution redeemed") }
+	if c.redeem(&anyprotocol1{Pow:[][]byte{solution(p)}}) { t.Error("puzzle redeemed after a wrong solution") }
+}
+
+/* Only the last maxChallenges puzzles are remembered. */
+func TestChallengeLimit(t *testing.T) {
+	c := new(sconn)
+	first,_ := c.challenge(1)
+	for i := 0; i<maxChallenges; i++ { c.challenge(1) }
+	if len(c.challenges)!=maxChallenges { t.Error("remembered",len(c.challenges)) }
+	if c.redeem(&anyprotocol1{Pow:[][]byte{solution(first)}}) { t.Error("oldest puzzle still redeemable") }
+}
+
+type zeroReader struct{}
+func (zeroReader) Read(b []byte) (int,error) {
+	for i := range b { b[i] = 0 }
+	return len(b),nil
+}
+
+/*
+An admission case: enter is called len(want) times without leave, want
+tells, whether each call is admitted.
+*/
+var enterCases = []struct{
+	name string
+	srv  *Server
+	want []bool
+}{
+	{"unlimited",&Server{},[]bool{true,true,true,true}},
+	{"slots",&Server{MaxHandshakes:2,HandshakeTimeout:20*time.Millisecond},[]bool{true,true,false,false}},
+	{"pow",&Server{PowThreshold:2,PowBits:4},[]bool{true,true,false,false}},
+}
+
+func TestEnter(t *testing.T) {
+	for _,c := range enterCases {
+		s := c.srv
+		conn := new(sconn)
+		for i,want := range c.want {
+			nc := new(fakeChannel)
+			got := s.enter(conn,new(anyprotocol1),nc)
+			if got!=want { t.Errorf("%s: enter #%d = %v",c.name,i,got) }
+			if !got && nc.reason!=ssh.ResourceShortage { t.Errorf("%s: rejected with %v",c.name,nc.reason) }
+		}
+		for _,ok := range c.want {
+			if ok { s.leave() }
+		}
+		if s.adm.load!=0 { t.Errorf("%s: load %d after leave",c.name,s.adm.load) }
+		if slots := s.slots(); slots!=nil && len(slots)!=0 { t.Errorf("%s: %d slots held",c.name,len(slots)) }
+	}
+}
+
+/* Beyond MaxQueue waiting handshakes, a handshake is rejected at once. */
+func TestQueue(t *testing.T) {
+	s := &Server{MaxHandshakes:1,MaxQueue:1,HandshakeTimeout:5*time.Second}
+	conn := new(sconn)
+	if !s.enter(conn,new(anyprotocol1),new(fakeChannel)) { t.Fatal("first handshake rejected") }
+	queued := make(chan bool)
+	go func(){ queued <- s.enter(conn,new(anyprotocol1),new(fakeChannel)) }()
+	for atomic.LoadInt32(&s.adm.load)<2 { time.Sleep(time.Millisecond) }
+	begin := time.Now()
+	if s.enter(conn,new(anyprotocol1),new(fakeChannel)) { t.Error("queue overflow admitted") }
+	if time.Since(begin)>time.Second { t.Error("queue overflow waited") }
+	s.leave()
+	if !<-queued { t.Error("queued handshake rejected") }
+	s.leave()
+	if s.adm.load!=0 { t.Error("load",s.adm.load) }
+}
+
+/* Under load, a solved puzzle buys admission. */
+func TestEnterPow(t *testing.T) {
+	s := &Server{PowThreshold:1,PowBits:6}
+	conn := new(sconn)
+	if !s.enter(conn,new(anyprotocol1),new(fakeChannel)) { t.Fatal("first handshake rejected") }
+	nc := new(fakeChannel)
+	if s.enter(conn,new(anyprotocol1),nc) { t.Fatal("no puzzle under load") }
+	p,e := puzzle.Parse(nc.msg)
+	if e!=nil { t.Fatal("reject reason",nc.msg,e) }
+	if int(p.Bits)!=s.PowBits { t.Error("difficulty",p.Bits) }
+	if challengeOf(&ssh.OpenChannelError{Reason:nc.reason,Message:nc.msg})==nil { t.Error("challengeOf missed the puzzle") }
+	if !s.enter(conn,&anyprotocol1{Pow:[][]byte{solution(p)}},new(fakeChannel)) { t.Error("solved puzzle rejected") }
+	s.leave()
+	s.leave()
+	if s.adm.load!=0 { t.Error("load",s.adm.load) }
+}
+
+func TestPowBits(t *testing.T) {
+	for _,c := range []struct{ in int; out uint8 }{ {0,defaultPowBits},{-1,defaultPowBits},{20,20},{64,64},{65,puzzle.MaxBits},{1000,puzzle.MaxBits} } {
+		if b := (&Server{PowBits:c.in}).powBits(); b!=c.out { t.Errorf("PowBits %d: %d",c.in,b) }
+	}
+}
@@ -26,17 +26,27 @@ SOFTWARE.
 package anyproto
 
 import "io"
-import "encoding/binary"
 
+/*
+The legacy one byte message format, that hides one byte in 32 random bytes.
+New code should use ReadMessage and WriteMessage.
+*/
 func DecodeOneByteMessage(conn io.Reader) (byte,error) {
 	var r request
-	e := binary.Read(conn,binary.BigEndian,&r)
+	_,e := io.ReadFull(conn,r.B[:])
 	if e!=nil { return 0,e }
 	return r.decode(),nil
 }
 func EncodeOneByteMessage(conn io.Writer,b byte) error {
+	return EncodeOneByteMessageFrom(conn,b,Rand)
+}
+
+/* Like EncodeOneByteMessage, but draws the mask from rnd. */
+func EncodeOneByteMessageFrom(conn io.Writer,b byte,rnd io.Reader) error {
 	var r request
-	r.init(b)
-	return binary.Write(conn,binary.BigEndian,r)
+	e := r.init(b,rnd)
+	if e!=nil { return e }
+	_,e = conn.Write(r.B[:])
+	return e
 }
 
@@ -0,0 +1,197 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package anyproto
+
+import "encoding/binary"
+import "errors"
+import "io"
+
+/*
+The version of the message format. Peers, that still send one byte
+messages (see EncodeOneByteMessage), are detected with a probability
+of 255/256, as their first byte is random.
+*/
+const Version = 2
+
+/* The maximum number of padding bytes added by WriteMessage. */
+const MaxPadding = 255
+
+var E_VERSION = errors.New("anyproto: unsupported message version (old peer?)")
+var E_FORMAT = errors.New("anyproto: malformed message")
+var E_TOO_BIG = errors.New("anyproto: message too big")
+
+/* The type of a field. */
+type Type uint8
+const (
+	TBytes Type = iota
+	TString
+	TUint
+	TBool
+)
+
+/* A typed field. Value holds the encoded value, use the accessors of Message. */
+type Field struct{
+	Tag   uint8
+	Type  Type
+	Value []byte
+}
+
+/*
+A message is an opcode and a list of typed, length-prefixed fields.
+A tag may appear more than once.
+
+Wire format (all integers big endian):
+
+	Version(1) Op(1) FieldsLen(2) PadLen(2) Fields[FieldsLen] Padding[PadLen]
+
+with every field being
+
+	Tag(1) Type(1) Len(2) Value[Len]
+
+TUint values are big endian with 1 to 8 bytes, TBool values are one byte.
+*/
+type Message struct{
+	Op     uint8
+	Fields []Field
+}
+
+func (m *Message) Add(tag uint8, t Type, v []byte) *Message {
+	m.Fields = append(m.Fields,Field{tag,t,v})
+	return m
+}
+func (m *Message) AddBytes(tag uint8, v []byte) *Message {
+	return m.Add(tag,TBytes,v)
+}
+func (m *Message) AddString(tag uint8, v string) *Message {
+	return m.Add(tag,TString,[]byte(v))
+}
+func (m *Message) AddUint(tag uint8, v uint64) *Message {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],v)
+	i := 0
+	for i<7 && b[i]==0 { i++ }
+	return m.Add(tag,TUint,b[i:])
+}
+func (m *Message) AddBool(tag uint8, v bool) *Message {
+	b := []byte{0}
+	if v { b[0] = 1 }
+	return m.Add(tag,TBool,b)
+}
+
+/* Returns the first field with the given tag and type, or nil. */
+func (m *Message) Get(tag uint8, t Type) *Field {
+	for i := range m.Fields {
+		if m.Fields[i].Tag==tag && m.Fields[i].Type==t { return &m.Fields[i] }
+	}
+	return nil
+}
+func (m *Message) Bytes(tag uint8) ([]byte,bool) {
+	f := m.Get(tag,TBytes)
+	if f==nil { return nil,false }
+	return f.Value,true
+}
+func (m *Message) String(tag uint8) (string,bool) {
+	f := m.Get(tag,TString)
+	if f==nil { return "",false }
+	return string(f.Value),true
+}
+func (m *Message) Uint(tag uint8) (uint64,bool) {
+	f := m.Get(tag,TUint)
+	if f==nil || len(f.Value)==0 || len(f.Value)>8 { return 0,false }
+	v := uint64(0)
+	for _,b := range f.Value { v = v<<8|uint64(b) }
+	return v,true
+}
+func (m *Message) Bool(tag uint8) (bool,bool) {
+	f := m.Get(tag,TBool)
+	if f==nil || len(f.Value)!=1 { return false,false }
+	return f.Value[0]!=0,true
+}
+
+/* Returns the values of all fields with the given tag and type. */
+func (m *Message) All(tag uint8, t Type) (v [][]byte) {
+	for _,f := range m.Fields {
+		if f.Tag==tag && f.Type==t { v = append(v,f.Value) }
+	}
+	return
+}
+
+/* Writes m, padded with a random number of bytes. */
+func WriteMessage(conn io.Writer, m *Message) error {
+	return WriteMessageFrom(conn,m,Rand)
+}
+
+/* Like WriteMessage, but draws the padding length from rnd. */
+func WriteMessageFrom(conn io.Writer, m *Message, rnd io.Reader) error {
+	var pl [1]byte
+	_,e := io.ReadFull(rnd,pl[:])
+	if e!=nil { return e }
+	
+	fl := 0
+	for _,f := range m.Fields {
+		if len(f.Value)>0xffff { return E_TOO_BIG }
+		fl += 4+len(f.Value)
+	}
+	if fl>0xffff { return E_TOO_BIG }
+	
+	b := make([]byte,6,6+fl+int(pl[0]))
+	b[0],b[1] = Version,m.Op
+	binary.BigEndian.PutUint16(b[2:],uint16(fl))
+	binary.BigEndian.PutUint16(b[4:],uint16(pl[0]))
+	for _,f := range m.Fields {
+		b = append(b,f.Tag,byte(f.Type),byte(len(f.Value)>>8),byte(len(f.Value)))
+		b = append(b,f.Value...)
+	}
+	/* The padding is zero, the scrambler encrypts it anyway. */
+	b = b[:len(b)+int(pl[0])]
+	_,e = conn.Write(b)
+	return e
+}
+
+/* Reads a message, written by WriteMessage. */
+func ReadMessage(conn io.Reader) (*Message,error) {
+	var h [6]byte
+	_,e := io.ReadFull(conn,h[:])
+	if e!=nil { return nil,e }
+	if h[0]!=Version { return nil,E_VERSION }
+	fl := int(binary.BigEndian.Uint16(h[2:]))
+	pl := int(binary.BigEndian.Uint16(h[4:]))
+	if pl>MaxPadding { return nil,E_FORMAT }
+	b := make([]byte,fl+pl)
+	_,e = io.ReadFull(conn,b)
+	if e!=nil { return nil,e }
+	b = b[:fl]
+	
+	m := &Message{Op:h[1]}
+	for len(b)>0 {
+		if len(b)<4 { return nil,E_FORMAT }
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b)<4+l { return nil,E_FORMAT }
+		m.Fields = append(m.Fields,Field{b[0],Type(b[1]),b[4:4+l:4+l]})
+		b = b[4+l:]
+	}
+	return m,nil
+}
@@ -0,0 +1,132 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package anyproto
+
+import "testing"
+import "bytes"
+import "io"
+
+var uintCases = []struct{
+	v uint64
+	n int /* encoded length */
+}{
+	{0,1},{1,1},{255,1},{256,2},{65535,2},{65536,3},{1<<56-1,7},{1<<56,8},{1<<64-1,8},
+}
+
+func TestUint(t *testing.T) {
+	for _,c := range uintCases {
+		m := new(Message).AddUint(1,c.v)
+		if l := len(m.Fields[0].Value); l!=c.n { t.Errorf("%d: encoded in %d bytes, want %d",c.v,l,c.n) }
+		if v,ok := m.Uint(1); !ok || v!=c.v { t.Errorf("%d: decoded %d %v",c.v,v,ok) }
+	}
+	for _,v := range [][]byte{ nil,make([]byte,9) } {
+		m := new(Message).Add(1,TUint,v)
+		if _,ok := m.Uint(1); ok { t.Errorf("Uint accepted %d bytes",len(v)) }
+	}
+	if _,ok := new(Message).Add(1,TBool,[]byte{1,0}).Bool(1); ok { t.Error("Bool accepted 2 bytes") }
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := NewDeterministicReader([]byte("seed"),"message")
+	/* Fills the message up to the limit. */
+	big := bytes.Repeat([]byte{0xab},0xffff-4-35)
+	for i := 0; i<64; i++ {
+		m := &Message{Op:uint8(i)}
+		m.AddString(1,"example.org").AddUint(2,443).AddUint(2,80).AddBool(3,true).AddBytes(4,nil)
+		if i==0 { m.AddBytes(5,big) }
+		var b bytes.Buffer
+		if e := WriteMessageFrom(&b,m,rnd); e!=nil { t.Fatal(e) }
+		b.WriteString("tail")
+		r,e := ReadMessage(&b)
+		if e!=nil { t.Fatal(e) }
+		if b.String()!="tail" { t.Fatal("read beyond the message") }
+		if r.Op!=m.Op || len(r.Fields)!=len(m.Fields) { t.Fatal("got",r.Op,len(r.Fields)) }
+		s,_ := r.String(1)
+		p,_ := r.Uint(2)
+		ok,_ := r.Bool(3)
+		if s!="example.org" || p!=443 || !ok { t.Error("got",s,p,ok) }
+		if ports := r.All(2,TUint); len(ports)!=2 { t.Error("repeated tag",len(ports)) }
+		if v,ok := r.Bytes(4); !ok || len(v)!=0 { t.Error("empty field",v,ok) }
+		if _,ok := r.Bytes(1); ok { t.Error("field of another type matched") }
+		if i==0 {
+			if v,_ := r.Bytes(5); !bytes.Equal(v,big) { t.Error("big field") }
+		}
+	}
+}
+
+func TestTooBig(t *testing.T) {
+	for _,m := range []*Message{
+		new(Message).AddBytes(1,make([]byte,0x10000)),
+		new(Message).AddBytes(1,make([]byte,0x8000)).AddBytes(1,make([]byte,0x8000)),
+		new(Message).AddBytes(1,make([]byte,0xffff-3)),
+	} {
+		if e := WriteMessageFrom(io.Discard,m,Rand); e!=E_TOO_BIG { t.Error("oversized message:",e) }
+	}
+	if e := WriteMessageFrom(io.Discard,new(Message).AddBytes(1,make([]byte,0xffff-4)),Rand); e!=nil { t.Error("largest message:",e) }
+}
+
+var readCases = []struct{
+	name string
+	b    []byte
+	e    error
+}{
+	{"empty",nil,io.EOF},
+	{"short header",[]byte{Version,1,0},io.ErrUnexpectedEOF},
+	{"version",[]byte{1,1,0,0,0,0},E_VERSION},
+	{"padding",[]byte{Version,1,0,0,1,0},E_FORMAT},
+	{"short fields",[]byte{Version,1,0,5,0,0,1,0,0},io.ErrUnexpectedEOF},
+	{"short padding",[]byte{Version,1,0,0,0,3,0},io.ErrUnexpectedEOF},
+	{"field header",[]byte{Version,1,0,3,0,0,1,0,0},E_FORMAT},
+	{"field value",[]byte{Version,1,0,5,0,0,1,0,0,2,9},E_FORMAT},
+	{"field beyond fields",[]byte{Version,1,0,5,0,2,1,0,0,2,9,0,0},E_FORMAT},
+	{"no fields",[]byte{Version,9,0,0,0,2,0,0},nil},
+}
+
+func TestRead(t *testing.T) {
+	for _,c := range readCases {
+		m,e := ReadMessage(bytes.NewReader(c.b))
+		if e!=c.e { t.Errorf("%s: %v",c.name,e) }
+		if e==nil && (m.Op!=9 || len(m.Fields)!=0) { t.Errorf("%s: %v",c.name,m) }
+	}
+}
+
+/* Every truncation of a valid message fails. */
+func TestTruncated(t *testing.T) {
+	var b bytes.Buffer
+	m := new(Message).AddString(1,"example.org").AddUint(2,443)
+	WriteMessageFrom(&b,m,NewDeterministicReader(nil,"truncated"))
+	for i := 0; i<b.Len(); i++ {
+		if _,e := ReadMessage(bytes.NewReader(b.Bytes()[:i])); e==nil { t.Errorf("%d of %d bytes accepted",i,b.Len()) }
+	}
+}
+
+func TestOneByte(t *testing.T) {
+	for i := 0; i<256; i++ {
+		var b bytes.Buffer
+		if e := EncodeOneByteMessage(&b,byte(i)); e!=nil { t.Fatal(e) }
+		v,e := DecodeOneByteMessage(&b)
+		if e!=nil || v!=byte(i) { t.Error(i,v,e) }
+	}
+}
@@ -25,16 +25,25 @@ SOFTWARE.
 
 package anyproto
 
-import "math/rand"
+import "io"
 
 type request struct{
 	B [32]byte
 }
 
-func (r *request) init(b byte) {
-	read(r.B[:])
+/*
+Masks b with 32 random bytes, followed by one byte, that selects the
+position (modulo 32), where b is hidden.
+*/
+func (r *request) init(b byte, rnd io.Reader) error {
+	var pos [1]byte
+	_,e := io.ReadFull(rnd,r.B[:])
+	if e!=nil { return e }
+	_,e = io.ReadFull(rnd,pos[:])
+	if e!=nil { return e }
 	for _,c := range r.B { b ^= c }
-	r.B[rand.Intn(32)] ^= b
+	r.B[pos[0]&31] ^= b
+	return nil
 }
 
 func (r *request) decode() byte {
@@ -42,4 +51,3 @@ func (r *request) decode() byte {
 	for _,c := range r.B { b ^= c }
 	return b
 }
-
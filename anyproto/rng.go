@@ -25,21 +25,41 @@ SOFTWARE.
 
 package anyproto
 
+import "io"
 import "sync"
 import "crypto/rand"
 import "golang.org/x/crypto/sha3"
 
-var lck sync.Mutex
+type shakeReader struct{
+	lck sync.Mutex
+	sh  sha3.ShakeHash
+}
+func (s *shakeReader) Read(b []byte) (int,error) {
+	s.lck.Lock(); defer s.lck.Unlock()
+	return s.sh.Read(b)
+}
 
-var sh sha3.ShakeHash
+func newShakeReader(b ...[]byte) *shakeReader {
+	s := &shakeReader{sh:sha3.NewShake256()}
+	for _,x := range b { s.sh.Write(x) }
+	return s
+}
+
+/*
+Returns the SHAKE256 output stream over seed || 0x00 || label, like
+scrambler.NewDeterministicReader. In deterministic mode, this is passed as
+the entropy source to the *From functions, in order to generate or check
+test vectors. NEVER use this outside of tests.
+*/
+func NewDeterministicReader(seed []byte, label string) io.Reader {
+	return newShakeReader(seed,[]byte{0},[]byte(label))
+}
+
+/* The default entropy source: a SHAKE256 stream, seeded from crypto/rand. */
+var Rand io.Reader
 
 func init(){
 	var b [256]byte
-	sh = sha3.NewShake256()
 	rand.Read(b[:])
-	sh.Write(b[:])
-}
-func read(b []byte){
-	lck.Lock(); defer lck.Unlock()
-	sh.Read(b)
+	Rand = newShakeReader(b[:])
 }
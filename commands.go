@@ -0,0 +1,108 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "github.com/maxymania/sshproxy/anyproto"
+import "golang.org/x/crypto/ssh"
+import "errors"
+import "sync"
+import "net"
+import "io"
+
+var E_OPCODE_TAKEN = errors.New("Opcode already in use")
+var E_NIL_HANDLER = errors.New("Command handler is nil")
+
+/*
+Handles a custom command at the exit. The handler owns the stream and must close it.
+The stream is a *Command, that carries the request sent by OpenCommand.
+*/
+type CommandHandler func(conn io.ReadWriteCloser, ch ssh.Channel)
+
+/* The stream handed to a CommandHandler. */
+type Command struct{
+	io.ReadWriteCloser
+	/* The request, as sent by OpenCommand. */
+	Message *anyproto.Message
+}
+
+var commands = struct{
+	sync.RWMutex
+	m map[byte]CommandHandler
+}{m:make(map[byte]CommandHandler)}
+
+func builtin(op byte) bool {
+	switch op {
+	case ap_conn,ap_resolve,ap_echo,ap_listen,ap_register,ap_rendezvous,apc_ok,apc_err: return true
+	}
+	return false
+}
+
+/*
+Registers a handler for a custom command, that is served at the exit.
+Built-in opcodes and opcodes already registered are rejected with
+E_OPCODE_TAKEN, a nil handler with E_NIL_HANDLER.
+*/
+func RegisterCommand(op byte, handler func(io.ReadWriteCloser, ssh.Channel)) error {
+	if handler==nil { return E_NIL_HANDLER }
+	if builtin(op) { return E_OPCODE_TAKEN }
+	commands.Lock(); defer commands.Unlock()
+	if _,ok := commands.m[op]; ok { return E_OPCODE_TAKEN }
+	commands.m[op] = handler
+	return nil
+}
+
+func command(op byte) CommandHandler {
+	commands.RLock(); defer commands.RUnlock()
+	return commands.m[op]
+}
+
+/* Acknowledges the command m and hands the stream over to h. */
+func ap1_command(h CommandHandler, m *anyproto.Message, ech2 io.ReadWriteCloser, ch2 ssh.Channel){
+	e := anyproto.WriteMessage(ech2,&anyproto.Message{Op:apc_ok})
+	if e!=nil {
+		ech2.Close()
+		return
+	}
+	h(&Command{ech2,m},ch2)
+}
+
+/*
+Builds a circuit and sends the custom command m, including its fields. The
+returned stream is connected to the handler, the exit registered with
+RegisterCommand for m.Op. If the exit doesn't know m.Op, a *RemoteError with
+EC_UNSUPPORTED is returned.
+*/
+func OpenCommand(m *anyproto.Message) (net.Conn,error) {
+	if builtin(m.Op) { return nil,E_OPCODE_TAKEN }
+	ech,e := chopen_anyproto1(Level,m)
+	if e!=nil { return nil,e }
+	_,e = readReply(ech)
+	if e!=nil {
+		ech.Close()
+		return nil,e
+	}
+	return ech,nil
+}
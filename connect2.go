@@ -25,106 +25,115 @@ SOFTWARE.
 
 package sshproxy
 
-import "encoding/binary"
 import "golang.org/x/crypto/ssh"
 import "net"
 import "log"
-import "errors"
-import "io"
-import "time"
+import "strconv"
+import "strings"
+import "syscall"
 
+import "github.com/maxymania/sshproxy/scrambler"
 import "github.com/maxymania/sshproxy/anyproto"
 
 
-type connHdr2S struct{
-	Port uint16
-	T uint8
-	IP [16]byte
-}
-
-
-func ap1_connect(ech2 io.ReadWriteCloser, ch2 ssh.Channel){
-	var cx connHdr2S
-	
-	e := binary.Read(ech2, binary.BigEndian,&cx)
-	if e!=nil {
-		log.Println("binary.Read",e)
-		ch2.Close()
+/*
+Connect request: tag_host (IP literal or host name, resolved at the exit)
+and tag_port. The apc_ok reply carries the remote tag_ip and tag_port.
+*/
+func ap1_connect(s *Server, m *anyproto.Message, ech2 *scrambler.Conn, ch2 ssh.Channel){
+	host,ok1 := m.String(tag_host)
+	port,ok2 := m.Uint(tag_port)
+	if !ok1 || !ok2 || port>0xffff {
+		replyErr(ech2,EC_FAILED,"malformed request")
+		ech2.Close()
 		return
 	}
 	
-	if cx.T>16 { cx.T = 16 }
-	
-	var coadr net.TCPAddr
-	
-	coadr.IP = net.IP(cx.IP[:cx.T])
-	coadr.Port = int(cx.Port)
-	
-	conn,err := net.DialTCP("tcp",nil,&coadr)
+	d := net.Dialer{Timeout:s.OpenTimeout}
+	if s.PermitExit!=nil {
+		/* Checked for every address, host resolves to. */
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			h,p,_ := net.SplitHostPort(address)
+			n,_ := strconv.ParseUint(p,10,16)
+			if !s.PermitExit(h,uint32(n)) { return E_EXIT_POLICY }
+			return nil
+		}
+	}
+	conn,err := d.Dial("tcp",net.JoinHostPort(host,strconv.Itoa(int(port))))
 	if err!=nil {
-		log.Println("net.DialTCP",err)
-		anyproto.EncodeOneByteMessage(ech2,apc_err)
+		log.Println("net.Dial",err)
+		replyErr(ech2,errCode(err),"")
+		ech2.Close()
+		return
+	}
+	r := &anyproto.Message{Op:apc_ok}
+	if ta,ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		r.AddBytes(tag_ip,[]byte(ta.IP)).AddUint(tag_port,uint64(ta.Port))
+	}
+	err = anyproto.WriteMessage(ech2,r)
+	if err!=nil {
+		log.Println("anyproto.WriteMessage",err)
+		conn.Close()
 		ech2.Close()
 		return
 	}
-	anyproto.EncodeOneByteMessage(ech2,apc_ok)
 	
-	go ch_proxy_copyin2(conn,ech2,ch2)
-	go ch_proxy_copyout2(ech2,conn)
+	go s.relay().Relay(conn,ech2)
 }
 
+/* The session, as seen by the user of Dial. It supports CloseWrite and Reset. */
 type myconn2 struct{
-	io.Reader
-	io.Writer
-	io.Closer
+	*scrambler.Conn
 	l net.Addr
 	r net.Addr
 }
 func (m *myconn2) LocalAddr() net.Addr { return m.l }
 func (m *myconn2) RemoteAddr() net.Addr { return m.r }
-func (m *myconn2) SetDeadline     (t time.Time) error { return nil }
-func (m *myconn2) SetReadDeadline (t time.Time) error { return nil }
-func (m *myconn2) SetWriteDeadline(t time.Time) error { return nil }
 
+/*
+Connects to addr through the cascade. Host names are resolved at the exit.
+Errors reported by the exit are of type *RemoteError. Host names ending
+with HiddenSuffix are hidden services (see DialHidden), the port is ignored.
+*/
 func Dial(netw, addr string) (net.Conn,error) {
-	var cx connHdr2S
-	
-	rm,e := net.ResolveTCPAddr(netw,addr)
+	return DialLevel(Level,netw,addr)
+}
+
+/*
+Like Dial, but with a circuit of the given level instead of Level. In path
+mode, level is ignored.
+*/
+func DialLevel(level int, netw, addr string) (net.Conn,error) {
+	switch netw {
+	case "tcp","tcp4","tcp6":
+	default: return nil,net.UnknownNetworkError(netw)
+	}
+	host,sport,e := net.SplitHostPort(addr)
 	if e!=nil { return nil,e }
-	
-	IPb := []byte(rm.IP)
-	cx.T = uint8(len(IPb))
-	cx.Port = uint16(rm.Port)
-	copy(cx.IP[:],IPb)
-	
-	ech,e := chopen_anyproto1(ap_conn)
+	if strings.HasSuffix(strings.ToLower(host),HiddenSuffix) { return DialHiddenLevel(level,host) }
+	if p := path(); p!=nil { return p.Dial(netw,addr) }
+	port,e := net.LookupPort(netw,sport)
 	if e!=nil { return nil,e }
 	
-	e = binary.Write(ech,binary.BigEndian,cx)
-	if e!=nil {
-		log.Println("Dial3: binary.Write",e)
-		ech.Close()
-		return nil,e
-	}
+	m := &anyproto.Message{Op:ap_conn}
+	m.AddString(tag_host,host).AddUint(tag_port,uint64(port))
+	ech,e := chopen_anyproto1(level,m)
+	if e!=nil { return nil,e }
 	
-	cty,e := anyproto.DecodeOneByteMessage(ech)
+	r,e := readReply(ech)
 	if e!=nil {
-		log.Println("Dial3: anyproto.DecodeOneByteMessage",e)
+		log.Println("Dial: readReply",e)
 		ech.Close()
 		return nil,e
 	}
 	
-	if cty == apc_err {
-		ech.Close()
-		return nil,errors.New("Connection Failed/Refused!")
-	}
-	if cty != apc_ok {
-		ech.Close()
-		return nil,errors.New("Unknown error!")
+	rm := &net.TCPAddr{IP:net.ParseIP(host),Port:port}
+	if ip,ok := r.Bytes(tag_ip); ok && (len(ip)==4 || len(ip)==16) {
+		rm.IP = net.IP(ip)
 	}
 	lo := new(net.TCPAddr)
 	lo.Port = 54321
 	lo.IP = net.IP{128,0,0,1}
 	
-	return &myconn2{ech,ech,ech,lo,rm},nil
+	return &myconn2{ech,lo,rm},nil
 }
@@ -0,0 +1,168 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "github.com/maxymania/sshproxy/scrambler"
+import "github.com/maxymania/sshproxy/anyproto"
+import "math/rand"
+import "sync"
+import "time"
+import "log"
+import "io"
+
+/* The maximum number of bytes the exit receives and sends per decoy session. */
+const maxDecoy = 1<<22
+
+/*
+Decoy session. The exit discards what it receives and sends tag_size bytes
+back, both up to maxDecoy.
+*/
+func ap1_echo(m *anyproto.Message, ech2 *scrambler.Conn){
+	defer ech2.Close()
+	n,ok := m.Uint(tag_size)
+	if !ok {
+		replyErr(ech2,EC_FAILED,"malformed request")
+		return
+	}
+	if n>maxDecoy { n = maxDecoy }
+	go func(){
+		io.Copy(ech2,io.LimitReader(zeros{},int64(n)))
+		ech2.CloseWrite()
+	}()
+	io.Copy(io.Discard,io.LimitReader(ech2,maxDecoy))
+}
+
+/*
+Decoy traffic generator. It builds circuits on a Poisson schedule and
+pushes synthetic traffic over them in both directions, so the circuits of
+Dial blend in, at least for an observer at the entry relay.
+*/
+type Decoy struct{
+	/* Mean time between two decoy circuits. Zero disables the generator. */
+	Interval time.Duration
+	
+	/*
+	Mean number of bytes per circuit and direction. The volumes of both
+	directions are drawn independently (exponentially distributed). Volumes
+	beyond maxDecoy are spread over several circuits to the exit.
+	*/
+	Volume int64
+	
+	/*
+	If set, each circuit connects to a random one of these addresses, sends
+	and reads up to its volumes. They should accept and send data, like an
+	echo or chargen service. Otherwise the exit acts as such.
+	*/
+	Targets []string
+	
+	/* The maximum number of bytes per day (UTC), both directions. Zero means unlimited. */
+	DailyCap int64
+	
+	mutex sync.Mutex
+	day   int64
+	used  int64
+}
+
+/* Reserves n bytes from today's budget. Returns the number of bytes granted. */
+func (d *Decoy) reserve(n int64) int64 {
+	if d.DailyCap<=0 { return n }
+	d.mutex.Lock(); defer d.mutex.Unlock()
+	day := time.Now().Unix()/86400
+	if day!=d.day { d.day,d.used = day,0 }
+	if n>d.DailyCap-d.used { n = d.DailyCap-d.used }
+	d.used += n
+	return n
+}
+
+/* Runs the generator until stop is closed. A nil stop runs it forever. */
+func (d *Decoy) Run(stop <-chan struct{}) {
+	if d.Interval<=0 { return }
+	t := time.NewTimer(0)
+	<-t.C
+	for {
+		t.Reset(time.Duration(rand.ExpFloat64()*float64(d.Interval)))
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
+		}
+		go d.circuit()
+	}
+}
+
+func (d *Decoy) circuit() {
+	up := int64(rand.ExpFloat64()*float64(d.Volume))
+	down := int64(rand.ExpFloat64()*float64(d.Volume))
+	if up+down<=0 { return }
+	n := d.reserve(up+down)
+	if n==0 { return }
+	if n<up+down {
+		up = int64(float64(up)*float64(n)/float64(up+down))
+		down = n-up
+	}
+	if len(d.Targets)!=0 {
+		conn,e := Dial("tcp",d.Targets[rand.Intn(len(d.Targets))])
+		if e!=nil {
+			log.Println("Decoy: Dial",e)
+			return
+		}
+		exchange(conn,up,down)
+		return
+	}
+	for up>0 || down>0 {
+		u,w := up,down
+		if u>maxDecoy { u = maxDecoy }
+		if w>maxDecoy { w = maxDecoy }
+		up,down = up-u,down-w
+		m := &anyproto.Message{Op:ap_echo}
+		ech,e := chopen_anyproto1(Level,m.AddUint(tag_size,uint64(w)))
+		if e!=nil {
+			log.Println("Decoy: chopen_anyproto1",e)
+			return
+		}
+		exchange(ech,u,w)
+	}
+}
+
+/* Sends up bytes and reads down bytes at the same time, then closes conn. */
+func exchange(conn io.ReadWriteCloser, up, down int64) {
+	defer conn.Close()
+	sent := make(chan struct{})
+	go func(){
+		defer close(sent)
+		io.Copy(conn,io.LimitReader(zeros{},up))
+		if cw,ok := conn.(interface{ CloseWrite() error }); ok { cw.CloseWrite() }
+	}()
+	io.Copy(io.Discard,io.LimitReader(conn,down))
+	<-sent
+}
+
+type zeros struct{}
+func (zeros) Read(b []byte) (int,error) {
+	for i := range b { b[i] = 0 }
+	return len(b),nil
+}
@@ -0,0 +1,106 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "strconv"
+import "errors"
+import "net"
+import "log"
+
+/*
+The extension in ssh.Permissions, that allows a user to open
+"direct-tcpip" channels. It has the same name as the OpenSSH certificate
+extension.
+*/
+const PermitForwarding = "permit-port-forwarding"
+
+/* The extra data of a "direct-tcpip" channel (RFC 4254, 7.2). */
+type directTCPIP struct{
+	Host     string
+	Port     uint32
+	OrigHost string
+	OrigPort uint32
+}
+
+/* Returns the permissions of the authenticated user, or nil. */
+func permissions(conn ssh.Conn) *ssh.Permissions {
+	if c,ok := conn.(*sconn); ok { conn = c.Conn }
+	if sc,ok := conn.(*ssh.ServerConn); ok { return sc.Permissions }
+	return nil
+}
+
+/* Asks f, whether conn may use host:port. If f is nil, the user needs the extension ext. */
+func permit(f func(ssh.Conn, string, uint32) bool, ext string, conn ssh.Conn, host string, port uint32) bool {
+	if f!=nil { return f(conn,host,port) }
+	p := permissions(conn)
+	if p==nil { return false }
+	_,ok := p.Extensions[ext]
+	return ok
+}
+
+func (s *Server) level() int {
+	if s.Level<=0 { return Level }
+	return s.Level
+}
+
+/*
+Serves "direct-tcpip" channels, as opened by "ssh -W host:port" or
+"ssh -D". The target is connected through the cascade with the Server's
+Level. It is not installed by default, use
+
+	s.HandleChannel("direct-tcpip",s.DirectTCPIP)
+*/
+func (s *Server) DirectTCPIP(conn ssh.Conn, nc ssh.NewChannel) {
+	var d directTCPIP
+	e := ssh.Unmarshal(nc.ExtraData(),&d)
+	if e!=nil || d.Port>0xffff {
+		nc.Reject(ssh.ConnectionFailed,"Malformed request!")
+		return
+	}
+	if !permit(s.PermitDirect,PermitForwarding,conn,d.Host,d.Port) {
+		nc.Reject(ssh.Prohibited,"Port forwarding not permitted!")
+		return
+	}
+	tc,e := DialLevel(s.level(),"tcp",net.JoinHostPort(d.Host,strconv.Itoa(int(d.Port))))
+	if e!=nil {
+		log.Println("DirectTCPIP: DialLevel",e)
+		var re *RemoteError
+		if errors.As(e,&re) && re.Code==EC_DENIED {
+			nc.Reject(ssh.Prohibited,e.Error())
+		} else {
+			nc.Reject(ssh.ConnectionFailed,e.Error())
+		}
+		return
+	}
+	ch,rq,e := nc.Accept()
+	if e!=nil {
+		tc.Close()
+		return
+	}
+	go ssh.DiscardRequests(rq)
+	s.relay().Relay(ch,tc)
+}
@@ -0,0 +1,277 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "net/http"
+import "context"
+import "bytes"
+import "io/ioutil"
+import "io"
+import "errors"
+import "time"
+import "sync"
+import "sort"
+import "net"
+import "log"
+
+/* The HTTP paths, an Authority serves. */
+const (
+	PathDescriptor = "/sotp/descriptor"
+	PathVote       = "/sotp/vote"
+	PathConsensus  = "/sotp/consensus"
+)
+
+var E_NOT_FOUND = errors.New("directory: document not found")
+var E_FUTURE = errors.New("directory: descriptor published in the future")
+
+/* The clock skew, tolerated for the publication time of a descriptor. */
+const maxSkew = 5*time.Minute
+
+/* Another directory authority. */
+type Peer struct{
+	/* The host:port of its HTTP service. */
+	Addr string
+	Key  ssh.PublicKey
+}
+
+func keys(peers []Peer) (r []ssh.PublicKey) {
+	for _,p := range peers { r = append(r,p.Key) }
+	return
+}
+
+type dialer func(network, addr string) (net.Conn,error)
+
+func (d dialer) client() *http.Client {
+	if d==nil { d = net.Dial }
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn,error) { return d(network,addr) },
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Minute,
+	}
+}
+func (d dialer) get(addr, path string) ([]byte,error) {
+	r,e := d.client().Get("http://"+addr+path)
+	if e!=nil { return nil,e }
+	defer r.Body.Close()
+	if r.StatusCode==http.StatusNotFound { return nil,E_NOT_FOUND }
+	if r.StatusCode!=http.StatusOK { return nil,errors.New("directory: "+addr+": "+r.Status) }
+	return ioutil.ReadAll(io.LimitReader(r.Body,MaxDocument))
+}
+func (d dialer) post(addr, path string, b []byte) error {
+	r,e := d.client().Post("http://"+addr+path,"text/plain",bytes.NewReader(b))
+	if e!=nil { return e }
+	defer r.Body.Close()
+	if r.StatusCode!=http.StatusOK { return errors.New("directory: "+addr+": "+r.Status) }
+	return nil
+}
+
+/*
+A directory authority. It serves its HTTP interface (ServeHTTP) and takes
+part in the rounds (Run) with its Peers.
+*/
+type Authority struct{
+	Key ssh.Signer
+	
+	/* The other authorities. */
+	Peers []Peer
+	
+	/* The length of a round. If zero, one hour is used. */
+	Interval time.Duration
+	
+	/*
+	The time between voting, computing the consensus and collecting the
+	signatures of the peers. If zero, a twentieth of Interval is used.
+	*/
+	Delay time.Duration
+	
+	/* Descriptors published longer ago are left out. If zero, three Intervals. */
+	MaxAge time.Duration
+	
+	/* Decides, whether a descriptor is listed. If nil, every valid descriptor is. */
+	Accept func(d *Descriptor) bool
+	
+	/* Dials the peers. If nil, net.Dial is used. */
+	Dial func(network, addr string) (net.Conn,error)
+	
+	mutex     sync.Mutex
+	descs     map[string]*Descriptor
+	vote      *Vote
+	consensus *Consensus
+}
+
+func (a *Authority) interval() time.Duration {
+	if a.Interval==0 { return time.Hour }
+	return a.Interval
+}
+func (a *Authority) delay() time.Duration {
+	if a.Delay==0 { return a.interval()/20 }
+	return a.Delay
+}
+func (a *Authority) maxAge() time.Duration {
+	if a.MaxAge==0 { return 3*a.interval() }
+	return a.MaxAge
+}
+func (a *Authority) keys() []ssh.PublicKey {
+	return append(keys(a.Peers),a.Key.PublicKey())
+}
+
+/*
+Adds a descriptor, replacing older ones of the same relay. Descriptors
+published in the future (beyond some clock skew) are rejected.
+*/
+func (a *Authority) Add(d *Descriptor) error {
+	if d.Published.After(time.Now().Add(maxSkew)) { return E_FUTURE }
+	if a.Accept!=nil && !a.Accept(d) { return errors.New("directory: descriptor not accepted") }
+	a.mutex.Lock(); defer a.mutex.Unlock()
+	if a.descs==nil { a.descs = make(map[string]*Descriptor) }
+	fp := d.Fingerprint()
+	if o := a.descs[fp]; o==nil || d.Published.After(o.Published) { a.descs[fp] = d }
+	return nil
+}
+
+/* Signs the vote for the round, now is in. */
+func (a *Authority) Vote(now time.Time) error {
+	v := new(Vote)
+	v.ValidAfter = now.Truncate(a.interval())
+	v.ValidUntil = v.ValidAfter.Add(a.interval())
+	v.Authority = ssh.FingerprintSHA256(a.Key.PublicKey())
+	a.mutex.Lock()
+	for fp,d := range a.descs {
+		if d.Published.Before(now.Add(-a.maxAge())) {
+			delete(a.descs,fp)
+			continue
+		}
+		v.Relays = append(v.Relays,d)
+	}
+	a.mutex.Unlock()
+	sort.Slice(v.Relays,func(i,j int) bool { return v.Relays[i].Fingerprint()<v.Relays[j].Fingerprint() })
+	v.encode("sotp-vote","authority "+v.Authority+"\n")
+	e := v.sign(a.Key)
+	if e!=nil { return e }
+	a.mutex.Lock()
+	a.vote = v
+	a.mutex.Unlock()
+	return nil
+}
+
+/*
+Fetches the votes of the peers for the current round and signs the
+consensus computed from them. Call Vote first.
+*/
+func (a *Authority) Compute() error {
+	a.mutex.Lock()
+	own := a.vote
+	a.mutex.Unlock()
+	if own==nil { return E_NOT_FOUND }
+	votes := []*Vote{own}
+	for _,p := range a.Peers {
+		b,e := dialer(a.Dial).get(p.Addr,PathVote)
+		if e!=nil { log.Println("directory: vote",p.Addr,e); continue }
+		v,e := ParseVote(b,p.Key)
+		if e!=nil { log.Println("directory: vote",p.Addr,e); continue }
+		if !v.ValidAfter.Equal(own.ValidAfter) { continue }
+		votes = append(votes,v)
+	}
+	c := compute(votes,len(a.Peers)+1,own.ValidAfter,own.ValidAfter.Add(3*a.interval()))
+	e := c.sign(a.Key)
+	if e!=nil { return e }
+	a.mutex.Lock()
+	if a.consensus!=nil { c.merge(a.consensus,a.keys()) }
+	a.consensus = c
+	a.mutex.Unlock()
+	return nil
+}
+
+/* Adds the peers' signatures of the same consensus. Call Compute first. */
+func (a *Authority) Gather() {
+	for _,p := range a.Peers {
+		b,e := dialer(a.Dial).get(p.Addr,PathConsensus)
+		if e!=nil { log.Println("directory: consensus",p.Addr,e); continue }
+		c,e := ParseConsensus(b)
+		if e!=nil { log.Println("directory: consensus",p.Addr,e); continue }
+		a.mutex.Lock()
+		if a.consensus!=nil { a.consensus.merge(c,a.keys()) }
+		a.mutex.Unlock()
+	}
+}
+
+/* Takes part in the rounds. Never returns. */
+func (a *Authority) Run() {
+	for {
+		now := time.Now()
+		e := a.Vote(now)
+		if e!=nil { log.Println("directory: Vote",e) }
+		time.Sleep(a.delay())
+		e = a.Compute()
+		if e!=nil { log.Println("directory: Compute",e) }
+		time.Sleep(a.delay())
+		a.Gather()
+		time.Sleep(now.Truncate(a.interval()).Add(a.interval()).Sub(time.Now()))
+	}
+}
+
+/* The current consensus, or nil. */
+func (a *Authority) Consensus() *Consensus {
+	a.mutex.Lock(); defer a.mutex.Unlock()
+	return a.consensus
+}
+
+func (a *Authority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var doc []byte
+	switch r.URL.Path {
+	case PathDescriptor:
+		if r.Method!="POST" {
+			http.Error(w,"POST only",http.StatusMethodNotAllowed)
+			return
+		}
+		b,e := ioutil.ReadAll(io.LimitReader(r.Body,MaxDocument))
+		if e!=nil { return }
+		d,e := ParseDescriptor(b)
+		if e==nil && d.Published.Before(time.Now().Add(-a.maxAge())) { e = E_EXPIRED }
+		if e==nil { e = a.Add(d) }
+		if e!=nil {
+			http.Error(w,e.Error(),http.StatusBadRequest)
+			return
+		}
+		return
+	case PathVote:
+		a.mutex.Lock()
+		if a.vote!=nil { doc = a.vote.Bytes() }
+		a.mutex.Unlock()
+	case PathConsensus:
+		a.mutex.Lock()
+		if a.consensus!=nil { doc = a.consensus.Bytes() }
+		a.mutex.Unlock()
+	}
+	if doc==nil {
+		http.NotFound(w,r)
+		return
+	}
+	w.Header().Set("Content-Type","text/plain")
+	w.Write(doc)
+}
@@ -0,0 +1,211 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "github.com/maxymania/sshproxy"
+import "golang.org/x/crypto/ssh"
+import "math/rand"
+import "errors"
+import "time"
+import "sync"
+import "net"
+import "log"
+
+var E_NO_RELAYS = errors.New("directory: no usable relays in the consensus")
+
+/*
+Fetches the consensus from the authorities and builds the sshproxy Client
+pool from it (see sshproxy.Replace). Unless Dial is set, the consensus is
+fetched over the cascade, so the pool needs some Clients to begin with.
+*/
+type Client struct{
+	Authorities []Peer
+	
+	/* The number of authorities, that must sign the consensus. If zero, a majority. */
+	Threshold int
+	
+	/* How often the consensus is fetched. If zero, every ten minutes. */
+	Interval time.Duration
+	
+	/* Dials the authorities. If nil, sshproxy.Dial is used. */
+	Dial func(network, addr string) (net.Conn,error)
+	
+	/* Decides, whether a relay is used. If nil, every relay is. */
+	Filter func(d *Descriptor) bool
+	
+	/*
+	The template for the SSH client configuration of the relays (user and
+	authentication). HostKeyCallback is replaced by one, that accepts the
+	relay's host key only. Used, if New is nil.
+	*/
+	SSH ssh.ClientConfig
+	
+	/* Creates the pool entry for a relay. If nil, one based on SSH is created. */
+	New func(d *Descriptor) (*sshproxy.Client,error)
+	
+	mutex     sync.Mutex
+	consensus *Consensus
+	clients   map[string]*sshproxy.Client
+}
+
+func (c *Client) threshold() int {
+	if c.Threshold==0 { return len(c.Authorities)/2+1 }
+	return c.Threshold
+}
+func (c *Client) interval() time.Duration {
+	if c.Interval==0 { return 10*time.Minute }
+	return c.Interval
+}
+func (c *Client) dial() dialer {
+	if c.Dial==nil { return sshproxy.Dial }
+	return c.Dial
+}
+
+/* Fetches and verifies the consensus, trying the authorities in random order. */
+func (c *Client) Fetch() (*Consensus,error) {
+	var err error = E_NOT_FOUND
+	keys := keys(c.Authorities)
+	for _,i := range rand.Perm(len(c.Authorities)) {
+		p := c.Authorities[i]
+		b,e := c.dial().get(p.Addr,PathConsensus)
+		if e!=nil { err = e; continue }
+		cs,e := ParseConsensus(b)
+		if e==nil { e = cs.Verify(keys,c.threshold(),time.Now()) }
+		if e!=nil { err = e; continue }
+		return cs,nil
+	}
+	return nil,err
+}
+
+func (c *Client) newClient(d *Descriptor) (*sshproxy.Client,error) {
+	if c.New!=nil { return c.New(d) }
+	cl := new(sshproxy.Client)
+	cl.Client = c.SSH
+	cl.Client.HostKeyCallback = ssh.FixedHostKey(d.HostKey)
+	cl.Net = d.Net
+	cl.Addr = d.Addr
+	return cl,nil
+}
+
+/* The pool entries are kept, as long as the relay's address stays the same. */
+func key(d *Descriptor) string { return d.Fingerprint()+" "+d.Net+" "+d.Addr }
+
+/*
+Fetches the consensus and replaces the pool with its relays. If none of
+them is usable, the pool is left alone.
+*/
+func (c *Client) Update() error {
+	cs,e := c.Fetch()
+	if e!=nil { return e }
+	c.mutex.Lock(); defer c.mutex.Unlock()
+	if c.consensus!=nil && cs.ValidAfter.Before(c.consensus.ValidAfter) { return nil }
+	clients := make(map[string]*sshproxy.Client)
+	var pool []*sshproxy.Client
+	for _,d := range cs.Relays {
+		if c.Filter!=nil && !c.Filter(d) { continue }
+		k := key(d)
+		cl := c.clients[k]
+		if cl==nil {
+			cl,e = c.newClient(d)
+			if e!=nil { log.Println("directory: relay",d.Nickname,e); continue }
+		}
+		clients[k] = cl
+		pool = append(pool,cl)
+	}
+	if len(pool)==0 { return E_NO_RELAYS }
+	sshproxy.Replace(pool)
+	c.consensus = cs
+	c.clients = clients
+	return nil
+}
+
+/* The consensus, the pool is built from, or nil. */
+func (c *Client) Consensus() *Consensus {
+	c.mutex.Lock(); defer c.mutex.Unlock()
+	return c.consensus
+}
+
+/*
+Updates the pool every Interval, starting right away, unless Update
+succeeded before. Never returns.
+*/
+func (c *Client) Run() {
+	if c.Consensus()!=nil { time.Sleep(c.interval()) }
+	for {
+		e := c.Update()
+		if e!=nil { log.Println("directory: Update",e) }
+		time.Sleep(c.interval())
+	}
+}
+
+/* Publishes a relay's descriptor to the authorities. */
+type Publisher struct{
+	/* The descriptor. Published and HostKey are set on every publication. */
+	Descriptor Descriptor
+	
+	/* The relay's SSH host key. */
+	Key ssh.Signer
+	
+	/* The host:port of the authorities. */
+	Authorities []string
+	
+	/* How often the descriptor is published. If zero, every 30 minutes. */
+	Interval time.Duration
+	
+	/* Dials the authorities. If nil, net.Dial is used. */
+	Dial func(network, addr string) (net.Conn,error)
+}
+
+/* Signs and publishes the descriptor. Fails, if no authority took it. */
+func (p *Publisher) Publish() error {
+	d := p.Descriptor
+	d.Published = time.Now()
+	e := d.Sign(p.Key)
+	if e!=nil { return e }
+	err := E_NOT_FOUND
+	ok := false
+	for _,a := range p.Authorities {
+		e = dialer(p.Dial).post(a,PathDescriptor,d.Bytes())
+		if e!=nil {
+			log.Println("directory: publish",a,e)
+			err = e
+			continue
+		}
+		ok = true
+	}
+	if ok { return nil }
+	return err
+}
+
+/* Publishes the descriptor every Interval. Never returns. */
+func (p *Publisher) Run() {
+	iv := p.Interval
+	if iv==0 { iv = 30*time.Minute }
+	for {
+		e := p.Publish()
+		if e!=nil { log.Println("directory: Publish",e) }
+		time.Sleep(iv)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "github.com/maxymania/sshproxy"
+import "golang.org/x/crypto/ssh"
+import "net/http/httptest"
+import "testing"
+import "strings"
+import "time"
+import "net"
+
+/* Returns the addresses of the pool, in order. */
+func pool() (r []string) {
+	for _,c := range sshproxy.Clients() { r = append(r,c.Addr) }
+	return
+}
+
+/*
+Runs a round of two authorities on loopback, which list the relays published
+to them. Returns the authorities as Peers.
+*/
+func round(t *testing.T, relays []string) []Peer {
+	ks := []ssh.Signer{signer(t),signer(t)}
+	as := make([]*Authority,len(ks))
+	ps := make([]Peer,len(ks))
+	for i,k := range ks {
+		as[i] = &Authority{Key:k,Dial:net.Dial}
+		s := httptest.NewServer(as[i])
+		t.Cleanup(s.Close)
+		ps[i] = Peer{Addr:strings.TrimPrefix(s.URL,"http://"),Key:k.PublicKey()}
+	}
+	var addrs []string
+	for i,a := range as {
+		a.Peers = []Peer{ps[1-i]}
+		addrs = append(addrs,ps[i].Addr)
+	}
+	for _,r := range relays {
+		p := &Publisher{Descriptor:Descriptor{Nickname:"relay",Addr:r},Key:signer(t),Authorities:addrs,Dial:net.Dial}
+		if e := p.Publish(); e!=nil { t.Fatal(e) }
+	}
+	now := time.Now()
+	for _,a := range as {
+		if e := a.Vote(now); e!=nil { t.Fatal(e) }
+	}
+	for _,a := range as {
+		if e := a.Compute(); e!=nil { t.Fatal(e) }
+	}
+	for _,a := range as { a.Gather() }
+	return ps
+}
+
+func TestClient(t *testing.T) {
+	relays := []string{"192.0.2.1:22","192.0.2.2:22","192.0.2.3:22"}
+	ps := round(t,relays)
+	drop := ""
+	c := &Client{
+		Authorities: ps,
+		Dial: net.Dial,
+		Filter: func(d *Descriptor) bool { return d.Addr!=drop },
+		New: func(d *Descriptor) (*sshproxy.Client,error) { return &sshproxy.Client{Net:d.Net,Addr:d.Addr},nil },
+	}
+	sshproxy.Replace([]*sshproxy.Client{ {Net:"tcp",Addr:"192.0.2.99:22"} })
+	if e := c.Update(); e!=nil { t.Fatal(e) }
+	got := pool()
+	if len(got)!=3 { t.Fatal("pool",got) }
+	for _,r := range relays {
+		if !strings.Contains(strings.Join(got," "),r) { t.Error(r,"missing in",got) }
+	}
+	if c.Consensus()==nil { t.Error("no consensus") }
+	
+	/* The pool entries of the relays, that stay, are kept. */
+	old := make(map[string]*sshproxy.Client)
+	for _,cl := range sshproxy.Clients() { old[cl.Addr] = cl }
+	drop = relays[1]
+	if e := c.Update(); e!=nil { t.Fatal(e) }
+	if got = pool(); len(got)!=2 { t.Fatal("pool",got) }
+	for _,cl := range sshproxy.Clients() {
+		if cl.Addr==drop { t.Error("filtered relay in the pool") }
+		if old[cl.Addr]!=cl { t.Error("pool entry of",cl.Addr,"replaced") }
+	}
+	
+	/* Without usable relays, the pool is left alone. */
+	c.Filter = func(d *Descriptor) bool { return false }
+	if e := c.Update(); e!=E_NO_RELAYS { t.Error("no relays:",e) }
+	if got := pool(); len(got)!=2 { t.Error("pool changed",got) }
+}
+
+func TestClientThreshold(t *testing.T) {
+	ps := round(t,[]string{"192.0.2.1:22"})
+	for _,c := range []struct{ th int; e error }{ {0,nil},{1,nil},{2,nil},{3,E_UNSIGNED} } {
+		cl := &Client{Authorities:ps,Threshold:c.th,Dial:net.Dial}
+		if _,e := cl.Fetch(); e!=c.e { t.Errorf("threshold %d: %v",c.th,e) }
+	}
+	/* An authority unknown to the client doesn't count. */
+	cl := &Client{Authorities:[]Peer{ps[0],{Addr:ps[1].Addr,Key:signer(t).PublicKey()}},Threshold:2,Dial:net.Dial}
+	if _,e := cl.Fetch(); e!=E_UNSIGNED { t.Error("foreign authority:",e) }
+}
+
+/* The default pool entries only accept the relay's host key. */
+func TestNewClient(t *testing.T) {
+	k := signer(t)
+	d := descriptor(t,k,"192.0.2.1:22",time.Now())
+	cl,e := (&Client{SSH:ssh.ClientConfig{User:"test"}}).newClient(d)
+	if e!=nil { t.Fatal(e) }
+	if cl.Net!=d.Net || cl.Addr!=d.Addr || cl.Client.User!="test" { t.Error("client",cl.Net,cl.Addr,cl.Client.User) }
+	addr := &net.TCPAddr{IP:net.IPv4(192,0,2,1),Port:22}
+	if cl.Client.HostKeyCallback("relay",addr,k.PublicKey())!=nil { t.Error("relay key rejected") }
+	if cl.Client.HostKeyCallback("relay",addr,signer(t).PublicKey())==nil { t.Error("other key accepted") }
+}
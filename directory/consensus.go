@@ -0,0 +1,208 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "strconv"
+import "bytes"
+import "sort"
+import "time"
+
+/* A list of descriptors, as in votes and consensus documents. */
+type list struct{
+	ValidAfter time.Time
+	ValidUntil time.Time
+	Relays     []*Descriptor
+	
+	body []byte
+	sigs []item
+}
+func (l *list) encode(kind string, extra string) {
+	b := []byte(kind+" 1\n"+extra)
+	b = append(b,"valid-after "+strconv.FormatInt(l.ValidAfter.Unix(),10)+"\n"...)
+	b = append(b,"valid-until "+strconv.FormatInt(l.ValidUntil.Unix(),10)+"\n"...)
+	for _,d := range l.Relays {
+		b = append(b,"descriptor "+strconv.Itoa(len(d.raw))+"\n"...)
+		b = append(b,d.raw...)
+	}
+	l.body = b
+	l.sigs = nil
+}
+func (l *list) parse(kind string, b []byte) (extra []item,e error) {
+	var its []item
+	l.body,its,l.sigs,e = split(b)
+	if e!=nil { return }
+	if len(its)==0 || its[0].kw!=kind || len(its[0].args)!=1 || its[0].args[0]!="1" { return nil,E_FORMAT }
+	for _,it := range its[1:] {
+		switch it.kw {
+		case "valid-after","valid-until":
+			if len(it.args)!=1 { return nil,E_FORMAT }
+			t,e := unix(it.args[0])
+			if e!=nil { return nil,e }
+			if it.kw=="valid-after" { l.ValidAfter = t } else { l.ValidUntil = t }
+		case "descriptor":
+			d,e := ParseDescriptor(it.blob)
+			if e!=nil { return nil,e }
+			l.Relays = append(l.Relays,d)
+		default:
+			extra = append(extra,it)
+		}
+	}
+	if l.ValidAfter.IsZero() || !l.ValidUntil.After(l.ValidAfter) { return nil,E_FORMAT }
+	return
+}
+func (l *list) sign(k ssh.Signer) error {
+	s,e := sign(k,l.body)
+	if e!=nil { return e }
+	its,e := items(s)
+	if e!=nil { return e }
+	fp := its[0].args[0]
+	for i,o := range l.sigs {
+		if o.args[0]==fp { l.sigs[i] = its[0]; return nil }
+	}
+	l.sigs = append(l.sigs,its[0])
+	sort.Slice(l.sigs,func(i,j int) bool { return l.sigs[i].args[0]<l.sigs[j].args[0] })
+	return nil
+}
+/* Returns the keys out of keys, that signed the list. */
+func (l *list) signers(keys []ssh.PublicKey) (r []ssh.PublicKey) {
+	for _,k := range keys {
+		for _,s := range l.sigs {
+			if verify(k,l.body,s) { r = append(r,k); break }
+		}
+	}
+	return
+}
+func (l *list) bytes() []byte {
+	b := append([]byte(nil),l.body...)
+	for _,s := range l.sigs {
+		b = append(b,"signature "+s.args[0]+" "+s.args[1]+"\n"...)
+	}
+	return b
+}
+
+/* An authority's list of the fresh descriptors it knows, for one round. */
+type Vote struct{
+	list
+	
+	/* The fingerprint of the authority's key. */
+	Authority string
+}
+func (v *Vote) Bytes() []byte { return v.bytes() }
+
+/* Parses a vote and verifies, that it is signed by key. A relay may be listed only once. */
+func ParseVote(b []byte, key ssh.PublicKey) (*Vote,error) {
+	v := new(Vote)
+	ex,e := v.parse("sotp-vote",b)
+	if e!=nil { return nil,e }
+	seen := make(map[string]bool,len(v.Relays))
+	for _,d := range v.Relays {
+		fp := d.Fingerprint()
+		if seen[fp] { return nil,E_FORMAT }
+		seen[fp] = true
+	}
+	for _,it := range ex {
+		if it.kw=="authority" && len(it.args)==1 { v.Authority = it.args[0] }
+	}
+	if v.Authority!=ssh.FingerprintSHA256(key) || len(v.signers([]ssh.PublicKey{key}))==0 { return nil,E_SIGNATURE }
+	return v,nil
+}
+
+/* The list of relays, the authorities agreed on, signed by some of them. */
+type Consensus struct{
+	list
+}
+
+/* The document with all signatures collected so far. */
+func (c *Consensus) Bytes() []byte { return c.bytes() }
+
+/* Parses a consensus. The signatures are checked by Verify. */
+func ParseConsensus(b []byte) (*Consensus,error) {
+	c := new(Consensus)
+	_,e := c.parse("sotp-consensus",b)
+	if e!=nil { return nil,e }
+	return c,nil
+}
+
+/*
+Verifies, that at least threshold of keys signed the consensus and that it
+is valid at now.
+*/
+func (c *Consensus) Verify(keys []ssh.PublicKey, threshold int, now time.Time) error {
+	if len(c.signers(keys))<threshold { return E_UNSIGNED }
+	if now.Before(c.ValidAfter) || !now.Before(c.ValidUntil) { return E_EXPIRED }
+	return nil
+}
+
+/* Adds the signatures of o out of keys, if o is the same document. */
+func (c *Consensus) merge(o *Consensus, keys []ssh.PublicKey) {
+	if !bytes.Equal(c.body,o.body) { return }
+	for _,k := range o.signers(keys) {
+		if len(c.signers([]ssh.PublicKey{k}))!=0 { continue }
+		fp := ssh.FingerprintSHA256(k)
+		for _,s := range o.sigs {
+			if s.args[0]==fp && verify(k,o.body,s) { c.sigs = append(c.sigs,s); break }
+		}
+	}
+	sort.Slice(c.sigs,func(i,j int) bool { return c.sigs[i].args[0]<c.sigs[j].args[0] })
+}
+
+/*
+Computes the consensus of the votes of a round, out of n authorities: the
+relays listed by more than n/2 of the votes, each with the newest
+descriptor any of them lists. Every vote must be from a different authority
+and counts once per relay. Descriptors published after the round are ignored.
+*/
+func compute(votes []*Vote, n int, after, until time.Time) *Consensus {
+	count := make(map[string]int)
+	newest := make(map[string]*Descriptor)
+	for _,v := range votes {
+		seen := make(map[string]bool,len(v.Relays))
+		for _,d := range v.Relays {
+			fp := d.Fingerprint()
+			if seen[fp] || d.Published.After(until) { continue }
+			seen[fp] = true
+			count[fp]++
+			o := newest[fp]
+			if o==nil || d.Published.After(o.Published) || (d.Published.Equal(o.Published) && newer(d,o)) {
+				newest[fp] = d
+			}
+		}
+	}
+	c := new(Consensus)
+	c.ValidAfter,c.ValidUntil = after,until
+	for fp,d := range newest {
+		if count[fp]>n/2 { c.Relays = append(c.Relays,d) }
+	}
+	sort.Slice(c.Relays,func(i,j int) bool { return c.Relays[i].Fingerprint()<c.Relays[j].Fingerprint() })
+	c.encode("sotp-consensus","")
+	return c
+}
+
+/* A deterministic tie breaker for descriptors published at the same second. */
+func newer(a, b *Descriptor) bool {
+	x,y := a.digest(),b.digest()
+	return bytes.Compare(x[:],y[:])>0
+}
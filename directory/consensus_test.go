@@ -0,0 +1,164 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "testing"
+import "bytes"
+import "time"
+
+/* A signed vote of the authority a, listing ds. */
+func vote(t *testing.T, a ssh.Signer, after time.Time, ds ...*Descriptor) *Vote {
+	v := new(Vote)
+	v.ValidAfter,v.ValidUntil = after,after.Add(time.Hour)
+	v.Authority = ssh.FingerprintSHA256(a.PublicKey())
+	v.Relays = ds
+	v.encode("sotp-vote","authority "+v.Authority+"\n")
+	if e := v.sign(a); e!=nil { t.Fatal(e) }
+	return v
+}
+
+func pubkeys(ks []ssh.Signer) (r []ssh.PublicKey) {
+	for _,k := range ks { r = append(r,k.PublicKey()) }
+	return
+}
+
+func TestVote(t *testing.T) {
+	a,b,r := signer(t),signer(t),signer(t)
+	now := time.Now().Truncate(time.Second)
+	v := vote(t,a,now.Truncate(time.Hour),descriptor(t,r,"a:1",now))
+	p,e := ParseVote(v.Bytes(),a.PublicKey())
+	if e!=nil { t.Fatal(e) }
+	if len(p.Relays)!=1 || p.Relays[0].Addr!="a:1" || !bytes.Equal(p.Relays[0].Bytes(),v.Relays[0].Bytes()) { t.Error("relays",p.Relays) }
+	if _,e := ParseVote(v.Bytes(),b.PublicKey()); e==nil { t.Error("vote of another authority accepted") }
+	/* A relay listed twice in one vote. */
+	v = vote(t,a,now.Truncate(time.Hour),descriptor(t,r,"a:1",now),descriptor(t,r,"a:2",now.Add(-time.Second)))
+	if _,e := ParseVote(v.Bytes(),a.PublicKey()); e!=E_FORMAT { t.Error("duplicate relay:",e) }
+}
+
+/*
+Three authorities vote on relays 0 to 3. A relay must be listed by a majority
+(two votes). Each listed[i] are the relays of authority i; a relay listed
+twice by one vote still counts once.
+*/
+var majorityCases = []struct{
+	name   string
+	listed [][]int
+	want   []int
+}{
+	{"all",[][]int{ {0,1},{0,1},{0,1} },[]int{0,1}},
+	{"majority",[][]int{ {0,1,2},{0,2},{3} },[]int{0,2}},
+	{"minority",[][]int{ {0},{1},{2} },nil},
+	{"duplicate",[][]int{ {0,0},{1},{} },nil},
+	{"duplicates",[][]int{ {0,0,1,1},{0},{1,1} },[]int{0,1}},
+	{"missing votes",[][]int{ {0,1} },nil},
+}
+
+func TestMajority(t *testing.T) {
+	as := []ssh.Signer{signer(t),signer(t),signer(t)}
+	rs := []ssh.Signer{signer(t),signer(t),signer(t),signer(t)}
+	now := time.Now().Truncate(time.Second)
+	after := now.Truncate(time.Hour)
+	for _,c := range majorityCases {
+		var votes []*Vote
+		for i,l := range c.listed {
+			var ds []*Descriptor
+			for j,r := range l {
+				/* Later copies of the same relay are newer. */
+				ds = append(ds,descriptor(t,rs[r],"relay:"+string(rune('0'+r)),now.Add(-time.Duration(10-j)*time.Second)))
+			}
+			votes = append(votes,vote(t,as[i],after,ds...))
+		}
+		cs := compute(votes,len(as),after,after.Add(time.Hour))
+		got := make(map[string]bool)
+		for _,d := range cs.Relays { got[d.Fingerprint()] = true }
+		if len(cs.Relays)!=len(c.want) { t.Errorf("%s: %d relays",c.name,len(cs.Relays)) }
+		for _,r := range c.want {
+			if !got[ssh.FingerprintSHA256(rs[r].PublicKey())] { t.Errorf("%s: relay %d missing",c.name,r) }
+		}
+	}
+}
+
+/* The newest descriptor of a relay wins, the order of the votes doesn't matter. */
+func TestNewest(t *testing.T) {
+	as := []ssh.Signer{signer(t),signer(t),signer(t)}
+	r := signer(t)
+	now := time.Now().Truncate(time.Second)
+	after := now.Truncate(time.Hour)
+	v0 := vote(t,as[0],after,descriptor(t,r,"old:1",now.Add(-time.Minute)))
+	v1 := vote(t,as[1],after,descriptor(t,r,"new:1",now))
+	v2 := vote(t,as[2],after,descriptor(t,r,"future:1",after.Add(2*time.Hour)))
+	c1 := compute([]*Vote{v0,v1,v2},3,after,after.Add(time.Hour))
+	c2 := compute([]*Vote{v2,v1,v0},3,after,after.Add(time.Hour))
+	if !bytes.Equal(c1.body,c2.body) { t.Error("not deterministic") }
+	if len(c1.Relays)!=1 || c1.Relays[0].Addr!="new:1" { t.Error("relays",c1.Relays) }
+}
+
+func TestThreshold(t *testing.T) {
+	as := []ssh.Signer{signer(t),signer(t),signer(t)}
+	keys := pubkeys(as)
+	now := time.Now()
+	after := now.Truncate(time.Hour)
+	v := vote(t,as[0],after,descriptor(t,signer(t),"a:1",now))
+	var cs []*Consensus
+	for _,a := range as {
+		c := compute([]*Vote{v,v,v},3,after,after.Add(time.Hour))
+		if e := c.sign(a); e!=nil { t.Fatal(e) }
+		cs = append(cs,c)
+	}
+	c := cs[0]
+	for i := 1; i<=len(as); i++ {
+		p,e := ParseConsensus(c.Bytes())
+		if e!=nil { t.Fatal(e) }
+		for th := 1; th<=len(as); th++ {
+			e := p.Verify(keys,th,now)
+			if (e==nil)!=(th<=i) { t.Errorf("%d signatures, threshold %d: %v",i,th,e) }
+			if e!=nil && e!=E_UNSIGNED { t.Error(e) }
+		}
+		if i<len(as) { c.merge(cs[i],keys) }
+	}
+	/* Signatures of unknown keys and duplicates don't count. */
+	c.sign(signer(t))
+	c.merge(cs[1],keys)
+	if n := len(c.signers(keys)); n!=len(as) { t.Error("signers",n) }
+	if c.Verify(keys[1:],3,now)!=E_UNSIGNED { t.Error("signature of an unknown key counted") }
+	if c.Verify(keys,3,after.Add(time.Hour))!=E_EXPIRED || c.Verify(keys,3,after.Add(-time.Second))!=E_EXPIRED { t.Error("validity") }
+	/* A different document isn't merged. */
+	o := compute(nil,3,after,after.Add(time.Hour))
+	o.sign(as[0])
+	o.merge(cs[1],keys)
+	if len(o.signers(keys))!=1 { t.Error("merged a different document") }
+}
+
+func TestFuture(t *testing.T) {
+	a := &Authority{Key:signer(t)}
+	r := signer(t)
+	now := time.Now()
+	if e := a.Add(descriptor(t,r,"a:1",now.Add(maxSkew+time.Minute))); e!=E_FUTURE { t.Error("future descriptor:",e) }
+	if e := a.Add(descriptor(t,r,"a:1",now.Add(maxSkew-time.Minute))); e!=nil { t.Error("skewed descriptor:",e) }
+	if e := a.Add(descriptor(t,r,"a:2",now.Add(-time.Minute))); e!=nil { t.Error(e) }
+	if e := a.Vote(now); e!=nil { t.Fatal(e) }
+	if len(a.vote.Relays)!=1 || a.vote.Relays[0].Addr!="a:1" { t.Error("the newest descriptor is not kept") }
+}
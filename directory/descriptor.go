@@ -0,0 +1,232 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "crypto/sha256"
+import "encoding/base64"
+import "strconv"
+import "strings"
+import "errors"
+import "time"
+import "net"
+
+var E_FIELD = errors.New("directory: invalid descriptor field")
+
+/* The maximum size of a relay's identity key. */
+const MaxIdentity = 4096
+
+/* An exit policy rule, like "accept *:443" or "reject 10.0.0.0/8:*". */
+type Rule struct{
+	Accept bool
+	
+	/* The matching addresses. nil matches every host, including names. */
+	Net *net.IPNet
+	
+	PortMin, PortMax uint16
+}
+func ParseRule(s string) (r Rule,e error) {
+	f := strings.Fields(s)
+	if len(f)!=2 { return r,E_FIELD }
+	switch f[0] {
+	case "accept": r.Accept = true
+	case "reject":
+	default: return r,E_FIELD
+	}
+	i := strings.LastIndexByte(f[1],':')
+	if i<0 { return r,E_FIELD }
+	h,p := strings.Trim(f[1][:i],"[]"),f[1][i+1:]
+	switch {
+	case h=="*":
+	case strings.IndexByte(h,'/')>=0:
+		_,r.Net,e = net.ParseCIDR(h)
+		if e!=nil { return r,E_FIELD }
+	default:
+		ip := net.ParseIP(h)
+		if ip==nil { return r,E_FIELD }
+		if ip4 := ip.To4(); ip4!=nil { ip = ip4 }
+		r.Net = &net.IPNet{IP:ip,Mask:net.CIDRMask(len(ip)*8,len(ip)*8)}
+	}
+	if p=="*" {
+		r.PortMin,r.PortMax = 0,0xffff
+		return
+	}
+	lo,hi := p,p
+	if j := strings.IndexByte(p,'-'); j>=0 { lo,hi = p[:j],p[j+1:] }
+	a,e1 := strconv.ParseUint(lo,10,16)
+	b,e2 := strconv.ParseUint(hi,10,16)
+	if e1!=nil || e2!=nil || a>b { return r,E_FIELD }
+	r.PortMin,r.PortMax = uint16(a),uint16(b)
+	return
+}
+func (r Rule) String() string {
+	s := "reject "
+	if r.Accept { s = "accept " }
+	if r.Net==nil {
+		s += "*"
+	} else if o,b := r.Net.Mask.Size(); o==b && r.Net.IP.To4()==nil {
+		s += "["+r.Net.IP.String()+"]"
+	} else if o==b {
+		s += r.Net.IP.String()
+	} else {
+		s += r.Net.String()
+	}
+	switch {
+	case r.PortMin==0 && r.PortMax==0xffff: return s+":*"
+	case r.PortMin==r.PortMax: return s+":"+strconv.Itoa(int(r.PortMin))
+	}
+	return s+":"+strconv.Itoa(int(r.PortMin))+"-"+strconv.Itoa(int(r.PortMax))
+}
+func (r Rule) Match(host string, port uint16) bool {
+	if port<r.PortMin || port>r.PortMax { return false }
+	if r.Net==nil { return true }
+	ip := net.ParseIP(host)
+	return ip!=nil && r.Net.Contains(ip)
+}
+
+/*
+A relay's self-description. It is signed with the relay's SSH host key,
+so it can be passed on by anyone.
+*/
+type Descriptor struct{
+	/* A name for humans, without white space. */
+	Nickname string
+	
+	/* Where clients connect to. Net defaults to "tcp". */
+	Net, Addr string
+	
+	/* The relay's SSH host key. Sign sets it. */
+	HostKey ssh.PublicKey
+	
+	/* The relay's scrambler identity key, if any. Opaque to the directory. */
+	Identity []byte
+	
+	/* The advertised bandwidth in bytes per second. */
+	Bandwidth uint64
+	
+	/*
+	The exit policy. The first matching rule applies, if none does, the target
+	is rejected. The relay enforces it (see sshproxy.Server.PermitExit).
+	*/
+	Policy []Rule
+	
+	Published time.Time
+	
+	raw []byte
+}
+
+/* Returns the SHA256 fingerprint of the host key, which identifies the relay. */
+func (d *Descriptor) Fingerprint() string { return ssh.FingerprintSHA256(d.HostKey) }
+
+/* Whether the exit policy allows connections to host:port. */
+func (d *Descriptor) Allows(host string, port uint16) bool {
+	for _,r := range d.Policy {
+		if r.Match(host,port) { return r.Accept }
+	}
+	return false
+}
+
+/* The signed document. Nil, until the descriptor is signed or parsed. */
+func (d *Descriptor) Bytes() []byte { return d.raw }
+
+func (d *Descriptor) digest() [32]byte { return sha256.Sum256(d.raw) }
+
+func token(s string) bool {
+	return s!="" && len(strings.Fields(s))==1 && strings.TrimSpace(s)==s
+}
+
+func (d *Descriptor) body() ([]byte,error) {
+	nt := d.Net
+	if nt=="" { nt = "tcp" }
+	if !token(d.Nickname) || !token(nt) || !token(d.Addr) || len(d.Identity)>MaxIdentity { return nil,E_FIELD }
+	b := []byte("sotp-descriptor 1\n")
+	b = append(b,"nickname "+d.Nickname+"\n"...)
+	b = append(b,"address "+nt+" "+d.Addr+"\n"...)
+	b = append(b,"host-key "...)
+	b = append(b,ssh.MarshalAuthorizedKey(d.HostKey)...)
+	if len(d.Identity)!=0 {
+		b = append(b,"identity "+base64.StdEncoding.EncodeToString(d.Identity)+"\n"...)
+	}
+	b = append(b,"bandwidth "+strconv.FormatUint(d.Bandwidth,10)+"\n"...)
+	for _,r := range d.Policy {
+		b = append(b,"policy "+r.String()+"\n"...)
+	}
+	b = append(b,"published "+strconv.FormatInt(d.Published.Unix(),10)+"\n"...)
+	return b,nil
+}
+
+/* Sets the host key to k's public key and signs the descriptor. */
+func (d *Descriptor) Sign(k ssh.Signer) error {
+	d.HostKey = k.PublicKey()
+	b,e := d.body()
+	if e!=nil { return e }
+	s,e := sign(k,b)
+	if e!=nil { return e }
+	d.raw = append(b,s...)
+	return nil
+}
+
+/* Parses a descriptor and verifies its signature. */
+func ParseDescriptor(b []byte) (*Descriptor,error) {
+	body,its,sigs,e := split(b)
+	if e!=nil { return nil,e }
+	if len(its)==0 || its[0].kw!="sotp-descriptor" || len(its[0].args)!=1 || its[0].args[0]!="1" { return nil,E_FORMAT }
+	d := new(Descriptor)
+	for _,it := range its[1:] {
+		a := it.args
+		switch it.kw {
+		case "nickname":
+			if len(a)!=1 { return nil,E_FORMAT }
+			d.Nickname = a[0]
+		case "address":
+			if len(a)!=2 { return nil,E_FORMAT }
+			d.Net,d.Addr = a[0],a[1]
+		case "host-key":
+			d.HostKey,_,_,_,e = ssh.ParseAuthorizedKey([]byte(strings.Join(a," ")))
+			if e!=nil { return nil,E_FORMAT }
+		case "identity":
+			if len(a)!=1 || d.Identity!=nil { return nil,E_FORMAT }
+			d.Identity,e = base64.StdEncoding.DecodeString(a[0])
+			if e!=nil || len(d.Identity)==0 || len(d.Identity)>MaxIdentity { return nil,E_FORMAT }
+		case "bandwidth":
+			if len(a)!=1 { return nil,E_FORMAT }
+			d.Bandwidth,e = strconv.ParseUint(a[0],10,64)
+			if e!=nil { return nil,E_FORMAT }
+		case "policy":
+			r,e := ParseRule(strings.Join(a," "))
+			if e!=nil { return nil,e }
+			d.Policy = append(d.Policy,r)
+		case "published":
+			if len(a)!=1 { return nil,E_FORMAT }
+			d.Published,e = unix(a[0])
+			if e!=nil { return nil,e }
+		/* Unknown items are ignored, for newer relays. */
+		}
+	}
+	if d.HostKey==nil || d.Addr=="" || d.Published.IsZero() { return nil,E_FORMAT }
+	if len(sigs)!=1 || !verify(d.HostKey,body,sigs[0]) { return nil,E_SIGNATURE }
+	d.raw = b
+	return d,nil
+}
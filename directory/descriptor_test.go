@@ -0,0 +1,140 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "crypto/ed25519"
+import "crypto/rand"
+import "testing"
+import "bytes"
+import "time"
+
+func signer(t *testing.T) ssh.Signer {
+	_,pk,e := ed25519.GenerateKey(rand.Reader)
+	if e!=nil { t.Fatal(e) }
+	s,e := ssh.NewSignerFromKey(pk)
+	if e!=nil { t.Fatal(e) }
+	return s
+}
+
+/* A signed descriptor of the relay k, with a small exit policy. */
+func descriptor(t *testing.T, k ssh.Signer, addr string, pub time.Time) *Descriptor {
+	d := &Descriptor{Nickname:"relay",Addr:addr,Bandwidth:1000,Identity:[]byte("identity key"),Published:pub}
+	for _,s := range []string{"reject 10.0.0.0/8:*","accept *:80-443"} {
+		r,e := ParseRule(s)
+		if e!=nil { t.Fatal(e) }
+		d.Policy = append(d.Policy,r)
+	}
+	if e := d.Sign(k); e!=nil { t.Fatal(e) }
+	return d
+}
+
+func TestDescriptor(t *testing.T) {
+	k := signer(t)
+	d := descriptor(t,k,"192.0.2.1:22",time.Unix(1500000000,0))
+	p,e := ParseDescriptor(d.Bytes())
+	if e!=nil { t.Fatal(e) }
+	switch {
+	case p.Nickname!="relay" || p.Net!="tcp" || p.Addr!="192.0.2.1:22" || p.Bandwidth!=1000:
+		t.Error("fields",p)
+	case !bytes.Equal(p.Identity,d.Identity):
+		t.Errorf("identity %q",p.Identity)
+	case p.Fingerprint()!=ssh.FingerprintSHA256(k.PublicKey()):
+		t.Error("host key",p.Fingerprint())
+	case !p.Published.Equal(d.Published) || len(p.Policy)!=2:
+		t.Error("published",p.Published,"policy",p.Policy)
+	}
+}
+
+var tamperCases = []struct{
+	name     string
+	old,new  string
+	e        error
+}{
+	{"address","192.0.2.1:22","192.0.2.2:22",E_SIGNATURE},
+	{"identity","identity aWRlbnRpdHkga2V5","identity aWRlbnRpdHkga2V6",E_SIGNATURE},
+	{"policy","accept *:80-443","accept *:1-443",E_SIGNATURE},
+	{"signature","signature SHA256:","signature SHA256:x",E_SIGNATURE},
+	{"bad identity","identity aWRlbnRpdHkga2V5","identity !!!",E_FORMAT},
+	{"empty identity","identity aWRlbnRpdHkga2V5","identity ",E_FORMAT},
+	{"two identities","identity aWRlbnRpdHkga2V5","identity aWRlbnRpdHkga2V5\nidentity aWRlbnRpdHkga2V5",E_FORMAT},
+	{"no host key","host-key ","host-kez ",E_FORMAT},
+	{"version","sotp-descriptor 1","sotp-descriptor 2",E_FORMAT},
+}
+
+func TestTamper(t *testing.T) {
+	d := descriptor(t,signer(t),"192.0.2.1:22",time.Now())
+	for _,c := range tamperCases {
+		if !bytes.Contains(d.Bytes(),[]byte(c.old)) { t.Fatal(c.name,"doesn't apply") }
+		b := bytes.Replace(d.Bytes(),[]byte(c.old),[]byte(c.new),1)
+		if _,e := ParseDescriptor(b); e!=c.e { t.Errorf("%s: %v",c.name,e) }
+	}
+	/* Signed by another key, than the one it names. */
+	o := descriptor(t,signer(t),"192.0.2.1:22",d.Published)
+	i := bytes.Index(d.Bytes(),[]byte("signature "))
+	j := bytes.Index(o.Bytes(),[]byte("signature "))
+	b := append(append([]byte(nil),d.Bytes()[:i]...),o.Bytes()[j:]...)
+	if _,e := ParseDescriptor(b); e!=E_SIGNATURE { t.Error("foreign signature:",e) }
+}
+
+func TestIdentityLimit(t *testing.T) {
+	d := &Descriptor{Nickname:"relay",Addr:"192.0.2.1:22",Identity:make([]byte,MaxIdentity+1),Published:time.Now()}
+	if e := d.Sign(signer(t)); e!=E_FIELD { t.Error("oversized identity signed:",e) }
+	d.Identity = d.Identity[:MaxIdentity]
+	if e := d.Sign(signer(t)); e!=nil { t.Error(e) }
+	if _,e := ParseDescriptor(d.Bytes()); e!=nil { t.Error(e) }
+	d.Identity = nil
+	d.Sign(signer(t))
+	if bytes.Contains(d.Bytes(),[]byte("identity")) { t.Error("empty identity written") }
+}
+
+var ruleCases = []struct{
+	rule string
+	host string
+	port uint16
+	ok   bool
+}{
+	{"accept *:443","example.com",443,true},
+	{"accept *:443","example.com",80,false},
+	{"accept *:80-443","192.0.2.1",100,true},
+	{"accept 10.0.0.0/8:*","10.1.2.3",1,true},
+	{"accept 10.0.0.0/8:*","example.com",1,false},
+	{"accept [::1]:22","::1",22,true},
+	{"accept 192.0.2.1:1-2","192.0.2.1",3,false},
+}
+
+func TestRule(t *testing.T) {
+	for _,c := range ruleCases {
+		r,e := ParseRule(c.rule)
+		if e!=nil { t.Errorf("%s: %v",c.rule,e); continue }
+		if r.String()!=c.rule { t.Errorf("%s: round trip %s",c.rule,r.String()) }
+		if r.Match(c.host,c.port)!=c.ok { t.Errorf("%s: match %s:%d",c.rule,c.host,c.port) }
+	}
+	for _,s := range []string{"allow *:1","accept *","accept *:x","accept *:2-1","accept 10.0.0.0/33:*",""} {
+		if _,e := ParseRule(s); e==nil { t.Errorf("%q accepted",s) }
+	}
+	d := descriptor(t,signer(t),"192.0.2.1:22",time.Now())
+	if d.Allows("10.1.1.1",80) || !d.Allows("example.com",443) || d.Allows("example.com",22) { t.Error("policy") }
+}
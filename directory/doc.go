@@ -0,0 +1,137 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Relay directory.
+
+Relays publish descriptors, signed with their SSH host key, to the
+directory authorities (see Publisher). Every authority signs a vote, the
+list of the fresh descriptors it knows. The authorities exchange their
+votes and compute the consensus from them: the relays listed in the votes
+of a majority of all authorities, each with its newest descriptor. As
+this is deterministic, the authorities sign the same document and collect
+each other's signatures. Clients accept a consensus signed by a majority
+of the authorities they know (see Client) and build the sshproxy Client
+pool from it.
+
+All documents are text, one "keyword arguments" line per item:
+
+	sotp-descriptor 1
+	nickname <name>
+	address <net> <addr>
+	host-key <authorized_keys format>
+	identity <base64>
+	bandwidth <bytes per second>
+	policy accept|reject <host>:<ports>
+	published <unix time>
+	signature <fingerprint> <base64>
+
+Votes and consensus documents embed descriptors as "descriptor <length>"
+lines, followed by the descriptor itself. Signatures cover everything
+before the first "signature" line.
+*/
+package directory
+
+import "golang.org/x/crypto/ssh"
+import "crypto/rand"
+import "encoding/base64"
+import "strconv"
+import "bytes"
+import "errors"
+import "time"
+
+/* The maximum size of a document. */
+const MaxDocument = 16<<20
+
+var E_FORMAT = errors.New("directory: malformed document")
+var E_SIGNATURE = errors.New("directory: bad signature")
+var E_UNSIGNED = errors.New("directory: not enough valid signatures")
+var E_EXPIRED = errors.New("directory: document not valid now")
+
+type item struct{
+	kw   string
+	args []string
+	blob []byte
+	off  int /* offset of the line */
+}
+
+/* Splits a document into items. */
+func items(b []byte) ([]item,error) {
+	var r []item
+	off := 0
+	for off<len(b) {
+		n := bytes.IndexByte(b[off:],'\n')
+		if n<0 { return nil,E_FORMAT }
+		f := bytes.Fields(b[off:off+n])
+		if len(f)==0 { return nil,E_FORMAT }
+		it := item{kw:string(f[0]),off:off}
+		for _,a := range f[1:] { it.args = append(it.args,string(a)) }
+		off += n+1
+		if it.kw=="descriptor" {
+			if len(it.args)!=1 { return nil,E_FORMAT }
+			l,e := strconv.Atoi(it.args[0])
+			if e!=nil || l<0 || l>len(b)-off { return nil,E_FORMAT }
+			it.blob = b[off:off+l:off+l]
+			off += l
+		}
+		r = append(r,it)
+	}
+	return r,nil
+}
+
+/* Splits a document into the signed body and the signature items. */
+func split(b []byte) ([]byte,[]item,[]item,error) {
+	its,e := items(b)
+	if e!=nil { return nil,nil,nil,e }
+	for i,it := range its {
+		if it.kw!="signature" { continue }
+		for _,s := range its[i:] {
+			if s.kw!="signature" || len(s.args)!=2 { return nil,nil,nil,E_FORMAT }
+		}
+		return b[:it.off],its[:i],its[i:],nil
+	}
+	return b,its,nil,nil
+}
+
+func sign(k ssh.Signer, body []byte) ([]byte,error) {
+	sig,e := k.Sign(rand.Reader,body)
+	if e!=nil { return nil,e }
+	return []byte("signature "+ssh.FingerprintSHA256(k.PublicKey())+" "+base64.StdEncoding.EncodeToString(ssh.Marshal(sig))+"\n"),nil
+}
+
+/* Verifies a signature item against k. */
+func verify(k ssh.PublicKey, body []byte, s item) bool {
+	if s.args[0]!=ssh.FingerprintSHA256(k) { return false }
+	b,e := base64.StdEncoding.DecodeString(s.args[1])
+	if e!=nil { return false }
+	sig := new(ssh.Signature)
+	if ssh.Unmarshal(b,sig)!=nil { return false }
+	return k.Verify(body,sig)==nil
+}
+
+func unix(s string) (time.Time,error) {
+	n,e := strconv.ParseInt(s,10,64)
+	if e!=nil { return time.Time{},E_FORMAT }
+	return time.Unix(n,0),nil
+}
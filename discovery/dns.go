@@ -0,0 +1,349 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+Relay discovery from DNS, for deployments without a directory.
+
+The relays of a domain are the targets of its "_sshproxy._tcp" SRV records.
+Every target has TXT records with the fingerprints of its SSH host keys:
+
+	_sshproxy._tcp.example.org. 300 IN SRV 0 0 2222 relay1.example.org.
+	relay1.example.org.         300 IN TXT "sshproxy-hostkey=SHA256:..."
+	relay1.example.org.         300 IN A   192.0.2.1
+
+Targets without a fingerprint or address are left out. All names are
+resolved through the same DNS server, the first A (or else AAAA) record
+is used. Priorities and weights are ignored, every target joins the pool.
+If the lookups of a target fail, it is skipped for this update and keeps
+its place in the pool. Note, that the answers are not
+authenticated (no DNSSEC validation); the fingerprints only pin the keys
+to what the DNS server said.
+*/
+package discovery
+
+import "github.com/maxymania/sshproxy"
+import "golang.org/x/crypto/ssh"
+import "golang.org/x/net/dns/dnsmessage"
+import "encoding/binary"
+import "math/rand"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "errors"
+import "sort"
+import "sync"
+import "time"
+import "net"
+import "io"
+import "log"
+
+/* The service label, prepended to the domain name. */
+const Service = "_sshproxy._tcp."
+
+/* The prefix of the fingerprints in the TXT records. */
+const HostKeyPrefix = "sshproxy-hostkey="
+
+var E_DNS = errors.New("discovery: bad DNS answer")
+
+/*
+Keeps the sshproxy Client pool in sync with the SRV and TXT records of
+a domain. Clients are added and removed, as the records change.
+*/
+type DNS struct{
+	/* The domain, e.g. "example.org". */
+	Name string
+	
+	/* The DNS server (host:port). If empty, the first one in /etc/resolv.conf is used. */
+	Server string
+	
+	/* The timeout of a query. If zero, five seconds. */
+	Timeout time.Duration
+	
+	/*
+	The bounds of the refresh interval, which is the lowest TTL of the
+	records. If zero, 30 seconds and one hour. After a failure, the records
+	are queried again after MinTTL.
+	*/
+	MinTTL, MaxTTL time.Duration
+	
+	/*
+	The template for the SSH client configuration (user and authentication).
+	HostKeyCallback is replaced by one, that accepts the keys of the TXT
+	records only. Used, if New is nil.
+	*/
+	SSH ssh.ClientConfig
+	
+	/*
+	Creates the pool entry for a relay at addr (IP address and port). If nil,
+	one based on SSH is created.
+	*/
+	New func(addr string, fingerprints []string) (*sshproxy.Client,error)
+	
+	mutex   sync.Mutex
+	clients map[string]*relay
+	ttl     time.Duration /* of the last successful Update */
+}
+
+/* A relay, as found in the records. */
+type relay struct{
+	target string
+	addr   string
+	fps    []string
+	cl     *sshproxy.Client
+}
+
+/* The pool entries are kept, as long as the relay's address and keys stay the same. */
+func (r *relay) key() string { return r.addr+" "+strings.Join(r.fps," ") }
+
+func (d *DNS) timeout() time.Duration {
+	if d.Timeout==0 { return 5*time.Second }
+	return d.Timeout
+}
+func (d *DNS) minTTL() time.Duration {
+	if d.MinTTL==0 { return 30*time.Second }
+	return d.MinTTL
+}
+func (d *DNS) maxTTL() time.Duration {
+	if d.MaxTTL==0 { return time.Hour }
+	return d.MaxTTL
+}
+
+/* Returns the first name server of /etc/resolv.conf. */
+func nameserver() string {
+	b,e := ioutil.ReadFile("/etc/resolv.conf")
+	if e==nil {
+		for _,l := range strings.Split(string(b),"\n") {
+			f := strings.Fields(l)
+			if len(f)>=2 && f[0]=="nameserver" { return net.JoinHostPort(f[1],"53") }
+		}
+	}
+	return "127.0.0.1:53"
+}
+func (d *DNS) server() string {
+	if d.Server=="" { return nameserver() }
+	return d.Server
+}
+
+func (d *DNS) roundTrip(netw string, q []byte) ([]byte,error) {
+	c,e := net.DialTimeout(netw,d.server(),d.timeout())
+	if e!=nil { return nil,e }
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(d.timeout()))
+	if netw=="udp" {
+		_,e = c.Write(q)
+		if e!=nil { return nil,e }
+		b := make([]byte,0xffff)
+		n,e := c.Read(b)
+		if e!=nil { return nil,e }
+		return b[:n],nil
+	}
+	b := make([]byte,2,2+len(q))
+	binary.BigEndian.PutUint16(b,uint16(len(q)))
+	_,e = c.Write(append(b,q...))
+	if e!=nil { return nil,e }
+	_,e = io.ReadFull(c,b)
+	if e!=nil { return nil,e }
+	b = make([]byte,binary.BigEndian.Uint16(b))
+	_,e = io.ReadFull(c,b)
+	return b,e
+}
+
+/*
+Queries the records of the given type. A non-existent name has no records.
+Returns the lowest TTL of them.
+*/
+func (d *DNS) query(name string, t dnsmessage.Type) ([]dnsmessage.Resource,time.Duration,error) {
+	if !strings.HasSuffix(name,".") { name += "." }
+	n,e := dnsmessage.NewName(name)
+	if e!=nil { return nil,0,e }
+	id := uint16(rand.Uint32())
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{ID:id,RecursionDesired:true},
+		Questions: []dnsmessage.Question{{Name:n,Type:t,Class:dnsmessage.ClassINET}},
+	}
+	q,e := m.Pack()
+	if e!=nil { return nil,0,e }
+	var r dnsmessage.Message
+	for _,netw := range []string{"udp","tcp"} {
+		b,e := d.roundTrip(netw,q)
+		if e!=nil { return nil,0,e }
+		e = r.Unpack(b)
+		if e!=nil { return nil,0,e }
+		if !r.Header.Truncated { break }
+	}
+	if r.Header.ID!=id || !r.Header.Response || len(r.Questions)!=1 || r.Questions[0]!=m.Questions[0] { return nil,0,E_DNS }
+	switch r.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError: return nil,d.minTTL(),nil
+	default: return nil,0,errors.New("discovery: "+name+": "+r.Header.RCode.String())
+	}
+	var rs []dnsmessage.Resource
+	ttl := d.maxTTL()
+	for _,a := range r.Answers {
+		if a.Header.Type!=t { continue }
+		rs = append(rs,a)
+		if at := time.Duration(a.Header.TTL)*time.Second; at<ttl { ttl = at }
+	}
+	return rs,ttl,nil
+}
+
+/* The fingerprints of the TXT records of target. */
+func (d *DNS) fingerprints(target string) ([]string,time.Duration,error) {
+	rs,ttl,e := d.query(target,dnsmessage.TypeTXT)
+	if e!=nil { return nil,0,e }
+	var fps []string
+	for _,r := range rs {
+		for _,s := range r.Body.(*dnsmessage.TXTResource).TXT {
+			if strings.HasPrefix(s,HostKeyPrefix) { fps = append(fps,s[len(HostKeyPrefix):]) }
+		}
+	}
+	sort.Strings(fps)
+	return fps,ttl,nil
+}
+
+/* The addresses of target, A records first. An IP address is returned as is. */
+func (d *DNS) addresses(target string) ([]net.IP,time.Duration,error) {
+	if ip := net.ParseIP(target); ip!=nil { return []net.IP{ip},d.maxTTL(),nil }
+	var ips []net.IP
+	ttl := d.maxTTL()
+	for _,t := range []dnsmessage.Type{dnsmessage.TypeA,dnsmessage.TypeAAAA} {
+		rs,rt,e := d.query(target,t)
+		if e!=nil { return nil,0,e }
+		if rt<ttl { ttl = rt }
+		for _,r := range rs {
+			switch b := r.Body.(type) {
+			case *dnsmessage.AResource: ips = append(ips,net.IP(append([]byte(nil),b.A[:]...)))
+			case *dnsmessage.AAAAResource: ips = append(ips,net.IP(append([]byte(nil),b.AAAA[:]...)))
+			}
+		}
+	}
+	return ips,ttl,nil
+}
+
+/* Looks up the fingerprints and the address of target. */
+func (d *DNS) lookup(target string, port uint16) (*relay,time.Duration,error) {
+	fps,ttl,e := d.fingerprints(target)
+	if e!=nil { return nil,0,e }
+	ips,t,e := d.addresses(target)
+	if e!=nil { return nil,0,e }
+	if t<ttl { ttl = t }
+	if len(fps)==0 || len(ips)==0 { return nil,ttl,nil }
+	return &relay{target:target,addr:net.JoinHostPort(ips[0].String(),strconv.Itoa(int(port))),fps:fps},ttl,nil
+}
+
+func (d *DNS) newClient(addr string, fps []string) (*sshproxy.Client,error) {
+	if d.New!=nil { return d.New(addr,fps) }
+	cl := new(sshproxy.Client)
+	cl.Client = d.SSH
+	cl.Client.HostKeyCallback = HostKeyCallback(fps)
+	cl.Net = "tcp"
+	cl.Addr = addr
+	return cl,nil
+}
+
+/* Accepts host keys with one of the given fingerprints. */
+func HostKeyCallback(fps []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		for _,f := range fps {
+			if f==fp { return nil }
+		}
+		return errors.New("discovery: host key "+fp+" not in DNS")
+	}
+}
+
+/*
+Queries the records and adds and removes Clients accordingly. If the SRV
+query fails, the pool is left alone; if the lookups of a target fail, its
+Clients are kept and the records are queried again after MinTTL. Returns,
+when the records should be queried again.
+*/
+func (d *DNS) Update() (time.Duration,error) {
+	srvs,ttl,e := d.query(Service+d.Name,dnsmessage.TypeSRV)
+	if e!=nil { return d.minTTL(),e }
+	want := make(map[string]*relay)
+	failed := make(map[string]bool)
+	for _,r := range srvs {
+		srv := r.Body.(*dnsmessage.SRVResource)
+		target := strings.TrimSuffix(srv.Target.String(),".")
+		if target=="" || srv.Port==0 { continue } /* "." means no service */
+		rl,t,e := d.lookup(target,srv.Port)
+		if e!=nil {
+			log.Println("discovery:",target,e)
+			failed[target] = true
+			ttl = d.minTTL()
+			continue
+		}
+		if t<ttl { ttl = t }
+		if rl==nil {
+			log.Println("discovery: no host key or address for",target)
+			continue
+		}
+		want[rl.key()] = rl
+	}
+	if ttl<d.minTTL() { ttl = d.minTTL() }
+	
+	d.mutex.Lock(); defer d.mutex.Unlock()
+	for k,rl := range d.clients {
+		if _,ok := want[k]; ok || failed[rl.target] { continue }
+		sshproxy.Remove(rl.cl)
+		delete(d.clients,k)
+	}
+	if d.clients==nil { d.clients = make(map[string]*relay) }
+	for k,rl := range want {
+		if _,ok := d.clients[k]; ok { continue }
+		cl,e := d.newClient(rl.addr,rl.fps)
+		if e!=nil { log.Println("discovery:",k,e); continue }
+		rl.cl = cl
+		sshproxy.Add(cl)
+		d.clients[k] = rl
+	}
+	d.ttl = ttl
+	return ttl,nil
+}
+
+/* The Clients currently in the pool. */
+func (d *DNS) Clients() []*sshproxy.Client {
+	d.mutex.Lock(); defer d.mutex.Unlock()
+	r := make([]*sshproxy.Client,0,len(d.clients))
+	for _,rl := range d.clients { r = append(r,rl.cl) }
+	return r
+}
+
+/*
+Updates the pool, whenever the records expire, starting right away,
+unless Update succeeded before. Never returns.
+*/
+func (d *DNS) Run() {
+	d.mutex.Lock()
+	t := d.ttl
+	d.mutex.Unlock()
+	time.Sleep(t)
+	var e error
+	for {
+		t,e = d.Update()
+		if e!=nil { log.Println("discovery: Update",d.Name,e) }
+		time.Sleep(t)
+	}
+}
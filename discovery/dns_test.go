@@ -0,0 +1,307 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package discovery
+
+import "github.com/maxymania/sshproxy"
+import "golang.org/x/crypto/ssh"
+import "golang.org/x/net/dns/dnsmessage"
+import "crypto/ed25519"
+import "crypto/rand"
+import "encoding/binary"
+import "strings"
+import "testing"
+import "sort"
+import "sync"
+import "time"
+import "net"
+import "io"
+
+const domain = "example.test"
+
+type relayInfo struct{
+	port uint16
+	txt  []string
+	ip   [4]byte
+}
+
+/*
+A DNS server, that answers from the current records, over UDP and TCP on
+the same port. The names in fail get SERVFAIL. If truncate is set, UDP
+answers are truncated.
+*/
+type standIn struct{
+	sync.Mutex
+	relays   map[string]relayInfo /* host name -> info */
+	fail     map[string]bool
+	truncate bool
+	udp,tcp  int /* queries served */
+}
+func (s *standIn) set(r map[string]relayInfo) {
+	s.Lock(); defer s.Unlock()
+	s.relays = r
+}
+func (s *standIn) answer(q []byte, udp bool) ([]byte,error) {
+	var m dnsmessage.Message
+	e := m.Unpack(q)
+	if e!=nil || len(m.Questions)!=1 { return nil,e }
+	qn := m.Questions[0]
+	name := strings.TrimSuffix(qn.Name.String(),".")
+	m.Header.Response = true
+	m.Header.Authoritative = true
+	h := dnsmessage.ResourceHeader{Name:qn.Name,Class:dnsmessage.ClassINET,TTL:300}
+	s.Lock(); defer s.Unlock()
+	if udp { s.udp++ } else { s.tcp++ }
+	switch {
+	case udp && s.truncate:
+		m.Header.Truncated = true
+	case s.fail[name]:
+		m.Header.RCode = dnsmessage.RCodeServerFailure
+	case qn.Type==dnsmessage.TypeSRV && name==Service+domain:
+		for n,r := range s.relays {
+			t,_ := dnsmessage.NewName(n+".")
+			m.Answers = append(m.Answers,dnsmessage.Resource{Header:h,Body:&dnsmessage.SRVResource{Port:r.port,Target:t}})
+		}
+		/* "." means no service, it is skipped. */
+		h.TTL = 60
+		m.Answers = append(m.Answers,dnsmessage.Resource{Header:h,Body:&dnsmessage.SRVResource{Port:22,Target:dnsmessage.MustNewName(".")}})
+	case qn.Type==dnsmessage.TypeTXT,qn.Type==dnsmessage.TypeA,qn.Type==dnsmessage.TypeAAAA:
+		r,ok := s.relays[name]
+		if !ok {
+			m.Header.RCode = dnsmessage.RCodeNameError
+			break
+		}
+		switch qn.Type {
+		case dnsmessage.TypeTXT:
+			m.Answers = append(m.Answers,dnsmessage.Resource{Header:h,Body:&dnsmessage.TXTResource{TXT:r.txt}})
+		case dnsmessage.TypeA:
+			ip := r.ip
+			if ip==[4]byte{} { ip = [4]byte{127,0,0,1} }
+			m.Answers = append(m.Answers,dnsmessage.Resource{Header:h,Body:&dnsmessage.AResource{A:ip}})
+		}
+	}
+	return m.Pack()
+}
+func (s *standIn) serve(pc net.PacketConn) {
+	for {
+		b := make([]byte,512)
+		n,a,e := pc.ReadFrom(b)
+		if e!=nil { return }
+		r,e := s.answer(b[:n],true)
+		if e!=nil { continue }
+		pc.WriteTo(r,a)
+	}
+}
+func (s *standIn) serveTCP(l net.Listener) {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return }
+		go func(){
+			defer c.Close()
+			var h [2]byte
+			if _,e := io.ReadFull(c,h[:]); e!=nil { return }
+			q := make([]byte,binary.BigEndian.Uint16(h[:]))
+			if _,e := io.ReadFull(c,q); e!=nil { return }
+			r,e := s.answer(q,false)
+			if e!=nil { return }
+			c.Write(append(binary.BigEndian.AppendUint16(nil,uint16(len(r))),r...))
+		}()
+	}
+}
+
+/* Starts a stand-in DNS server and returns it with its address. */
+func start(t *testing.T) (*standIn,string) {
+	pc,e := net.ListenPacket("udp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	l,e := net.Listen("tcp",pc.LocalAddr().String())
+	if e!=nil { t.Fatal(e) }
+	t.Cleanup(func(){ pc.Close(); l.Close() })
+	s := &standIn{fail:make(map[string]bool)}
+	go s.serve(pc)
+	go s.serveTCP(l)
+	return s,pc.LocalAddr().String()
+}
+
+func signer(t *testing.T) ssh.Signer {
+	_,pk,e := ed25519.GenerateKey(rand.Reader)
+	if e!=nil { t.Fatal(e) }
+	s,e := ssh.NewSignerFromKey(pk)
+	if e!=nil { t.Fatal(e) }
+	return s
+}
+
+/* Starts a relay on a port of 127.0.0.1 and returns its records. */
+func newRelay(t *testing.T) relayInfo {
+	key := signer(t)
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	t.Cleanup(func(){ l.Close() })
+	cfg := &ssh.ServerConfig{NoClientAuth:true}
+	cfg.AddHostKey(key)
+	go func(){
+		for {
+			c,e := l.Accept()
+			if e!=nil { return }
+			go func(){
+				cc,nc,rr,e := ssh.NewServerConn(c,cfg)
+				if e!=nil { c.Close(); return }
+				sshproxy.Handle(cc,nc,rr)
+			}()
+		}
+	}()
+	return relayInfo{port:uint16(l.Addr().(*net.TCPAddr).Port),txt:[]string{HostKeyPrefix+ssh.FingerprintSHA256(key.PublicKey())}}
+}
+
+func echo(t *testing.T) string {
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	t.Cleanup(func(){ l.Close() })
+	go func(){
+		for {
+			c,e := l.Accept()
+			if e!=nil { return }
+			go func(){ io.Copy(c,c); c.Close() }()
+		}
+	}()
+	return l.Addr().String()
+}
+
+/* Returns the addresses of the pool, sorted. */
+func pool() (r []string) {
+	for _,c := range sshproxy.Clients() { r = append(r,c.Addr) }
+	sort.Strings(r)
+	return
+}
+
+/* A fake pool entry, that remembers the fingerprints. */
+func fake(addr string, fps []string) (*sshproxy.Client,error) {
+	return &sshproxy.Client{Net:"tcp",Addr:addr,Client:ssh.ClientConfig{User:strings.Join(fps," ")}},nil
+}
+
+func TestRecords(t *testing.T) {
+	s,addr := start(t)
+	s.set(map[string]relayInfo{
+		"r1."+domain: {port:22,ip:[4]byte{192,0,2,1},txt:[]string{"v=spf1 -all",HostKeyPrefix+"SHA256:b",HostKeyPrefix+"SHA256:a"}},
+		"r2."+domain: {port:2222,ip:[4]byte{192,0,2,2},txt:[]string{HostKeyPrefix+"SHA256:c"}},
+		"nokey."+domain: {port:22,ip:[4]byte{192,0,2,3},txt:[]string{"unrelated"}},
+		"noport."+domain: {port:0,ip:[4]byte{192,0,2,4},txt:[]string{HostKeyPrefix+"SHA256:d"}},
+	})
+	d := &DNS{Name:domain,Server:addr,MinTTL:time.Second,New:fake}
+	sshproxy.Replace(nil)
+	ttl,e := d.Update()
+	if e!=nil { t.Fatal(e) }
+	if ttl!=60*time.Second { t.Error("ttl",ttl) }
+	if got := pool(); strings.Join(got," ")!="192.0.2.1:22 192.0.2.2:2222" { t.Fatal("pool",got) }
+	for _,c := range d.Clients() {
+		/* The fingerprints are sorted, other TXT records are ignored. */
+		if c.Addr=="192.0.2.1:22" && c.Client.User!="SHA256:a SHA256:b" { t.Error("fingerprints",c.Client.User) }
+	}
+	fps,_,e := d.fingerprints("r2."+domain)
+	if e!=nil || len(fps)!=1 || fps[0]!="SHA256:c" { t.Error("fingerprints",fps,e) }
+	/* A target, that is an IP address, isn't looked up. */
+	ips,_,e := d.addresses("192.0.2.9")
+	if e!=nil || len(ips)!=1 || !ips[0].Equal(net.IPv4(192,0,2,9)) { t.Error("addresses",ips,e) }
+	/* A name the server doesn't know has no records. */
+	rs,_,e := d.query("unknown."+domain,dnsmessage.TypeA)
+	if e!=nil || len(rs)!=0 { t.Error("unknown name",rs,e) }
+}
+
+/* The relays' names are only known to the configured server. */
+func TestServer(t *testing.T) {
+	s,addr := start(t)
+	s.set(map[string]relayInfo{"r1."+domain: {port:22,txt:[]string{HostKeyPrefix+"SHA256:a"}}})
+	sshproxy.Replace(nil)
+	d := &DNS{Name:domain,Server:addr,New:fake}
+	if _,e := d.Update(); e!=nil { t.Fatal(e) }
+	if got := pool(); len(got)!=1 || got[0]!="127.0.0.1:22" { t.Error("pool",got) }
+	if s.udp==0 || s.tcp!=0 { t.Error("queries",s.udp,s.tcp) }
+	
+	/* Truncated answers are retried over TCP. */
+	s.truncate = true
+	if _,e := d.Update(); e!=nil { t.Fatal(e) }
+	if got := pool(); len(got)!=1 { t.Error("pool",got) }
+	if s.tcp==0 { t.Error("no TCP retry") }
+	
+	/* Without a reachable server, the pool is left alone. */
+	d.Server = "127.0.0.1:1"
+	d.Timeout = time.Second
+	if _,e := d.Update(); e==nil { t.Error("no error without server") }
+	if got := pool(); len(got)!=1 { t.Error("pool changed",got) }
+}
+
+func TestChanges(t *testing.T) {
+	target := echo(t)
+	a,b,c := newRelay(t),newRelay(t),newRelay(t)
+	s,addr := start(t)
+	d := &DNS{Name:domain,Server:addr,MinTTL:time.Second}
+	sshproxy.Replace(nil)
+	
+	steps := []struct{
+		name   string
+		relays map[string]relayInfo
+		fail   string
+		n      int
+		dial   bool
+	}{
+		{"one",map[string]relayInfo{"r1."+domain:a},"",1,true},
+		{"replaced and added",map[string]relayInfo{"r1."+domain:b,"r2."+domain:c},"",2,true},
+		/* The failing target keeps its place, the other one is removed. */
+		{"failing target",map[string]relayInfo{"r1."+domain:b,"r3."+domain:a},"r1."+domain,2,true},
+		{"recovered",map[string]relayInfo{"r1."+domain:b},"",1,true},
+		/* A wrong fingerprint: the relay is in the pool, but circuits over it fail. */
+		{"wrong key",map[string]relayInfo{"r2."+domain:{port:c.port,txt:a.txt}},"",1,false},
+		{"right key",map[string]relayInfo{"r2."+domain:c},"",1,true},
+	}
+	for _,st := range steps {
+		s.set(st.relays)
+		s.Lock()
+		s.fail = map[string]bool{st.fail:true}
+		s.Unlock()
+		ttl,e := d.Update()
+		if e!=nil { t.Fatal(st.name,e) }
+		if st.fail!="" && ttl!=d.minTTL() { t.Error(st.name,"ttl",ttl) }
+		if len(sshproxy.Clients())!=st.n || len(d.Clients())!=st.n { t.Fatal(st.name,"pool",pool()) }
+		conn,e := sshproxy.Dial("tcp",target)
+		if (e==nil)!=st.dial { t.Fatal(st.name,"dial",e) }
+		if e!=nil { continue }
+		conn.Write([]byte("ping"))
+		buf := make([]byte,4)
+		io.ReadFull(conn,buf)
+		conn.Close()
+		if string(buf)!="ping" { t.Error(st.name,"echo",buf) }
+	}
+	/* The pool entries of the relays, that stay, are kept. */
+	before := d.Clients()
+	d.Update()
+	if after := d.Clients(); len(after)!=1 || after[0]!=before[0] { t.Error("pool entry replaced") }
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	k,o := signer(t),signer(t)
+	cb := HostKeyCallback([]string{"SHA256:x",ssh.FingerprintSHA256(k.PublicKey())})
+	addr := &net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:22}
+	if cb("relay",addr,k.PublicKey())!=nil { t.Error("listed key rejected") }
+	if cb("relay",addr,o.PublicKey())==nil { t.Error("other key accepted") }
+	if HostKeyCallback(nil)("relay",addr,k.PublicKey())==nil { t.Error("key accepted without fingerprints") }
+}
@@ -26,95 +26,122 @@ SOFTWARE.
 package sshproxy
 
 import "golang.org/x/crypto/ssh"
+import "sync"
+import "time"
 import "io"
 
+import "github.com/maxymania/sshproxy/relay"
+
+/*
+How long a spliced channel waits for the upstream's trailing requests
+(exit-status) and data, before it is closed anyway.
+*/
+const jumpLinger = 5*time.Second
+
+/* The extension in ssh.Permissions, that allows a user to jump to the Upstream. */
+const PermitJumping = "permit-jump"
+
 func ch_proxy_req(ch ssh.Channel, rq *ssh.Request) {
 	b,_ := ch.SendRequest(rq.Type,true,rq.Payload)
 	rq.Reply(b,[]byte{})
 }
+
+/* Forwards channel requests in order. */
 func ch_proxy_reqs(ch ssh.Channel, rq <-chan *ssh.Request){
 	for r := range rq {
 		if r.WantReply {
-			go ch_proxy_req(ch,r)
+			ch_proxy_req(ch,r)
 		}else{
 			ch.SendRequest(r.Type,false,r.Payload)
 		}
 	}
 }
 
-func ch_proxy_copy(src ssh.Channel,dst ssh.Channel){
-	b := make([]byte,1<<13)
-	for {
-		n,e := src.Read(b)
-		if e==io.EOF {
-			dst.CloseWrite()
-			return
-		}
-		if n>0 {
-			dst.Write(b[:n])
-		}
-	}
+/*
+The client side of a spliced channel. EOF is delayed, until the upstream's
+stderr is drained, and closing, until the upstream's requests have been
+forwarded, so neither stderr nor exit-status are lost.
+*/
+type jumpChannel struct{
+	ssh.Channel
+	once   sync.Once
+	eof    chan struct{} /* closed on CloseWrite */
+	stderr chan struct{} /* closed, once stderr is drained */
+	done   chan struct{} /* closed, once the upstream is done */
 }
-
-func ch_proxy_copyin(src io.Reader,dst ssh.Channel){
-	b := make([]byte,1<<13)
-	for {
-		n,e := src.Read(b)
-		if e==io.EOF {
-			dst.CloseWrite()
-			return
-		}
-		if n>0 {
-			dst.Write(b[:n])
-		}
+func linger(c chan struct{}) {
+	t := time.NewTimer(jumpLinger)
+	defer t.Stop()
+	select {
+	case <-c:
+	case <-t.C:
 	}
 }
-func ch_proxy_copyin2(src io.Reader,dst io.Writer, ch ssh.Channel){
-	b := make([]byte,1<<13)
-	for {
-		n,e := src.Read(b)
-		if e==io.EOF {
-			ch.CloseWrite()
-			return
-		}
-		if n>0 {
-			dst.Write(b[:n])
-		}
-	}
+func (j *jumpChannel) CloseWrite() error {
+	linger(j.stderr)
+	j.once.Do(func(){ close(j.eof) })
+	return j.Channel.CloseWrite()
 }
-func ch_proxy_copyout(src ssh.Channel,dst io.WriteCloser){
-	b := make([]byte,1<<13)
-	for {
-		n,e := src.Read(b)
-		if e==io.EOF {
-			dst.Close()
-			return
-		}
-		if n>0 {
-			dst.Write(b[:n])
-		}
-	}
+func (j *jumpChannel) Close() error {
+	linger(j.done)
+	return j.Channel.Close()
 }
-func ch_proxy_copyout2(src io.Reader,dst io.WriteCloser){
-	b := make([]byte,1<<13)
-	for {
-		n,e := src.Read(b)
-		if e==io.EOF {
-			dst.Close()
-			return
-		}
-		if n>0 {
-			dst.Write(b[:n])
-		}
-	}
+
+/*
+Splices the channel a (towards the client) with b (towards the upstream),
+including stderr and the channel requests of both sides. It returns, once
+both are closed.
+*/
+func ch_proxy_copy(a,b ssh.Channel, rqa,rqb <-chan *ssh.Request, rc *relay.Config){
+	ja := &jumpChannel{Channel:a,eof:make(chan struct{}),stderr:make(chan struct{}),done:make(chan struct{})}
+	go func(){
+		io.Copy(a.Stderr(),b.Stderr())
+		close(ja.stderr)
+	}()
+	go io.Copy(b.Stderr(),a.Stderr())
+	go func(){
+		ch_proxy_reqs(b,rqa)
+		b.Close()
+	}()
+	go func(){
+		ch_proxy_reqs(a,rqb)
+		/* b is closed. Let the remaining data drain, then close a. */
+		linger(ja.eof)
+		close(ja.done)
+		a.Close()
+	}()
+	rc.Relay(ja,b)
 }
 
-func ch_proxy_eat(src io.Reader){
-	b := make([]byte,1<<13)
-	for {
-		_,e := src.Read(b)
-		if e==io.EOF {
-			return
+/*
+Forwards a channel as-is to the Server's Upstream (see Jump), e.g. to serve
+"session" channels as a bastion host.
+*/
+func (s *Server) Jump(conn ssh.Conn, nc ssh.NewChannel) {
+	cl := s.Upstream
+	if cl==nil {
+		nc.Reject(ssh.ConnectionFailed,"No upstream!")
+		return
+	}
+	host,port := cl.hostPort()
+	if !permit(s.PermitJump,PermitJumping,conn,host,port) {
+		nc.Reject(ssh.Prohibited,"Jump not permitted!")
+		return
+	}
+	b,rqb,e := cl.open(nc.ChannelType(),nc.ExtraData())
+	if e!=nil {
+		if oe,ok := e.(*ssh.OpenChannelError); ok {
+			nc.Reject(oe.Reason,oe.Message)
+		} else {
+			nc.Reject(ssh.ConnectionFailed,e.Error())
 		}
+		return
+	}
+	a,rqa,e := nc.Accept()
+	if e!=nil {
+		b.Close()
+		go DevNullRequest(rqb)
+		return
 	}
+	ch_proxy_copy(a,b,rqa,rqb,s.relay())
 }
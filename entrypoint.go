@@ -26,36 +26,258 @@ SOFTWARE.
 package sshproxy
 
 import "golang.org/x/crypto/ssh"
+import "github.com/maxymania/sshproxy/scrambler"
+import "github.com/maxymania/sshproxy/relay"
+import "sync"
+import "time"
 
-func channel(nc ssh.NewChannel){
-	{
-		switch(nc.ChannelType()){
-		case any_req1:  ch_anyproto1(nc)
-		}
+/*
+Serves a new channel of a registered type. conn is the SSH connection, the
+channel was opened on.
+*/
+type ChannelHandler func(conn ssh.Conn, nc ssh.NewChannel)
+
+/*
+Serves a global request. It must reply, if r.WantReply is set. The requests
+of a connection are served in order, one at a time, as SSH requires the
+replies in order. A handler may block, this doesn't stall the connection,
+but delays the later requests of the same connection, so it should bound
+the time it takes.
+*/
+type RequestHandler func(conn ssh.Conn, r *ssh.Request)
+
+func (s *Server) handlers() {
+	s.hOnce.Do(func(){
+		s.channels = make(map[string]ChannelHandler)
+		s.requests = make(map[string]RequestHandler)
+		s.channels[any_req1] = func(conn ssh.Conn, nc ssh.NewChannel){ ch_anyproto1(s,conn.(*sconn),nc) }
+	})
+}
+
+/*
+Registers the handler for a channel type. A nil handler removes it. The
+handler for "anyprotocolv1" is installed by default.
+*/
+func (s *Server) HandleChannel(ct string, h ChannelHandler) {
+	s.handlers()
+	s.hmutex.Lock(); defer s.hmutex.Unlock()
+	if h==nil { delete(s.channels,ct); return }
+	s.channels[ct] = h
+}
+
+/* Registers the handler for a global request type. A nil handler removes it. */
+func (s *Server) HandleRequest(name string, h RequestHandler) {
+	s.handlers()
+	s.hmutex.Lock(); defer s.hmutex.Unlock()
+	if h==nil { delete(s.requests,name); return }
+	s.requests[name] = h
+}
+
+func (s *Server) channel(c *sconn, nc ssh.NewChannel){
+	s.handlers()
+	s.hmutex.RLock()
+	h := s.channels[nc.ChannelType()]
+	s.hmutex.RUnlock()
+	if h!=nil {
+		h(c,nc)
+		return
 	}
 	nc.Reject(ssh.UnknownChannelType,"Unknown channel type!")
 }
-func request(r *ssh.Request){
+func (s *Server) request(c *sconn, r *ssh.Request){
+	s.handlers()
+	s.hmutex.RLock()
+	h := s.requests[r.Type]
+	s.hmutex.RUnlock()
+	if h!=nil {
+		h(c,r)
+		return
+	}
 	if r.WantReply { r.Reply(false,nil) }
 }
 
-func channel2(conn ssh.Conn,nc <-chan ssh.NewChannel){
+func (s *Server) channel2(c *sconn,nc <-chan ssh.NewChannel){
 	for n := range nc {
-		go channel(n)
+		go s.channel(c,n)
 	}
 }
-func request2(conn ssh.Conn,reqs <-chan *ssh.Request){
+/*
+The number of global requests queued per connection. The SSH library stops
+reading from the connection, while its own (small) queue is full.
+*/
+const requestQueue = 64
+
+func (s *Server) request2(c *sconn,reqs <-chan *ssh.Request){
+	q := make(chan *ssh.Request,requestQueue)
+	go func(){
+		for r := range q {
+			s.request(c,r)
+		}
+	}()
 	for r := range reqs {
-		go request(r)
+		q <- r
 	}
+	close(q)
 }
 
 
 var Level int = 4
 
+/*
+Handshake parameters used for every session, this node takes part in, unless
+overridden by the Server or the Client.
+*/
+var Scrambler scrambler.Config
+
+/* Copy engine parameters used for every relayed connection, unless overridden by the Server. */
+var Relay relay.Config
+
+/* Per-listener settings. The zero value is ready to use. */
+type Server struct{
+	/* Handshake parameters for this listener. If nil, Scrambler is used. */
+	Scrambler *scrambler.Config
+	
+	/* Copy engine parameters for this listener. If nil, Relay is used. */
+	Relay *relay.Config
+	
+	/* The level for connections started by this listener. If zero, Level is used. */
+	Level int
+	
+	/*
+	Decides whether conn may forward to host:port (see DirectTCPIP). If nil,
+	the user needs the PermitForwarding extension.
+	*/
+	PermitDirect func(conn ssh.Conn, host string, port uint32) bool
+	
+	/*
+	Decides whether conn may have the exit listen on host:port (see
+	TCPIPForward). If nil, the user needs the PermitForwarding extension.
+	*/
+	PermitListen func(conn ssh.Conn, host string, port uint32) bool
+	
+	/*
+	Decides whether conn may jump to Upstream at host:port (see Jump). If nil,
+	the user needs the PermitJumping extension.
+	*/
+	PermitJump func(conn ssh.Conn, host string, port uint32) bool
+	
+	/*
+	Decides whether this node, as exit, listens on host:port on behalf of
+	a client (see Listen). If nil, it never does.
+	*/
+	PermitExitListen func(host string, port uint32) bool
+	
+	/*
+	Decides whether this node, as exit, connects to host:port (see Dial).
+	host is the resolved IP address. If nil, it connects anywhere.
+	*/
+	PermitExit func(host string, port uint32) bool
+	
+	/*
+	The SSH server, channels are forwarded to in jump mode. Register Jump for
+	the channel types to forward, e.g.
+
+		s.HandleChannel("session",s.Jump)
+
+	PermitJump decides, who may jump to Upstream.Addr.
+	*/
+	Upstream *Client
+	
+	/* If set, this node, as exit, serves as rendezvous point for hidden services. */
+	Rendezvous bool
+	
+	/* Deadline for opening the channel to the next hop. */
+	OpenTimeout time.Duration
+	
+	/* Deadline for the scrambler handshake, once the channel is accepted. */
+	HandshakeTimeout time.Duration
+	
+	/* Deadline for the first anyproto command, once the handshake is done. */
+	CommandTimeout time.Duration
+	
+	/*
+	Maximum number of pending handshakes per SSH connection and per source
+	address. Zero means unlimited.
+	*/
+	MaxPendingConn int
+	MaxPendingAddr int
+	
+	/*
+	Maximum number of concurrent scrambler handshakes. Further channels wait
+	for a slot, at most HandshakeTimeout. Zero means unlimited.
+	*/
+	MaxHandshakes int
+	
+	/* Maximum number of channels waiting for a handshake slot. Zero means unlimited. */
+	MaxQueue int
+	
+	/*
+	If more than PowThreshold handshakes are running or waiting, the client
+	has to solve a puzzle of PowBits difficulty first. Zero disables puzzles.
+	*/
+	PowThreshold int
+	PowBits      int
+	
+	/*
+	Mix mode: if MixBatch is greater than 1, handshakes are collected into
+	rounds of MixBatch, which are released in random order, or MixTimeout
+	after the first one arrived. MixTimeout should be well below
+	HandshakeTimeout. Random delays for the data are set in Relay.
+	MixBatch is capped to MaxHandshakes.
+	*/
+	MixBatch   int
+	MixTimeout time.Duration
+	
+	adm admission
+	
+	mixOnce sync.Once
+	mixer   *mixer
+	
+	rmutex   sync.Mutex
+	services map[string][]ssh.Conn /* registered hidden services */
+	
+	hOnce    sync.Once
+	hmutex   sync.RWMutex
+	channels map[string]ChannelHandler
+	requests map[string]RequestHandler
+	
+	pmutex  sync.Mutex
+	pending map[string]int
+}
+
+func (s *Server) scrambler() *scrambler.Config {
+	if s.Scrambler==nil { return &Scrambler }
+	return s.Scrambler
+}
+func (s *Server) relay() *relay.Config {
+	if s.Relay==nil { return &Relay }
+	return s.Relay
+}
+
+func (s *Server) Handle(conn ssh.Conn, nc <-chan ssh.NewChannel, reqs <-chan *ssh.Request){
+	c := &sconn{Conn:conn}
+	go s.channel2(c,nc)
+	go s.request2(c,reqs)
+	go func(){
+		conn.Wait()
+		c.unforwardAll()
+	}()
+}
+
+var defaultServer Server
+
 func Handle(conn ssh.Conn, nc <-chan ssh.NewChannel, reqs <-chan *ssh.Request){
-	go channel2(conn,nc)
-	go request2(conn,reqs)
+	defaultServer.Handle(conn,nc,reqs)
+}
+
+/* Registers a channel handler, that is used by Handle. */
+func HandleChannel(ct string, h ChannelHandler) {
+	defaultServer.HandleChannel(ct,h)
+}
+
+/* Registers a global request handler, that is used by Handle. */
+func HandleRequest(name string, h RequestHandler) {
+	defaultServer.HandleRequest(name,h)
 }
 
 func DevNullRequest(reqs <-chan *ssh.Request){
@@ -0,0 +1,148 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+A directory setup on loopback: three authorities, four relays and a
+client, which fetches the consensus, first directly and then over the
+cascade built from it, and finally connects to an echo server through
+the cascade. Exits with 1, if anything fails.
+*/
+package main
+
+import "github.com/maxymania/sshproxy"
+import "github.com/maxymania/sshproxy/directory"
+import "golang.org/x/crypto/ssh"
+import "crypto/ed25519"
+import "crypto/rand"
+import "net/http"
+import "strconv"
+import "time"
+import "net"
+import "log"
+import "io"
+import "os"
+
+func signer() ssh.Signer {
+	_,pk,e := ed25519.GenerateKey(rand.Reader)
+	if e!=nil { log.Fatal(e) }
+	s,e := ssh.NewSignerFromKey(pk)
+	if e!=nil { log.Fatal(e) }
+	return s
+}
+
+func listen() net.Listener {
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { log.Fatal(e) }
+	return l
+}
+
+func echo(l net.Listener) {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return }
+		go func(){ io.Copy(c,c); c.Close() }()
+	}
+}
+
+func relay(l net.Listener, key ssh.Signer) {
+	cfg := &ssh.ServerConfig{NoClientAuth:true}
+	cfg.AddHostKey(key)
+	for {
+		c,e := l.Accept()
+		if e!=nil { return }
+		go func(){
+			cc,nc,rr,e := ssh.NewServerConn(c,cfg)
+			if e!=nil { c.Close(); return }
+			sshproxy.Handle(cc,nc,rr)
+		}()
+	}
+}
+
+func main() {
+	const nauth = 3
+	const nrelay = 4
+	
+	el := listen()
+	go echo(el)
+	
+	/* The authorities. */
+	auths := make([]*directory.Authority,nauth)
+	peers := make([]directory.Peer,nauth)
+	for i := range auths {
+		auths[i] = &directory.Authority{Key:signer()}
+		l := listen()
+		peers[i] = directory.Peer{Addr:l.Addr().String(),Key:auths[i].Key.PublicKey()}
+		go http.Serve(l,auths[i])
+	}
+	for i,a := range auths {
+		for j,p := range peers {
+			if i!=j { a.Peers = append(a.Peers,p) }
+		}
+	}
+	var addrs []string
+	for _,p := range peers { addrs = append(addrs,p.Addr) }
+	
+	/* The relays publish their descriptors. */
+	for i := 0; i<nrelay; i++ {
+		key := signer()
+		l := listen()
+		go relay(l,key)
+		p := &directory.Publisher{Key:key,Authorities:addrs}
+		p.Descriptor.Nickname = "relay"+strconv.Itoa(i)
+		p.Descriptor.Addr = l.Addr().String()
+		p.Descriptor.Bandwidth = 1<<20
+		r,_ := directory.ParseRule("accept *:*")
+		p.Descriptor.Policy = []directory.Rule{r}
+		if e := p.Publish(); e!=nil { log.Fatal(e) }
+	}
+	
+	/* One round. */
+	now := time.Now()
+	for _,a := range auths {
+		if e := a.Vote(now); e!=nil { log.Fatal(e) }
+	}
+	for _,a := range auths {
+		if e := a.Compute(); e!=nil { log.Fatal(e) }
+	}
+	for _,a := range auths { a.Gather() }
+	
+	/* Bootstrap: fetch directly, then over the cascade. */
+	dc := &directory.Client{Authorities:peers,Threshold:nauth,Dial:net.Dial}
+	if e := dc.Update(); e!=nil { log.Fatal("direct: ",e) }
+	log.Println("Consensus:",len(dc.Consensus().Relays),"relays, valid until",dc.Consensus().ValidUntil)
+	dc.Dial = nil
+	if e := dc.Update(); e!=nil { log.Fatal("over the cascade: ",e) }
+	log.Println("Consensus fetched over the cascade")
+	
+	c,e := sshproxy.Dial("tcp",el.Addr().String())
+	if e!=nil { log.Fatal(e) }
+	defer c.Close()
+	msg := []byte("hello through the directory")
+	c.Write(msg)
+	buf := make([]byte,len(msg))
+	_,e = io.ReadFull(c,buf)
+	if e!=nil || string(buf)!=string(msg) { log.Fatal("echo: ",e) }
+	log.Println("Echo ok")
+	os.Exit(0)
+}
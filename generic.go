@@ -25,21 +25,24 @@ SOFTWARE.
 
 package sshproxy
 
-import "bytes"
-import "encoding/binary"
+import "io"
 import "golang.org/x/crypto/ssh"
 import "log"
 import "errors"
-import "io"
 
 import "github.com/maxymania/sshproxy/scrambler"
 import "github.com/maxymania/sshproxy/anyproto"
+import "github.com/maxymania/sshproxy/puzzle"
 
 const any_req1 = "anyprotocolv1"
 
 const (
 	ap_conn = 0x3e
 	ap_resolve = 0xF9
+	ap_echo = 0x7c
+	ap_listen = 0xa7
+	ap_register = 0x93
+	ap_rendezvous = 0x5a
 )
 
 const (
@@ -47,9 +50,62 @@ const (
 	apc_err = 0x5d
 )
 
+/* The maximum number of puzzle solutions, a channel carries. */
+const maxSolutions = 4
+
+const solutionSize = puzzle.NonceSize+puzzle.SolutionSize
+
+/* If set in Level, the address of the exit follows, prefixed by its length. */
+const levelExit = 0x80
+
+var E_EXIT_ADDR = errors.New("Exit address too long")
+var E_LEVEL = errors.New("Level out of range")
+
 type anyprotocol1 struct{
 	Hotness uint8
 	Level   uint8
+	
+	/*
+	The exit, the originator asked for (the Addr of a Client in the pool).
+	The last relay connects to it instead of a random one.
+	*/
+	Exit    string
+	
+	/*
+	Puzzle solutions (Nonce || Solution) of the relays on the way, solved by
+	the originator. Every relay removes the one it redeems and forwards the
+	others.
+	*/
+	Pow     [][]byte
+	
+	redeemed *puzzle.Challenge
+}
+func (a *anyprotocol1) parse(b []byte) error {
+	if len(b)<2 { return io.ErrUnexpectedEOF }
+	a.Hotness,a.Level = b[0],b[1]
+	b = b[2:]
+	a.Exit = ""
+	if a.Level&levelExit!=0 {
+		a.Level &^= levelExit
+		if len(b)<1 || len(b)<1+int(b[0]) { return io.ErrUnexpectedEOF }
+		a.Exit = string(b[1:1+b[0]])
+		b = b[1+b[0]:]
+	}
+	if len(b)%solutionSize!=0 || len(b)>maxSolutions*solutionSize { return E_SOLUTIONS }
+	a.Pow = nil
+	for ; len(b)>0; b = b[solutionSize:] {
+		a.Pow = append(a.Pow,b[:solutionSize:solutionSize])
+	}
+	return nil
+}
+func (a *anyprotocol1) bytes() []byte {
+	b := []byte{a.Hotness,a.Level}
+	if a.Exit!="" {
+		b[1] |= levelExit
+		b = append(append(b,byte(len(a.Exit))),a.Exit...)
+	}
+	for _,p := range a.Pow { b = append(b,p...) }
+	return b
 }
 
 /*
@@ -62,33 +118,48 @@ Hotness:
 	...
 */
 
-func ch_anyproto1(nc ssh.NewChannel){
+func ch_anyproto1(s *Server, c *sconn, nc ssh.NewChannel){
 	var cr anyprotocol1
 	
-	e := binary.Read(bytes.NewReader(nc.ExtraData()), binary.BigEndian,&cr)
+	e := cr.parse(nc.ExtraData())
 	if e!=nil {
-		log.Println("binary.Read",e)
+		log.Println("anyprotocol1.parse",e)
 		nc.Reject(ssh.ConnectionFailed,"Fail!")
 		return
 	}
+	if !s.acquire(c) {
+		log.Println("Too many pending handshakes from",c.RemoteAddr())
+		nc.Reject(ssh.ResourceShortage,"Too many pending handshakes!")
+		return
+	}
+	pending := true
+	defer func(){ if pending { s.release(c) } }()
+	
+	if !s.enter(c,&cr,nc) { return }
+	admitted := true
+	defer func(){ if admitted { s.leave() } }()
+	
 	if cr.Hotness<cr.Level {
 		cr.Hotness++
-		buf := new(bytes.Buffer)
-		e = binary.Write(buf,binary.BigEndian,cr)
-		if e!=nil {
-			log.Println("binary.Write",e)
-			nc.Reject(ssh.ConnectionFailed,"Fail!")
-			return
-		}
 		
-		b := buf.Bytes()
-		cl := selClient()
+		b := cr.bytes()
+		cl := nextHop(&cr)
 		if cl==nil {
 			log.Println("No Client")
 			nc.Reject(ssh.ConnectionFailed,"Fail!")
 			return
 		}
-		ch,rq,e := cl.open(any_req1,b)
+		if m := s.mix(); m!=nil {
+			ap1_mix(s,m,cl,b,nc)
+			return
+		}
+		ch,rq,e := cl.openTimeout(s.OpenTimeout,any_req1,b)
+		if p := challengeOf(e); p!=nil {
+			/* The originator has to solve it, not us. */
+			c.restore(&cr)
+			nc.Reject(ssh.ResourceShortage,p.String())
+			return
+		}
 		if e!=nil {
 			log.Println("cl.open",any_req1,e)
 			nc.Reject(ssh.ConnectionFailed,"Fail!")
@@ -105,7 +176,11 @@ func ch_anyproto1(nc ssh.NewChannel){
 		}
 		go DevNullRequest(rq2)
 		
-		e = scrambler.Intermediate(ch2,ch)
+		sc := *s.scrambler()
+		sc.Relay = s.relay()
+		w := watch(s.HandshakeTimeout,ch,ch2)
+		e = sc.Intermediate(ch2,ch)
+		if !w.stop() && e==nil { e = E_HANDSHAKE_TIMEOUT }
 		
 		if e!=nil {
 			log.Println("scrambler.Intermediate",e)
@@ -123,54 +198,93 @@ func ch_anyproto1(nc ssh.NewChannel){
 	}
 	go DevNullRequest(rq2)
 	
-	ech2,e := scrambler.Endpt(ch2)
+	w := watch(s.HandshakeTimeout,ch2)
+	ech2,e := s.scrambler().Endpt(ch2)
+	if !w.stop() && e==nil { e = E_HANDSHAKE_TIMEOUT }
+	s.leave()
+	admitted = false
 	if e!=nil {
 		log.Println("scrambler.Endpt",e)
+		ch2.Close()
 		return
 	}
 	
-	cty,e := anyproto.DecodeOneByteMessage(ech2)
+	w = watch(s.CommandTimeout,ch2)
+	m,e := anyproto.ReadMessage(ech2)
+	if !w.stop() && e==nil { e = E_COMMAND_TIMEOUT }
 	if e!=nil {
-		log.Println("anyproto.DecodeOneByteMessage",e)
+		log.Println("anyproto.ReadMessage",e)
+		ch2.Close()
 		return
 	}
+	s.release(c)
+	pending = false
 	
-	switch cty{
-	case ap_conn: ap1_connect(ech2,ch2)
-	case ap_resolve: ap1_resolve(ech2,ch2)
+	switch m.Op{
+	case ap_conn: ap1_connect(s,m,ech2,ch2)
+	case ap_resolve: ap1_resolve(m,ech2)
+	case ap_echo: ap1_echo(m,ech2)
+	case ap_listen: ap1_listen(s,m,ech2)
+	case ap_register: ap1_register(s,m,ech2)
+	case ap_rendezvous: ap1_rendezvous(s,m,ech2)
 	default:
-		ch2.Close()
+		if h := command(m.Op); h!=nil {
+			ap1_command(h,m,ech2,ch2)
+			return
+		}
+		replyErr(ech2,EC_UNSUPPORTED,"")
+		ech2.Close()
 	}
 }
 
-func chopen_anyproto1(ct byte) (io.ReadWriteCloser,error){
+/*
+Returns the Client for the next hop of cr, whose Hotness is already
+incremented. If the next hop is the exit and cr asks for one, it is that.
+*/
+func nextHop(cr *anyprotocol1) *Client {
+	if cr.Exit!="" && cr.Hotness>=cr.Level { return findClient(cr.Exit) }
+	return selClient()
+}
+
+/* Builds a circuit of the given level and sends the command m. */
+func chopen_anyproto1(level int, m *anyproto.Message) (*scrambler.Conn,error){
+	return chopen_exit(level,"",m)
+}
+
+/*
+Like chopen_anyproto1, but the circuit ends at the given exit, the Addr of
+a Client in the pool of the last relay. If exit is empty, it is a random one.
+*/
+func chopen_exit(level int, exit string, m *anyproto.Message) (*scrambler.Conn,error){
 	var cr anyprotocol1
 	
-	cr.Hotness = 1
-	cr.Level = uint8(Level)
+	if path()!=nil { return nil,E_PATH_MODE }
+	if len(exit)>0xff { return nil,E_EXIT_ADDR }
+	if level<0 || level>=levelExit { return nil,E_LEVEL }
 	
-	buf := new(bytes.Buffer)
-	binary.Write(buf,binary.BigEndian,cr)
+	cr.Hotness = 1
+	cr.Level = uint8(level)
+	cr.Exit = exit
 	
-	cl := selClient()
+	cl := nextHop(&cr)
 	if cl==nil { return nil,errors.New("No Client") }
-	ch,rq,e := cl.open(any_req1,buf.Bytes()) /* send anyprotocol1 */
+	ch,rq,e := cl.openSolve(any_req1,&cr) /* send anyprotocol1 */
 	if e!=nil {
 		log.Println("chopen_anyproto1: cl.open",e)
 		return nil,e
 	}
 	go DevNullRequest(rq)
 	
-	ech,e := scrambler.Initiator(ch)
+	ech,e := cl.scrambler().Initiator(ch)
 	if e!=nil {
 		log.Println("chopen_anyproto1: scrambler.Initiator",e)
 		ch.Close()
 		return nil,e
 	}
 	
-	e = anyproto.EncodeOneByteMessage(ech,ct)
+	e = anyproto.WriteMessage(ech,m)
 	if e!=nil {
-		log.Println("chopen_anyproto1: anyproto.EncodeOneByteMessage",e)
+		log.Println("chopen_anyproto1: anyproto.WriteMessage",e)
 		ech.Close()
 		return nil,e
 	}
@@ -0,0 +1,413 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "github.com/maxymania/sshproxy/anyproto"
+import "github.com/maxymania/sshproxy/scrambler"
+import "golang.org/x/crypto/ssh"
+import "crypto/ed25519"
+import "crypto/sha256"
+import "crypto/rand"
+import "encoding/base32"
+import mrand "math/rand"
+import "bytes"
+import "sort"
+import "strings"
+import "errors"
+import "time"
+import "sync"
+import "net"
+import "log"
+import "io"
+
+/*
+Hidden services are reachable only through the cascade:
+
+The service registers its name at the exit of its own circuit (the
+rendezvous point), which keeps the circuit open. A client asks the exit
+of its circuit to connect it to the name, the exit splices the client's
+circuit with a channel on the service's one. So neither side learns the
+other's address.
+
+The name is derived from the service's key (see HiddenName). The service
+proves the key to the rendezvous point on registration, and to the client
+on every connection (as SSH host key of an end-to-end SSH session), so
+neither the rendezvous point nor anyone else can impersonate it.
+
+The rendezvous points of a name are ranked by rendezvous hashing over
+RendezvousPoints. The service keeps Replicas registrations, one at each of
+the highest ranked points, and the client tries them in order. Both ask
+for the point as exit of their circuits, so it must be in the pool of
+every relay, e.g. through the directory.
+*/
+
+/* Host names ending with this suffix are hidden services for Dial. */
+const HiddenSuffix = ".sotp"
+
+/* How often DialHidden tries another circuit. */
+const hiddenRetries = 8
+
+/*
+The addresses of the rendezvous points (nodes with Server.Rendezvous set).
+Hidden services and their clients must agree on them. If empty, the
+addresses of the pool are used.
+*/
+var RendezvousPoints []string
+
+var E_HIDDEN_NAME = errors.New("Hidden service key doesn't match the name")
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* Returns the name of the hidden service with the given key. */
+func HiddenName(pub ssh.PublicKey) string {
+	h := sha256.Sum256(pub.Marshal())
+	return strings.ToLower(b32.EncodeToString(h[:]))
+}
+
+/* Returns the rendezvous points of name, highest ranked first. */
+func rendezvousPoints(name string) []string {
+	pts := RendezvousPoints
+	if len(pts)==0 {
+		for _,c := range Clients() { pts = append(pts,c.Addr) }
+	}
+	type ranked struct{
+		addr  string
+		score [sha256.Size]byte
+	}
+	rs := make([]ranked,len(pts))
+	for i,a := range pts {
+		rs[i] = ranked{a,sha256.Sum256([]byte(name+"\x00"+a))}
+	}
+	sort.Slice(rs,func(i, j int) bool { return bytes.Compare(rs[i].score[:],rs[j].score[:])>0 })
+	pts = make([]string,len(rs))
+	for i,r := range rs { pts[i] = r.addr }
+	return pts
+}
+
+func (s *Server) register(name string, sc ssh.Conn) {
+	s.rmutex.Lock(); defer s.rmutex.Unlock()
+	if s.services==nil { s.services = make(map[string][]ssh.Conn) }
+	s.services[name] = append(s.services[name],sc)
+}
+func (s *Server) unregister(name string, sc ssh.Conn) {
+	s.rmutex.Lock(); defer s.rmutex.Unlock()
+	l := s.services[name]
+	for i,c := range l {
+		if c!=sc { continue }
+		l = append(l[:i],l[i+1:]...)
+		break
+	}
+	if len(l)==0 {
+		delete(s.services,name)
+	} else {
+		s.services[name] = l
+	}
+}
+func (s *Server) service(name string) ssh.Conn {
+	s.rmutex.Lock(); defer s.rmutex.Unlock()
+	l := s.services[name]
+	if len(l)==0 { return nil }
+	return l[mrand.Intn(len(l))]
+}
+
+func ephemeralSigner() (ssh.Signer,error) {
+	_,pk,e := ed25519.GenerateKey(rand.Reader)
+	if e!=nil { return nil,e }
+	return ssh.NewSignerFromKey(pk)
+}
+
+/*
+Register request: tag_host (the name). After the apc_ok reply, the circuit
+carries an SSH connection, on which the service authenticates with its key.
+The rendezvous point opens a "rendezvous" channel on it for every client.
+*/
+func ap1_register(s *Server, m *anyproto.Message, ech2 *scrambler.Conn){
+	defer ech2.Close()
+	name,ok := m.String(tag_host)
+	if !ok {
+		replyErr(ech2,EC_FAILED,"malformed request")
+		return
+	}
+	if !s.Rendezvous {
+		replyErr(ech2,EC_DENIED,"")
+		return
+	}
+	e := anyproto.WriteMessage(ech2,&anyproto.Message{Op:apc_ok})
+	if e!=nil { return }
+	
+	sig,e := ephemeralSigner()
+	if e!=nil { return }
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if HiddenName(key)!=name { return nil,E_HIDDEN_NAME }
+			return nil,nil
+		},
+	}
+	cfg.AddHostKey(sig)
+	sc,nc,rq,e := ssh.NewServerConn(ech2,cfg)
+	if e!=nil {
+		log.Println("ap1_register: ssh.NewServerConn",e)
+		return
+	}
+	go DevNullChannel(nc)
+	go DevNullRequest(rq)
+	s.register(name,sc)
+	sc.Wait()
+	s.unregister(name,sc)
+}
+
+/* Rendezvous request: tag_host (the name). The apc_ok reply is followed by the service's stream. */
+func ap1_rendezvous(s *Server, m *anyproto.Message, ech2 *scrambler.Conn){
+	name,ok := m.String(tag_host)
+	if !ok {
+		replyErr(ech2,EC_FAILED,"malformed request")
+		ech2.Close()
+		return
+	}
+	sc := s.service(name)
+	if sc==nil {
+		replyErr(ech2,EC_NONAME,"")
+		ech2.Close()
+		return
+	}
+	ch,rq,e := sc.OpenChannel("rendezvous",nil)
+	if e!=nil {
+		replyErr(ech2,EC_UNREACHABLE,"")
+		ech2.Close()
+		return
+	}
+	go DevNullRequest(rq)
+	e = anyproto.WriteMessage(ech2,&anyproto.Message{Op:apc_ok})
+	if e!=nil {
+		ch.Close()
+		ech2.Close()
+		return
+	}
+	s.relay().Relay(ech2,ch)
+}
+
+/* A stream to a hidden service. Closing it closes the end-to-end SSH session. */
+type hiddenConn struct{
+	chanConn
+	conn ssh.Conn
+}
+func (h *hiddenConn) Close() error {
+	h.chanConn.Close()
+	return h.conn.Close()
+}
+
+type hiddenAddr string
+func (h hiddenAddr) Network() string { return "sotp" }
+func (h hiddenAddr) String() string { return string(h) }
+
+/*
+Connects to the hidden service with the given name (with or without
+HiddenSuffix). The service is authenticated by its key.
+*/
+func DialHidden(name string) (net.Conn,error) {
+	return DialHiddenLevel(Level,name)
+}
+
+/* Like DialHidden, but with circuits of the given level instead of Level. */
+func DialHiddenLevel(level int, name string) (net.Conn,error) {
+	name = strings.ToLower(strings.TrimSuffix(name,HiddenSuffix))
+	m := &anyproto.Message{Op:ap_rendezvous}
+	m.AddString(tag_host,name)
+	pts := rendezvousPoints(name)
+	if len(pts)==0 { return nil,errors.New("No Client") }
+	var ech *scrambler.Conn
+	var e error
+	for i := 0; i<hiddenRetries; i++ {
+		ech,e = chopen_exit(level,pts[i%len(pts)],m)
+		if e!=nil { continue }
+		_,e = readReply(ech)
+		if e==nil { break }
+		ech.Close()
+		ech = nil
+	}
+	if ech==nil { return nil,e }
+	
+	cfg := &ssh.ClientConfig{
+		User: "hidden",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if HiddenName(key)!=name { return E_HIDDEN_NAME }
+			return nil
+		},
+	}
+	conn,nc,rq,e := ssh.NewClientConn(ech,name,cfg)
+	if e!=nil {
+		ech.Close()
+		return nil,e
+	}
+	go DevNullChannel(nc)
+	go DevNullRequest(rq)
+	ch,crq,e := conn.OpenChannel("hidden",nil)
+	if e!=nil {
+		conn.Close()
+		return nil,e
+	}
+	go DevNullRequest(crq)
+	return &hiddenConn{chanConn{ch,hiddenAddr("client"),hiddenAddr(name+HiddenSuffix)},conn},nil
+}
+
+/* Publishes a hidden service. */
+type HiddenService struct{
+	/* The service's key. Its name is HiddenName(Key.PublicKey()). */
+	Key ssh.Signer
+	
+	/* Connections are forwarded to this (local) TCP address. */
+	Local string
+	
+	/* The number of rendezvous points, the service registers at. If zero, 3 is used. */
+	Replicas int
+	
+	once sync.Once
+	stop chan struct{}
+}
+
+func (h *HiddenService) Name() string { return HiddenName(h.Key.PublicKey()) }
+
+/* Keeps the registrations open, until Close is called. Blocks. */
+func (h *HiddenService) Run() {
+	h.once.Do(func(){ h.stop = make(chan struct{}) })
+	n := h.Replicas
+	if n<=0 { n = 3 }
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i<n; i++ {
+		go func(i int){
+			defer wg.Done()
+			h.replica(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (h *HiddenService) Close() error {
+	h.once.Do(func(){ h.stop = make(chan struct{}) })
+	select {
+	case <-h.stop:
+	default: close(h.stop)
+	}
+	return nil
+}
+
+/* Maintains the i-th registration, with exponential backoff on errors. */
+func (h *HiddenService) replica(i int) {
+	backoff := time.Second
+	for {
+		t0 := time.Now()
+		e := h.register(i)
+		if e!=nil { log.Println("HiddenService:",e) }
+		if time.Since(t0)>time.Minute { backoff = time.Second }
+		t := time.NewTimer(backoff)
+		select {
+		case <-h.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if backoff<time.Minute { backoff *= 2 }
+	}
+}
+
+/* Registers at the i-th ranked rendezvous point and serves the clients. */
+func (h *HiddenService) register(i int) error {
+	name := h.Name()
+	pts := rendezvousPoints(name)
+	if len(pts)==0 { return errors.New("No Client") }
+	m := &anyproto.Message{Op:ap_register}
+	m.AddString(tag_host,name)
+	ech,e := chopen_exit(Level,pts[i%len(pts)],m)
+	if e!=nil { return e }
+	_,e = readReply(ech)
+	if e!=nil { ech.Close(); return e }
+	
+	cfg := &ssh.ClientConfig{
+		User: "hidden",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(h.Key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn,nc,rq,e := ssh.NewClientConn(ech,"rendezvous",cfg)
+	if e!=nil { ech.Close(); return e }
+	go DevNullRequest(rq)
+	done := make(chan struct{})
+	defer close(done)
+	go func(){
+		select {
+		case <-h.stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	for n := range nc {
+		if n.ChannelType()!="rendezvous" {
+			n.Reject(ssh.UnknownChannelType,"Unknown channel type!")
+			continue
+		}
+		go h.serve(n)
+	}
+	e = conn.Wait()
+	/* The rendezvous point or h.Close closed the connection. */
+	if errors.Is(e,io.EOF) || errors.Is(e,net.ErrClosed) { return nil }
+	return e
+}
+
+/* Serves one client: end-to-end SSH with the service's key, then forwards to Local. */
+func (h *HiddenService) serve(n ssh.NewChannel) {
+	ch,rq,e := n.Accept()
+	if e!=nil { return }
+	go DevNullRequest(rq)
+	cfg := &ssh.ServerConfig{NoClientAuth:true}
+	cfg.AddHostKey(h.Key)
+	sc,nc,srq,e := ssh.NewServerConn(&chanConn{ch,hiddenAddr(h.Name()),hiddenAddr("client")},cfg)
+	if e!=nil {
+		ch.Close()
+		return
+	}
+	defer sc.Close()
+	go DevNullRequest(srq)
+	for n := range nc {
+		if n.ChannelType()!="hidden" {
+			n.Reject(ssh.UnknownChannelType,"Unknown channel type!")
+			continue
+		}
+		go func(n ssh.NewChannel){
+			tc,e := net.Dial("tcp",h.Local)
+			if e!=nil {
+				n.Reject(ssh.ConnectionFailed,e.Error())
+				return
+			}
+			c,crq,e := n.Accept()
+			if e!=nil {
+				tc.Close()
+				return
+			}
+			go DevNullRequest(crq)
+			Relay.Relay(c,tc)
+		}(n)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "sync"
+import "sync/atomic"
+import "time"
+import "net"
+import "io"
+import "github.com/maxymania/sshproxy/puzzle"
+
+/* The state of one SSH connection to this Server. */
+type sconn struct{
+	ssh.Conn
+	pending int32 /* pending handshakes */
+	
+	cmutex     sync.Mutex
+	challenges []*puzzle.Challenge /* outstanding puzzles */
+	
+	fmutex   sync.Mutex
+	forwards map[string]net.Listener /* see TCPIPForward */
+}
+
+func (c *sconn) host() string {
+	a := c.RemoteAddr().String()
+	h,_,e := net.SplitHostPort(a)
+	if e!=nil { return a }
+	return h
+}
+
+/*
+Reserves a slot for a pending handshake on c. Returns false, if either the
+per-connection or the per-address limit is reached.
+*/
+func (s *Server) acquire(c *sconn) bool {
+	if s.MaxPendingConn>0 {
+		if atomic.AddInt32(&c.pending,1)>int32(s.MaxPendingConn) {
+			atomic.AddInt32(&c.pending,-1)
+			return false
+		}
+	}
+	if s.MaxPendingAddr>0 {
+		h := c.host()
+		s.pmutex.Lock()
+		defer s.pmutex.Unlock()
+		if s.pending[h]>=s.MaxPendingAddr {
+			if s.MaxPendingConn>0 { atomic.AddInt32(&c.pending,-1) }
+			return false
+		}
+		if s.pending==nil { s.pending = make(map[string]int) }
+		s.pending[h]++
+	}
+	return true
+}
+func (s *Server) release(c *sconn) {
+	if s.MaxPendingConn>0 {
+		atomic.AddInt32(&c.pending,-1)
+	}
+	if s.MaxPendingAddr>0 {
+		h := c.host()
+		s.pmutex.Lock()
+		defer s.pmutex.Unlock()
+		if s.pending[h]--; s.pending[h]<=0 { delete(s.pending,h) }
+	}
+}
+
+/* Closes the given streams, unless stopped within d. A zero d never fires. */
+type watchdog struct{
+	t *time.Timer
+}
+func watch(d time.Duration, c ...io.Closer) *watchdog {
+	if d<=0 { return &watchdog{} }
+	return &watchdog{time.AfterFunc(d,func(){
+		for _,cc := range c { cc.Close() }
+	})}
+}
+
+/* Returns false, if the watchdog already fired. */
+func (w *watchdog) stop() bool {
+	if w.t==nil { return true }
+	return w.t.Stop()
+}
+
+type openResult struct{
+	ch ssh.Channel
+	rq <-chan *ssh.Request
+	e  error
+}
+
+var E_OPEN_TIMEOUT = errTimeout("Timeout while opening channel")
+var E_HANDSHAKE_TIMEOUT = errTimeout("Timeout during handshake")
+var E_COMMAND_TIMEOUT = errTimeout("Timeout while waiting for command")
+
+type errTimeout string
+func (e errTimeout) Error() string { return string(e) }
+func (e errTimeout) Timeout() bool { return true }
+func (e errTimeout) Temporary() bool { return true }
+
+/* Like cl.open, but gives up after d. A late channel is closed. */
+func (cl *Client) openTimeout(d time.Duration, ct string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	if d<=0 { return cl.open(ct,data) }
+	var mutex sync.Mutex
+	late := false
+	res := make(chan openResult,1)
+	go func(){
+		ch,rq,e := cl.open(ct,data)
+		mutex.Lock(); defer mutex.Unlock()
+		if late {
+			if e==nil {
+				ch.Close()
+				go DevNullRequest(rq)
+			}
+			return
+		}
+		res <- openResult{ch,rq,e}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-res: return r.ch,r.rq,r.e
+	case <-t.C:
+	}
+	mutex.Lock(); defer mutex.Unlock()
+	late = true
+	/* The open might have succeeded in the meantime. */
+	select {
+	case r := <-res:
+		return r.ch,r.rq,r.e
+	default:
+	}
+	return nil,nil,E_OPEN_TIMEOUT
+}
@@ -0,0 +1,336 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "github.com/maxymania/sshproxy/anyproto"
+import "github.com/maxymania/sshproxy/scrambler"
+import "golang.org/x/crypto/ssh"
+import "crypto/ed25519"
+import "crypto/rand"
+import "strconv"
+import "errors"
+import "time"
+import "net"
+import "log"
+
+var E_NO_DEADLINE = errors.New("Deadlines are not supported")
+
+/* The extra data of a "forwarded-tcpip" channel (RFC 4254, 7.2). */
+type forwardedTCPIP struct{
+	Addr     string
+	Port     uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+/* The payload of "tcpip-forward" and "cancel-tcpip-forward" requests. */
+type tcpipForward struct{
+	Addr string
+	Port uint32
+}
+
+/* An ssh.Channel as net.Conn. */
+type chanConn struct{
+	ssh.Channel
+	l,r net.Addr
+}
+func (c *chanConn) LocalAddr() net.Addr { return c.l }
+func (c *chanConn) RemoteAddr() net.Addr { return c.r }
+func (c *chanConn) SetDeadline(t time.Time) error { return E_NO_DEADLINE }
+func (c *chanConn) SetReadDeadline(t time.Time) error { return E_NO_DEADLINE }
+func (c *chanConn) SetWriteDeadline(t time.Time) error { return E_NO_DEADLINE }
+
+func tcpAddr(host string, port uint32) net.Addr {
+	return &net.TCPAddr{IP:net.ParseIP(host),Port:int(port)}
+}
+
+/*
+Listen request: tag_host and tag_port. The apc_ok reply carries the port,
+the exit listens on. Then the circuit carries an SSH connection, on which
+the exit (as SSH server) opens a "forwarded-tcpip" channel for every
+inbound connection. The listener is closed with the circuit.
+*/
+func ap1_listen(s *Server, m *anyproto.Message, ech2 *scrambler.Conn){
+	defer ech2.Close()
+	host,ok1 := m.String(tag_host)
+	port,ok2 := m.Uint(tag_port)
+	if !ok1 || !ok2 || port>0xffff {
+		replyErr(ech2,EC_FAILED,"malformed request")
+		return
+	}
+	if s.PermitExitListen==nil || !s.PermitExitListen(host,uint32(port)) {
+		replyErr(ech2,EC_DENIED,"")
+		return
+	}
+	l,e := net.Listen("tcp",net.JoinHostPort(host,strconv.Itoa(int(port))))
+	if e!=nil {
+		replyErr(ech2,errCode(e),"")
+		return
+	}
+	defer l.Close()
+	port = uint64(l.Addr().(*net.TCPAddr).Port)
+	e = anyproto.WriteMessage(ech2,(&anyproto.Message{Op:apc_ok}).AddUint(tag_port,port))
+	if e!=nil { return }
+	
+	_,pk,e := ed25519.GenerateKey(rand.Reader)
+	if e!=nil { return }
+	sig,e := ssh.NewSignerFromKey(pk)
+	if e!=nil { return }
+	cfg := &ssh.ServerConfig{NoClientAuth:true}
+	cfg.AddHostKey(sig)
+	sc,nc,rq,e := ssh.NewServerConn(ech2,cfg)
+	if e!=nil {
+		log.Println("ap1_listen: ssh.NewServerConn",e)
+		return
+	}
+	go DevNullChannel(nc)
+	go DevNullRequest(rq)
+	go func(){
+		sc.Wait()
+		l.Close()
+	}()
+	
+	for {
+		conn,e := l.Accept()
+		if e!=nil { break }
+		go func(){
+			o := conn.RemoteAddr().(*net.TCPAddr)
+			ch,rq,e := sc.OpenChannel("forwarded-tcpip",ssh.Marshal(&forwardedTCPIP{host,uint32(port),o.IP.String(),uint32(o.Port)}))
+			if e!=nil {
+				conn.Close()
+				return
+			}
+			go DevNullRequest(rq)
+			s.relay().Relay(conn,ch)
+		}()
+	}
+	sc.Close()
+}
+
+/* The client side of a listener at the exit. */
+type listener struct{
+	conn ssh.Conn
+	nc   <-chan ssh.NewChannel
+	addr net.Addr
+}
+func (l *listener) Addr() net.Addr { return l.addr }
+func (l *listener) Close() error { return l.conn.Close() }
+func (l *listener) Accept() (net.Conn,error) {
+	for n := range l.nc {
+		var f forwardedTCPIP
+		if n.ChannelType()!="forwarded-tcpip" || ssh.Unmarshal(n.ExtraData(),&f)!=nil {
+			n.Reject(ssh.UnknownChannelType,"Unknown channel type!")
+			continue
+		}
+		ch,rq,e := n.Accept()
+		if e!=nil { continue }
+		go DevNullRequest(rq)
+		return &chanConn{ch,l.addr,tcpAddr(f.OrigAddr,f.OrigPort)},nil
+	}
+	return nil,net.ErrClosed
+}
+
+/*
+Asks the exit of a new circuit to listen on addr. Inbound connections are
+delivered through the cascade. Port 0 selects a free port, see Addr().
+*/
+func Listen(netw, addr string) (net.Listener,error) {
+	return ListenLevel(Level,netw,addr)
+}
+
+/*
+Like Listen, but with a circuit of the given level instead of Level. In path
+mode, level is ignored and the last hop listens.
+*/
+func ListenLevel(level int, netw, addr string) (net.Listener,error) {
+	switch netw {
+	case "tcp","tcp4","tcp6":
+	default: return nil,net.UnknownNetworkError(netw)
+	}
+	if p := path(); p!=nil { return p.Listen(netw,addr) }
+	host,sport,e := net.SplitHostPort(addr)
+	if e!=nil { return nil,e }
+	port,e := net.LookupPort(netw,sport)
+	if e!=nil { return nil,e }
+	
+	m := &anyproto.Message{Op:ap_listen}
+	m.AddString(tag_host,host).AddUint(tag_port,uint64(port))
+	ech,e := chopen_anyproto1(level,m)
+	if e!=nil { return nil,e }
+	r,e := readReply(ech)
+	if e!=nil {
+		ech.Close()
+		return nil,e
+	}
+	p,_ := r.Uint(tag_port)
+	
+	cfg := &ssh.ClientConfig{User:"listen",HostKeyCallback:ssh.InsecureIgnoreHostKey()}
+	conn,nc,rq,e := ssh.NewClientConn(ech,"exit",cfg)
+	if e!=nil {
+		ech.Close()
+		return nil,e
+	}
+	go DevNullRequest(rq)
+	return &listener{conn,nc,tcpAddr(host,uint32(p))},nil
+}
+
+/*
+Used, if Server.OpenTimeout is zero, as the circuit of a forwarding is built,
+while the later requests of the connection wait.
+*/
+const defaultListenTimeout = 30*time.Second
+
+type listenResult struct{
+	l net.Listener
+	e error
+}
+
+var E_LISTEN_TIMEOUT = errTimeout("Timeout while listening")
+
+/* Like ListenLevel, but gives up after d. A late listener is closed. */
+func listenTimeout(d time.Duration, level int, netw, addr string) (net.Listener,error) {
+	res := make(chan listenResult,1)
+	late := make(chan struct{})
+	go func(){
+		l,e := ListenLevel(level,netw,addr)
+		select {
+		case res <- listenResult{l,e}:
+		case <-late:
+			if e==nil { l.Close() }
+		}
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case r := <-res: return r.l,r.e
+	case <-t.C:
+	}
+	close(late)
+	/* The listener might have been built in the meantime. */
+	select {
+	case r := <-res: return r.l,r.e
+	default:
+	}
+	return nil,E_LISTEN_TIMEOUT
+}
+
+/*
+Serves "tcpip-forward" requests, as sent by "ssh -R". The exit of a new
+circuit listens and inbound connections are delivered as "forwarded-tcpip"
+channels. The exit must permit it, see PermitExitListen. The circuit must be
+built within OpenTimeout (default 30s). It is not installed by default, use
+
+	s.HandleRequest("tcpip-forward",s.TCPIPForward)
+	s.HandleRequest("cancel-tcpip-forward",s.CancelTCPIPForward)
+*/
+func (s *Server) TCPIPForward(conn ssh.Conn, r *ssh.Request) {
+	var f tcpipForward
+	c,ok := conn.(*sconn)
+	if !ok || ssh.Unmarshal(r.Payload,&f)!=nil || f.Port>0xffff || !permit(s.PermitListen,PermitForwarding,conn,f.Addr,f.Port) {
+		if r.WantReply { r.Reply(false,nil) }
+		return
+	}
+	d := s.OpenTimeout
+	if d<=0 { d = defaultListenTimeout }
+	l,e := listenTimeout(d,s.level(),"tcp",net.JoinHostPort(f.Addr,strconv.Itoa(int(f.Port))))
+	if e!=nil {
+		log.Println("TCPIPForward: listenTimeout",e)
+		if r.WantReply { r.Reply(false,nil) }
+		return
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	if !c.forward(f.Addr,port,l) {
+		l.Close()
+		if r.WantReply { r.Reply(false,nil) }
+		return
+	}
+	if r.WantReply {
+		if f.Port==0 {
+			r.Reply(true,ssh.Marshal(&struct{ Port uint32 }{port}))
+		} else {
+			r.Reply(true,nil)
+		}
+	}
+	
+	go s.forwarded(c,f.Addr,port,l)
+}
+
+/* Accepts the connections of a forwarding and opens a "forwarded-tcpip" channel for each. */
+func (s *Server) forwarded(c *sconn, addr string, port uint32, l net.Listener) {
+	for {
+		tc,e := l.Accept()
+		if e!=nil { break }
+		go func(){
+			o := tc.RemoteAddr().(*net.TCPAddr)
+			ch,rq,e := c.OpenChannel("forwarded-tcpip",ssh.Marshal(&forwardedTCPIP{addr,port,o.IP.String(),uint32(o.Port)}))
+			if e!=nil {
+				tc.Close()
+				return
+			}
+			go DevNullRequest(rq)
+			s.relay().Relay(ch,tc)
+		}()
+	}
+	c.unforward(addr,port,l)
+}
+
+/* Serves "cancel-tcpip-forward" requests. See TCPIPForward. */
+func (s *Server) CancelTCPIPForward(conn ssh.Conn, r *ssh.Request) {
+	var f tcpipForward
+	c,ok := conn.(*sconn)
+	res := ok && ssh.Unmarshal(r.Payload,&f)==nil && c.unforward(f.Addr,f.Port,nil)
+	if r.WantReply { r.Reply(res,nil) }
+}
+
+/* Remembers a forwarding of c. Returns false, if it already exists. */
+func (c *sconn) forward(addr string, port uint32, l net.Listener) bool {
+	k := net.JoinHostPort(addr,strconv.Itoa(int(port)))
+	c.fmutex.Lock(); defer c.fmutex.Unlock()
+	if _,ok := c.forwards[k]; ok { return false }
+	if c.forwards==nil { c.forwards = make(map[string]net.Listener) }
+	c.forwards[k] = l
+	return true
+}
+
+/* Closes a forwarding. If l is not nil, only if it is still the active one. */
+func (c *sconn) unforward(addr string, port uint32, l net.Listener) bool {
+	k := net.JoinHostPort(addr,strconv.Itoa(int(port)))
+	c.fmutex.Lock(); defer c.fmutex.Unlock()
+	o,ok := c.forwards[k]
+	if !ok || (l!=nil && o!=l) { return false }
+	delete(c.forwards,k)
+	o.Close()
+	return true
+}
+
+/* Closes all forwardings of c. */
+func (c *sconn) unforwardAll() {
+	c.fmutex.Lock(); defer c.fmutex.Unlock()
+	for k,l := range c.forwards {
+		l.Close()
+		delete(c.forwards,k)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "github.com/maxymania/sshproxy/anyproto"
+import "errors"
+import "syscall"
+import "strconv"
+import "net"
+import "io"
+
+/* Field tags of anyproto messages. */
+const (
+	tag_host = 1
+	tag_port = 2
+	tag_ip   = 3
+	tag_code = 4
+	tag_msg  = 5
+	tag_size = 6
+	tag_ttl  = 7
+)
+
+/* Error codes of an apc_err reply. */
+const (
+	EC_FAILED = iota+1
+	EC_REFUSED
+	EC_UNREACHABLE
+	EC_TIMEOUT
+	EC_NONAME
+	EC_DENIED
+	EC_UNSUPPORTED
+)
+
+var ecNames = map[int]string{
+	EC_FAILED: "failed",
+	EC_REFUSED: "connection refused",
+	EC_UNREACHABLE: "network unreachable",
+	EC_TIMEOUT: "timeout",
+	EC_NONAME: "no such host",
+	EC_DENIED: "permission denied",
+	EC_UNSUPPORTED: "unsupported command",
+}
+
+var E_EXIT_POLICY = errors.New("Exit policy rejects the target")
+
+/* An error reported by the exit. */
+type RemoteError struct{
+	Code int
+	Msg  string
+}
+func (e *RemoteError) Error() string {
+	n,ok := ecNames[e.Code]
+	if !ok { n = "error "+strconv.Itoa(e.Code) }
+	if e.Msg=="" { return "remote: "+n }
+	return "remote: "+n+": "+e.Msg
+}
+func (e *RemoteError) Timeout() bool { return e.Code==EC_TIMEOUT }
+func (e *RemoteError) Temporary() bool { return e.Code==EC_TIMEOUT || e.Code==EC_UNREACHABLE }
+
+/* Maps a local error to an error code. */
+func errCode(e error) int {
+	var dnse *net.DNSError
+	var ne net.Error
+	switch {
+	case errors.Is(e,E_EXIT_POLICY): return EC_DENIED
+	case errors.As(e,&dnse): return EC_NONAME
+	case errors.Is(e,syscall.ECONNREFUSED): return EC_REFUSED
+	case errors.Is(e,syscall.ENETUNREACH),errors.Is(e,syscall.EHOSTUNREACH): return EC_UNREACHABLE
+	case errors.As(e,&ne) && ne.Timeout(): return EC_TIMEOUT
+	}
+	return EC_FAILED
+}
+
+/* Sends an apc_err reply. */
+func replyErr(w io.Writer, code int, msg string) error {
+	m := &anyproto.Message{Op:apc_err}
+	m.AddUint(tag_code,uint64(code)).AddString(tag_msg,msg)
+	return anyproto.WriteMessage(w,m)
+}
+
+/* Reads a reply. An apc_err reply is returned as *RemoteError. */
+func readReply(r io.Reader) (*anyproto.Message,error) {
+	m,e := anyproto.ReadMessage(r)
+	if e!=nil { return nil,e }
+	switch m.Op {
+	case apc_ok: return m,nil
+	case apc_err:
+		c,_ := m.Uint(tag_code)
+		s,_ := m.String(tag_msg)
+		return nil,&RemoteError{int(c),s}
+	}
+	return nil,errors.New("Unknown reply!")
+}
@@ -0,0 +1,207 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "math/rand"
+import "sync"
+import "time"
+import "io"
+import "log"
+
+/*
+Collects handshakes into rounds. A round is released, once Batch
+handshakes are waiting or Timeout after its first handshake arrived,
+whatever happens first. The waiters of a round are released one by one
+in random order: the next one only after the previous one sent its
+record to the next hop (or Timeout passed), so the order of the outgoing
+records doesn't follow the order of the incoming ones.
+*/
+type mixer struct{
+	Batch   int
+	Timeout time.Duration
+	
+	mutex   sync.Mutex
+	waiting []mixSlot
+	timer   *time.Timer
+}
+
+type mixSlot struct{
+	turn chan struct{} /* closed, when it's the waiter's turn */
+	sent chan struct{} /* closed by the waiter, when it sent its record */
+}
+
+/*
+Blocks until it's the caller's turn in the released round. The caller must
+call the returned function, once it sent its record or gave up. It may be
+called more than once.
+*/
+func (m *mixer) wait() func() {
+	c := mixSlot{make(chan struct{}),make(chan struct{})}
+	m.mutex.Lock()
+	m.waiting = append(m.waiting,c)
+	if len(m.waiting)>=m.Batch {
+		m.flush()
+	} else if len(m.waiting)==1 && m.Timeout>0 {
+		m.timer = time.AfterFunc(m.Timeout,func(){
+			m.mutex.Lock(); defer m.mutex.Unlock()
+			m.flush()
+		})
+	}
+	m.mutex.Unlock()
+	<-c.turn
+	var once sync.Once
+	return func(){ once.Do(func(){ close(c.sent) }) }
+}
+
+/* Releases the current round. m.mutex must be held. */
+func (m *mixer) flush() {
+	if m.timer!=nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	w := m.waiting
+	m.waiting = nil
+	rand.Shuffle(len(w),func(i,j int){ w[i],w[j] = w[j],w[i] })
+	go m.release(w)
+}
+func (m *mixer) release(w []mixSlot) {
+	for _,c := range w {
+		close(c.turn)
+		t := time.NewTimer(m.Timeout)
+		select {
+		case <-c.sent:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+/* Used, if Server.MixTimeout is zero, so a round never waits forever. */
+const defaultMixTimeout = time.Second
+
+func (s *Server) mix() *mixer {
+	s.mixOnce.Do(func(){
+		if s.MixBatch<=1 { return }
+		s.mixer = &mixer{Batch:s.MixBatch,Timeout:s.MixTimeout}
+		/* Waiting handshakes hold their slot, so a bigger round could never fill. */
+		if s.MaxHandshakes>0 && s.mixer.Batch>s.MaxHandshakes { s.mixer.Batch = s.MaxHandshakes }
+		if s.mixer.Timeout<=0 { s.mixer.Timeout = defaultMixTimeout }
+	})
+	return s.mixer
+}
+
+/*
+A channel to the next hop, that is opened late, after the mixer released
+the round. Read and Write fail, until it is opened.
+*/
+type lazyChannel struct{
+	mutex  sync.Mutex
+	ch     ssh.Channel
+	closed bool
+	sent   func() /* called after the first Write */
+}
+func (l *lazyChannel) set(ch ssh.Channel, sent func()) bool {
+	l.mutex.Lock(); defer l.mutex.Unlock()
+	if l.closed { return false }
+	l.ch = ch
+	l.sent = sent
+	return true
+}
+func (l *lazyChannel) get() ssh.Channel {
+	l.mutex.Lock(); defer l.mutex.Unlock()
+	return l.ch
+}
+func (l *lazyChannel) Read(b []byte) (int,error) {
+	ch := l.get()
+	if ch==nil { return 0,io.ErrClosedPipe }
+	return ch.Read(b)
+}
+func (l *lazyChannel) Write(b []byte) (int,error) {
+	ch := l.get()
+	if ch==nil { return 0,io.ErrClosedPipe }
+	n,e := ch.Write(b)
+	l.mutex.Lock()
+	sent := l.sent
+	l.sent = nil
+	l.mutex.Unlock()
+	if sent!=nil { sent() }
+	return n,e
+}
+func (l *lazyChannel) CloseWrite() error {
+	ch := l.get()
+	if ch==nil { return io.ErrClosedPipe }
+	return ch.CloseWrite()
+}
+func (l *lazyChannel) Close() error {
+	l.mutex.Lock(); defer l.mutex.Unlock()
+	l.closed = true
+	if l.ch==nil { return nil }
+	return l.ch.Close()
+}
+
+/*
+Like the intermediate path of ch_anyproto1, but the channel to the next hop
+is opened only after the round is released, so its timing doesn't reveal
+which incoming channel it belongs to.
+*/
+func ap1_mix(s *Server, m *mixer, cl *Client, b []byte, nc ssh.NewChannel){
+	ch2,rq2,e := nc.Accept()
+	if e!=nil {
+		log.Println("nc.Accept",e)
+		return
+	}
+	go DevNullRequest(rq2)
+	
+	up := new(lazyChannel)
+	sent := func(){}
+	defer func(){ sent() }()
+	sc := *s.scrambler()
+	sc.Relay = s.relay()
+	sc.Hold = func() error {
+		sent = m.wait()
+		/*
+		The channel is accepted already, so a puzzle of the next hop can't be
+		passed back to the originator. The circuit fails, the originator
+		builds another one.
+		*/
+		ch,rq,e := cl.openTimeout(s.OpenTimeout,any_req1,b)
+		if e!=nil { return e }
+		go DevNullRequest(rq)
+		if !up.set(ch,sent) { ch.Close(); return io.ErrClosedPipe }
+		return nil
+	}
+	w := watch(s.HandshakeTimeout,up,ch2)
+	e = sc.Intermediate(ch2,up)
+	if !w.stop() && e==nil { e = E_HANDSHAKE_TIMEOUT }
+	
+	if e!=nil {
+		log.Println("scrambler.Intermediate",e)
+		up.Close()
+		ch2.Close()
+	}
+}
+
@@ -0,0 +1,127 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package sshproxy
+
+import "testing"
+import "time"
+
+/*
+Queues n waiters one after another. Each waiter reports its number, when it's
+its turn, and calls sent after hold.
+*/
+func queue(m *mixer, n int, hold time.Duration) chan int {
+	order := make(chan int,n)
+	for i := 0; i<n; i++ {
+		go func(i int){
+			sent := m.wait()
+			order <- i
+			time.Sleep(hold)
+			sent()
+			sent()
+		}(i)
+		for {
+			m.mutex.Lock()
+			l := len(m.waiting)
+			m.mutex.Unlock()
+			if l==i+1 || i+1==m.Batch { break }
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return order
+}
+
+func collect(t *testing.T, order chan int, n int, limit time.Duration) []int {
+	var r []int
+	deadline := time.After(limit)
+	for len(r)<n {
+		select {
+		case i := <-order: r = append(r,i)
+		case <-deadline: t.Fatal("released",len(r),"of",n); return r
+		}
+	}
+	return r
+}
+
+/* A full round is released at once, in shuffled order. */
+func TestMixShuffle(t *testing.T) {
+	const n = 5
+	shuffled := false
+	for round := 0; round<20 && !shuffled; round++ {
+		m := &mixer{Batch:n,Timeout:time.Second}
+		r := collect(t,queue(m,n,0),n,time.Second)
+		seen := make(map[int]bool)
+		for j,i := range r {
+			if seen[i] { t.Fatal("released twice",i) }
+			seen[i] = true
+			if i!=j { shuffled = true }
+		}
+	}
+	if !shuffled { t.Error("rounds are released in arrival order") }
+}
+
+/* An incomplete round is released after Timeout. */
+func TestMixTimeout(t *testing.T) {
+	m := &mixer{Batch:10,Timeout:30*time.Millisecond}
+	begin := time.Now()
+	collect(t,queue(m,3,0),3,time.Second)
+	if d := time.Since(begin); d<30*time.Millisecond { t.Error("released after",d) }
+	if m.timer!=nil || len(m.waiting)!=0 { t.Error("round not reset") }
+}
+
+/* The next waiter is released after its predecessor sent, or Timeout passed. */
+func TestMixSequential(t *testing.T) {
+	for _,c := range []struct{ hold, timeout, min, max time.Duration }{
+		{20*time.Millisecond,time.Second,40*time.Millisecond,time.Second},
+		{time.Second,20*time.Millisecond,40*time.Millisecond,500*time.Millisecond},
+	} {
+		m := &mixer{Batch:3,Timeout:c.timeout}
+		order := queue(m,3,c.hold)
+		begin := time.Now()
+		collect(t,order,3,2*time.Second)
+		/* The round is released, as soon as the last waiter is queued. */
+		if d := time.Since(begin); d<c.min-10*time.Millisecond || d>c.max { t.Error("hold",c.hold,"timeout",c.timeout,"took",d) }
+	}
+}
+
+func TestMixConfig(t *testing.T) {
+	for _,c := range []struct{
+		srv     *Server
+		batch   int
+		timeout time.Duration
+	}{
+		{&Server{},0,0},
+		{&Server{MixBatch:1},0,0},
+		{&Server{MixBatch:4},4,defaultMixTimeout},
+		{&Server{MixBatch:4,MixTimeout:time.Minute},4,time.Minute},
+		{&Server{MixBatch:8,MaxHandshakes:3},3,defaultMixTimeout},
+	} {
+		m := c.srv.mix()
+		if m==nil {
+			if c.batch!=0 { t.Error("no mixer for",c.batch) }
+			continue
+		}
+		if m.Batch!=c.batch || m.Timeout!=c.timeout { t.Error("mixer",m.Batch,m.Timeout,"want",c.batch,c.timeout) }
+	}
+}
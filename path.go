@@ -0,0 +1,150 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package sshproxy
+
+import "golang.org/x/crypto/ssh"
+import "errors"
+import "sync"
+import "net"
+
+/*
+Builds the cascade client-side over stock SSH servers: SSH to the first
+hop, open "direct-tcpip" to the next one, run a new SSH client over that
+channel, and so on. The last hop connects to the destination. The hops
+don't need to run sshproxy, but each of them learns its successor, and
+the last one the destination.
+
+The chain is built on the first Dial and reused, until it breaks.
+*/
+type Path struct{
+	Hops []*Client
+	
+	mutex  sync.Mutex
+	client *ssh.Client
+	conns  []ssh.Conn
+}
+
+var E_NO_HOPS = errors.New("Path without hops")
+var E_PATH_MODE = errors.New("Not available in path mode")
+
+func (p *Path) close(conns []ssh.Conn) {
+	for i := len(conns)-1; i>=0; i-- { conns[i].Close() }
+}
+
+func (p *Path) build() (*ssh.Client,[]ssh.Conn,error) {
+	var conns []ssh.Conn
+	var cl *ssh.Client
+	for _,h := range p.Hops {
+		var co net.Conn
+		var e error
+		if cl==nil {
+			co,e = net.Dial(h.Net,h.Addr)
+		} else {
+			co,e = cl.Dial("tcp",h.Addr)
+		}
+		if e!=nil { p.close(conns); return nil,nil,e }
+		st,snc,sr,e := ssh.NewClientConn(co,h.Addr,&h.Client)
+		if e!=nil { co.Close(); p.close(conns); return nil,nil,e }
+		conns = append(conns,st)
+		cl = ssh.NewClient(st,snc,sr)
+	}
+	return cl,conns,nil
+}
+
+/* Returns the client of the last hop. If fresh, the chain has been built right now. */
+func (p *Path) get() (cl *ssh.Client, fresh bool, e error) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	if p.client!=nil { return p.client,false,nil }
+	if len(p.Hops)==0 { return nil,false,E_NO_HOPS }
+	cl,conns,e := p.build()
+	if e!=nil { return nil,false,e }
+	p.client,p.conns = cl,conns
+	go func(){
+		/* If any hop goes away, the last one does too. */
+		cl.Wait()
+		p.reset(cl)
+	}()
+	return cl,true,nil
+}
+
+/* Drops the chain, if cl is still the current one. */
+func (p *Path) reset(cl *ssh.Client) {
+	p.mutex.Lock(); defer p.mutex.Unlock()
+	if p.client!=cl { return }
+	p.close(p.conns)
+	p.client,p.conns = nil,nil
+}
+
+/*
+Connects to addr through the path. The last hop resolves host names. If
+the chain is broken, it is rebuilt once.
+*/
+func (p *Path) Dial(netw, addr string) (net.Conn,error) {
+	for {
+		cl,fresh,e := p.get()
+		if e!=nil { return nil,e }
+		c,e := cl.Dial(netw,addr)
+		if e==nil { return c,nil }
+		if _,ok := e.(*ssh.OpenChannelError); ok || fresh { return nil,e }
+		p.reset(cl)
+	}
+}
+
+/*
+Asks the last hop to listen on addr (a "tcpip-forward" request). If the
+chain is broken, it is rebuilt once.
+*/
+func (p *Path) Listen(netw, addr string) (net.Listener,error) {
+	for {
+		cl,fresh,e := p.get()
+		if e!=nil { return nil,e }
+		l,e := cl.Listen(netw,addr)
+		if e==nil || fresh { return l,e }
+		p.reset(cl)
+	}
+}
+
+var pathMode struct{
+	sync.RWMutex
+	p *Path
+}
+
+/*
+Switches Dial, DialLevel, Listen and ListenLevel to path mode (see Path).
+A nil p switches back to the cascade of sshproxy nodes. Everything else,
+that needs a circuit, like Resolve, DialHidden or OpenCommand, fails with
+E_PATH_MODE. Pass host names to Dial instead of resolving them.
+*/
+func SetPath(p *Path) {
+	pathMode.Lock(); defer pathMode.Unlock()
+	pathMode.p = p
+}
+
+/* Returns the Path set with SetPath, or nil. */
+func path() *Path {
+	pathMode.RLock(); defer pathMode.RUnlock()
+	return pathMode.p
+}
@@ -29,23 +29,43 @@ import "math/rand"
 import "golang.org/x/crypto/ssh"
 import "net"
 import "io"
+import "strconv"
 import "sync"
 
+import "github.com/maxymania/sshproxy/scrambler"
+
 type Client struct{
 	Client ssh.ClientConfig
 	Net string
 	Addr string
+	
+	/* Handshake parameters for sessions started over this Client. If nil, Scrambler is used. */
+	Scrambler *scrambler.Config
+	
+	/* Maximum puzzle difficulty, this client is willing to solve. If zero, 24 is used. */
+	MaxPowBits int
+	
 	err error
 	conn ssh.Conn
-	nc <-chan ssh.NewChannel
-	reqs <-chan *ssh.Request
 	mutex sync.Mutex
 }
-func (c *Client) handler(){
-	go DevNullChannel(c.nc)
-	DevNullRequest(c.reqs)
-	c.conn.Close()
-	c.err = io.EOF
+func (c *Client) scrambler() *scrambler.Config {
+	if c.Scrambler==nil { return &Scrambler }
+	return c.Scrambler
+}
+func (c *Client) hostPort() (string,uint32) {
+	h,p,e := net.SplitHostPort(c.Addr)
+	if e!=nil { return c.Addr,0 }
+	n,_ := strconv.ParseUint(p,10,16)
+	return h,uint32(n)
+}
+/* Serves conn, until it is closed. If it is still the current one, the next open reconnects. */
+func (c *Client) handler(conn ssh.Conn, nc <-chan ssh.NewChannel, reqs <-chan *ssh.Request){
+	go DevNullChannel(nc)
+	DevNullRequest(reqs)
+	conn.Close()
+	c.mutex.Lock(); defer c.mutex.Unlock()
+	if c.conn==conn { c.err = io.EOF }
 }
 func (c *Client) getConn() (ssh.Conn,error){
 	c.mutex.Lock()
@@ -57,32 +77,109 @@ func (c *Client) getConn() (ssh.Conn,error){
 		if e!=nil { return nil,e }
 		c.err = nil
 		c.conn = st
-		c.nc = snc
-		c.reqs = sr
-		go c.handler()
+		go c.handler(st,snc,sr)
 		return st,nil
 	}
 	return c.conn,nil
 }
 func (c *Client) send(name string, wantReply bool, payload []byte) (bool, []byte, error) {
 	cc,e := c.getConn()
-	if e!=nil { c.err = e; return false,nil,e }
+	if e!=nil { return false,nil,e }
 	return cc.SendRequest(name,wantReply,payload)
 }
-func (c *Client) open(ct string, data []byte) (ch ssh.Channel, rq <-chan *ssh.Request, er error) {
+func (c *Client) maxPowBits() int {
+	if c.MaxPowBits==0 { return defaultMaxPowBits }
+	return c.MaxPowBits
+}
+/* Opens a channel. */
+func (c *Client) open(ct string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
 	cc,e := c.getConn()
-	if e!=nil { c.err = e; er=e; return }
+	if e!=nil { return nil,nil,e }
 	return cc.OpenChannel(ct,data)
 }
 
+/*
+Opens the first channel of a circuit, this node originates. If a relay on
+the way answers with a puzzle, it is solved and the solution is added to
+cr.Pow. Relays pass the puzzles of the next hop back, so the originator
+pays for the circuit.
+*/
+func (c *Client) openSolve(ct string, cr *anyprotocol1) (ch ssh.Channel, rq <-chan *ssh.Request, er error) {
+	for i := 0; ; i++ {
+		ch,rq,er = c.open(ct,cr.bytes())
+		p := challengeOf(er)
+		if p==nil || i>=powRetries || int(p.Bits)>c.maxPowBits() { return }
+		if len(cr.Pow)>=maxSolutions { cr.Pow = cr.Pow[1:] }
+		cr.Pow = append(cr.Pow,append(p.Nonce[:],p.Solve()...))
+	}
+}
+
+/*
+Closes the connection, if any, which ends the circuits through it. The next
+open reconnects.
+*/
+func (c *Client) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn!=nil { c.conn.Close() }
+	c.conn,c.err = nil,nil
+}
+
 var x []*Client = nil
+var xmutex sync.Mutex
 
 func Add(c *Client){
+	xmutex.Lock(); defer xmutex.Unlock()
 	x = append(x,c)
 }
 
+/* Removes c from the pool and closes its connection, which ends the circuits through it. */
+func Remove(c *Client){
+	xmutex.Lock(); defer xmutex.Unlock()
+	nx := make([]*Client,0,len(x))
+	for _,o := range x {
+		if o!=c { nx = append(nx,o) }
+	}
+	x = nx
+	c.close()
+}
+
+/*
+Replaces the pool with cs. Clients, that are not in cs anymore, are closed,
+which ends the circuits through them; Clients in both keep their connection
+and circuits.
+*/
+func Replace(cs []*Client){
+	keep := make(map[*Client]bool,len(cs))
+	for _,c := range cs { keep[c] = true }
+	xmutex.Lock()
+	old := x
+	x = append([]*Client(nil),cs...)
+	xmutex.Unlock()
+	for _,c := range old {
+		if !keep[c] { c.close() }
+	}
+}
+
+/* Returns the Client of the pool with the given address, or nil. */
+func findClient(addr string) *Client {
+	xmutex.Lock(); defer xmutex.Unlock()
+	for _,c := range x {
+		if c.Addr==addr { return c }
+	}
+	return nil
+}
+
+/* Returns a copy of the pool. */
+func Clients() []*Client {
+	xmutex.Lock(); defer xmutex.Unlock()
+	return append([]*Client(nil),x...)
+}
+
 func selClient() *Client {
+	xmutex.Lock()
 	xr := x
+	xmutex.Unlock()
 	xl := len(xr)
 	if xl==0 { return nil }
 	return xr[rand.Int31n(int32(xl))]
@@ -0,0 +1,241 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "github.com/maxymania/sshproxy"
+import "golang.org/x/net/dns/dnsmessage"
+import "encoding/binary"
+import "strings"
+import "errors"
+import "sync"
+import "time"
+import "net"
+import "log"
+import "io"
+
+/*
+The TTL of negative answers and of addresses, the exit doesn't know the TTL
+of (like from /etc/hosts). Otherwise, the TTL of the DNS answers at the exit
+is used, up to dnsMaxTTL. Lookups are cached for as long, as they are valid.
+*/
+const dnsTTL = 60
+const dnsMaxTTL = 86400
+
+/* The UDP payload size of ServeDNS for clients with EDNS0 (RFC 6891), at most. */
+const dnsMaxUDP = 4096
+
+/* The maximum number of cached lookups. */
+const dnsCacheSize = 4096
+
+/* How long ServeDNSTCP waits for the next query on a connection. */
+const dnsIdle = 10*time.Second
+
+/* A cached lookup: the addresses, or a negative answer (NXDOMAIN). */
+type dnsEntry struct{
+	ips     []net.IP
+	noname  bool
+	expires time.Time
+}
+
+var dnsCache = struct{
+	sync.Mutex
+	m map[string]*dnsEntry
+}{m:make(map[string]*dnsEntry)}
+
+/* Returns the cached lookup of name and its remaining TTL, or nil. */
+func dnsCached(name string) (*dnsEntry,uint32) {
+	dnsCache.Lock(); defer dnsCache.Unlock()
+	d := dnsCache.m[name]
+	if d==nil { return nil,0 }
+	ttl := time.Until(d.expires)
+	if ttl<time.Second {
+		delete(dnsCache.m,name)
+		return nil,0
+	}
+	return d,uint32(ttl/time.Second)
+}
+
+func dnsStore(name string, d *dnsEntry, ttl uint32) {
+	dnsCache.Lock(); defer dnsCache.Unlock()
+	if len(dnsCache.m)>=dnsCacheSize {
+		now := time.Now()
+		for k,o := range dnsCache.m {
+			if now.After(o.expires) { delete(dnsCache.m,k) }
+		}
+		if len(dnsCache.m)>=dnsCacheSize { dnsCache.m = make(map[string]*dnsEntry) }
+	}
+	d.expires = time.Now().Add(time.Duration(ttl)*time.Second)
+	dnsCache.m[name] = d
+}
+
+/* Resolves name through the cache. Server failures are not cached. */
+func dnsLookup(name string) (*dnsEntry,uint32,error) {
+	if d,ttl := dnsCached(name); d!=nil { return d,ttl,nil }
+	ips,d,e := sshproxy.LookupIPTTL(name)
+	var re *sshproxy.RemoteError
+	if errors.As(e,&re) && re.Code==sshproxy.EC_NONAME {
+		e = nil
+	}
+	if e!=nil { return nil,0,e }
+	ttl := uint32(d/time.Second)
+	switch {
+	case len(ips)==0 || ttl==0: ttl = dnsTTL
+	case ttl>dnsMaxTTL: ttl = dnsMaxTTL
+	}
+	r := &dnsEntry{ips:ips,noname:len(ips)==0}
+	dnsStore(name,r,ttl)
+	return r,ttl,nil
+}
+
+/*
+A DNS server (UDP), that resolves A and AAAA queries at the exit through
+sshproxy.LookupIPTTL. Other query types are answered with no records. Use it
+together with ServeTransparent, so neither names nor connections leave
+the host outside the cascade. Answers are up to 512 bytes, or the payload
+size the client advertises with EDNS0, up to dnsMaxUDP. Bigger answers are
+truncated, serve ServeDNSTCP on the same address for the clients to retry.
+*/
+func ServeDNS(pc net.PacketConn) error {
+	for {
+		b := make([]byte,dnsMaxUDP)
+		n,a,e := pc.ReadFrom(b)
+		if e!=nil { return e }
+		go func(){
+			r,e := dnsAnswer(b[:n],false)
+			if e!=nil { return }
+			pc.WriteTo(r,a)
+		}()
+	}
+}
+
+/* Like ServeDNS, but over TCP (RFC 7766). Answers are never truncated. */
+func ServeDNSTCP(l net.Listener) error {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return e }
+		go dnsConn(c)
+	}
+}
+
+/* Answers the queries of one TCP connection, in order. */
+func dnsConn(c net.Conn) {
+	defer c.Close()
+	var n [2]byte
+	for {
+		c.SetReadDeadline(time.Now().Add(dnsIdle))
+		_,e := io.ReadFull(c,n[:])
+		if e!=nil { return }
+		q := make([]byte,binary.BigEndian.Uint16(n[:]))
+		_,e = io.ReadFull(c,q)
+		if e!=nil { return }
+		r,e := dnsAnswer(q,true)
+		if e!=nil { return }
+		_,e = c.Write(append(binary.BigEndian.AppendUint16(nil,uint16(len(r))),r...))
+		if e!=nil { return }
+	}
+}
+
+/*
+Returns the OPT record of the query, that is left in p, or nil, if the
+client doesn't support EDNS0.
+*/
+func dnsOPT(p *dnsmessage.Parser) *dnsmessage.ResourceHeader {
+	if p.SkipAllAnswers()!=nil || p.SkipAllAuthorities()!=nil { return nil }
+	for {
+		h,e := p.AdditionalHeader()
+		if e!=nil { return nil }
+		if h.Type==dnsmessage.TypeOPT { return &h }
+		if p.SkipAdditional()!=nil { return nil }
+	}
+}
+
+/* Answers the query q. Over UDP, answers bigger than the client accepts are truncated. */
+func dnsAnswer(q []byte, tcp bool) ([]byte,error) {
+	var p dnsmessage.Parser
+	h,e := p.Start(q)
+	if e!=nil { return nil,e }
+	qs,e := p.AllQuestions()
+	if e!=nil { return nil,e }
+	
+	max := 0xffff
+	var extra []dnsmessage.Resource
+	opt := dnsOPT(&p)
+	if opt!=nil {
+		var rrh dnsmessage.ResourceHeader
+		rrh.SetEDNS0(dnsMaxUDP,0,false)
+		extra = append(extra,dnsmessage.Resource{Header:rrh,Body:&dnsmessage.OPTResource{}})
+	}
+	if !tcp {
+		max = 512
+		/* The class of an OPT record is the payload size of the client. */
+		if opt!=nil && int(opt.Class)>max { max = int(opt.Class) }
+		if max>dnsMaxUDP { max = dnsMaxUDP }
+	}
+	
+	rh := dnsmessage.Header{ID:h.ID,Response:true,OpCode:h.OpCode,RecursionDesired:h.RecursionDesired,RecursionAvailable:true}
+	var ans []dnsmessage.Resource
+	switch {
+	case h.OpCode!=0 || len(qs)!=1:
+		rh.RCode = dnsmessage.RCodeNotImplemented
+	case qs[0].Class!=dnsmessage.ClassINET || (qs[0].Type!=dnsmessage.TypeA && qs[0].Type!=dnsmessage.TypeAAAA):
+		/* No records. */
+	default:
+		name := strings.ToLower(strings.TrimSuffix(qs[0].Name.String(),"."))
+		d,ttl,e := dnsLookup(name)
+		if e!=nil {
+			log.Println("ServeDNS: LookupIP",name,e)
+			rh.RCode = dnsmessage.RCodeServerFailure
+			break
+		}
+		if d.noname {
+			rh.RCode = dnsmessage.RCodeNameError
+			break
+		}
+		rrh := dnsmessage.ResourceHeader{Name:qs[0].Name,Type:qs[0].Type,Class:dnsmessage.ClassINET,TTL:ttl}
+		for _,ip := range d.ips {
+			if ip4 := ip.To4(); ip4!=nil {
+				if qs[0].Type!=dnsmessage.TypeA { continue }
+				r := &dnsmessage.AResource{}
+				copy(r.A[:],ip4)
+				ans = append(ans,dnsmessage.Resource{Header:rrh,Body:r})
+			} else if qs[0].Type==dnsmessage.TypeAAAA {
+				r := &dnsmessage.AAAAResource{}
+				copy(r.AAAA[:],ip.To16())
+				ans = append(ans,dnsmessage.Resource{Header:rrh,Body:r})
+			}
+		}
+	}
+	m := dnsmessage.Message{Header:rh,Questions:qs,Answers:ans,Additionals:extra}
+	b,e := m.Pack()
+	if e!=nil { return nil,e }
+	if len(b)>max {
+		/* Too big, let the client retry over TCP. */
+		m.Answers = nil
+		m.Header.Truncated = true
+		return m.Pack()
+	}
+	return b,nil
+}
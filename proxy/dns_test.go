@@ -0,0 +1,104 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy
+
+import "golang.org/x/net/dns/dnsmessage"
+import "testing"
+import "net"
+
+/* A query of the given type, with an OPT record advertising edns bytes, if not zero. */
+func dnsQuery(t *testing.T, name string, qt dnsmessage.Type, edns int) []byte {
+	m := &dnsmessage.Message{
+		Header: dnsmessage.Header{ID:7,RecursionDesired:true},
+		Questions: []dnsmessage.Question{{Name:dnsmessage.MustNewName(name),Type:qt,Class:dnsmessage.ClassINET}},
+	}
+	if edns>0 {
+		var h dnsmessage.ResourceHeader
+		h.SetEDNS0(edns,0,false)
+		m.Additionals = append(m.Additionals,dnsmessage.Resource{Header:h,Body:&dnsmessage.OPTResource{}})
+	}
+	b,e := m.Pack()
+	if e!=nil { t.Fatal(e) }
+	return b
+}
+
+/* Stores n cached IPv6 addresses for name. */
+func dnsFill(name string, n int, ttl uint32) {
+	d := new(dnsEntry)
+	for i := 0; i<n; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14],ip[15] = byte(i>>8),byte(i)
+		d.ips = append(d.ips,ip)
+	}
+	dnsStore(name,d,ttl)
+}
+
+var answerCases = []struct{
+	name      string
+	n         int /* cached addresses */
+	edns      int
+	tcp       bool
+	truncated bool
+}{
+	{"small",3,0,false,false},
+	{"plain udp",60,0,false,true},
+	{"edns",60,4096,false,false},
+	{"edns small",60,512,false,true},
+	{"edns beyond max",200,65000,false,true},
+	{"tcp",200,0,true,false},
+	{"tcp edns",200,1232,true,false},
+}
+
+func TestDNSAnswer(t *testing.T) {
+	for _,c := range answerCases {
+		name := c.name+".example."
+		dnsFill(name[:len(name)-1],c.n,300)
+		b,e := dnsAnswer(dnsQuery(t,name,dnsmessage.TypeAAAA,c.edns),c.tcp)
+		if e!=nil { t.Fatal(c.name,e) }
+		var m dnsmessage.Message
+		if e := m.Unpack(b); e!=nil { t.Fatal(c.name,e) }
+		max := 512
+		if c.edns>max { max = c.edns }
+		if max>dnsMaxUDP { max = dnsMaxUDP }
+		if !c.tcp && len(b)>max { t.Errorf("%s: %d bytes",c.name,len(b)) }
+		if m.Header.Truncated!=c.truncated { t.Errorf("%s: truncated=%v",c.name,m.Header.Truncated) }
+		want := c.n
+		if c.truncated { want = 0 }
+		if len(m.Answers)!=want { t.Errorf("%s: %d answers",c.name,len(m.Answers)) }
+		for _,a := range m.Answers {
+			if a.Header.TTL>300 || a.Header.TTL<290 { t.Errorf("%s: TTL %d",c.name,a.Header.TTL) }
+		}
+		/* An EDNS0 query gets an OPT record back. */
+		opt := len(m.Additionals)==1 && m.Additionals[0].Header.Type==dnsmessage.TypeOPT
+		if opt!=(c.edns>0) { t.Errorf("%s: additionals %v",c.name,m.Additionals) }
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	dnsFill("expired.example",1,0)
+	if d,_ := dnsCached("expired.example"); d!=nil { t.Error("expired entry returned") }
+	dnsFill("valid.example",1,3600)
+	if d,ttl := dnsCached("valid.example"); d==nil || ttl>3600 || ttl<3590 { t.Error("valid entry",d,ttl) }
+}
@@ -0,0 +1,117 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "github.com/maxymania/sshproxy"
+import "encoding/binary"
+import "strconv"
+import "net"
+import "log"
+
+/* A static port forward through the cascade, like "ssh -L". */
+type Forward struct{
+	/* The destination, as host:port. */
+	Target string
+	
+	/* The level of the circuits. If zero, sshproxy.Dial is used. */
+	Level int
+	
+	/* If 1 or 2, a PROXY protocol header of that version is sent to Target. */
+	ProxyProtocol int
+}
+
+func (f *Forward) dial() (net.Conn,error) {
+	if f.Level>0 { return sshproxy.DialLevel(f.Level,"tcp",f.Target) }
+	return sshproxy.Dial("tcp",f.Target)
+}
+
+/* Forwards every connection accepted on l. */
+func (f *Forward) Serve(l net.Listener) error {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return e }
+		go f.forward(c)
+	}
+}
+
+func (f *Forward) forward(c net.Conn) {
+	rc,e := f.dial()
+	if e!=nil {
+		log.Println("forward: Dial",f.Target,e)
+		c.Close()
+		return
+	}
+	if f.ProxyProtocol!=0 {
+		_,e = rc.Write(proxyHeader(f.ProxyProtocol,c.RemoteAddr(),c.LocalAddr()))
+		if e!=nil {
+			log.Println("forward: PROXY header",f.Target,e)
+			c.Close()
+			rc.Close()
+			return
+		}
+	}
+	sshproxy.Relay.Relay(c,rc)
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/* Formats ip as IPv6 address. IPv4 addresses are mapped (::ffff:a.b.c.d). */
+func ip6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4!=nil { return "::ffff:"+ip4.String() }
+	return ip.String()
+}
+
+/* Builds a PROXY protocol header (version 1 or 2) for a connection from src to dst. */
+func proxyHeader(v int, src, dst net.Addr) []byte {
+	s,ok1 := src.(*net.TCPAddr)
+	d,ok2 := dst.(*net.TCPAddr)
+	four := ok1 && ok2 && s.IP.To4()!=nil && d.IP.To4()!=nil
+	if v==1 {
+		switch {
+		case !ok1 || !ok2: return []byte("PROXY UNKNOWN\r\n")
+		case four: return []byte("PROXY TCP4 "+s.IP.String()+" "+d.IP.String()+" "+strconv.Itoa(s.Port)+" "+strconv.Itoa(d.Port)+"\r\n")
+		}
+		return []byte("PROXY TCP6 "+ip6String(s.IP)+" "+ip6String(d.IP)+" "+strconv.Itoa(s.Port)+" "+strconv.Itoa(d.Port)+"\r\n")
+	}
+	
+	b := append([]byte(nil),proxyV2Sig...)
+	var a []byte
+	switch {
+	case !ok1 || !ok2:
+		/* LOCAL, AF_UNSPEC */
+		return append(b,0x20,0x00,0,0)
+	case four:
+		b = append(b,0x21,0x11) /* PROXY, TCP over IPv4 */
+		a = append(append(a,s.IP.To4()...),d.IP.To4()...)
+	default:
+		b = append(b,0x21,0x21) /* PROXY, TCP over IPv6 */
+		a = append(append(a,s.IP.To16()...),d.IP.To16()...)
+	}
+	a = binary.BigEndian.AppendUint16(a,uint16(s.Port))
+	a = binary.BigEndian.AppendUint16(a,uint16(d.Port))
+	b = binary.BigEndian.AppendUint16(b,uint16(len(a)))
+	return append(b,a...)
+}
@@ -0,0 +1,72 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy
+
+import "testing"
+import "bytes"
+import "net"
+
+func tcp(ip string, port int) net.Addr {
+	return &net.TCPAddr{IP:net.ParseIP(ip),Port:port}
+}
+
+var headerCases = []struct{
+	name     string
+	v        int
+	src,dst  net.Addr
+	want     []byte
+}{
+	{"v1 ipv4",1,tcp("1.2.3.4",5),tcp("10.0.0.1",443),
+		[]byte("PROXY TCP4 1.2.3.4 10.0.0.1 5 443\r\n")},
+	{"v1 ipv6",1,tcp("2001:db8::1",65535),tcp("::1",22),
+		[]byte("PROXY TCP6 2001:db8::1 ::1 65535 22\r\n")},
+	{"v1 mixed",1,tcp("1.2.3.4",5),tcp("::1",6),
+		[]byte("PROXY TCP6 ::ffff:1.2.3.4 ::1 5 6\r\n")},
+	{"v1 mixed reverse",1,tcp("::1",5),tcp("1.2.3.4",6),
+		[]byte("PROXY TCP6 ::1 ::ffff:1.2.3.4 5 6\r\n")},
+	{"v1 unknown",1,&net.UnixAddr{Name:"x",Net:"unix"},tcp("1.2.3.4",6),
+		[]byte("PROXY UNKNOWN\r\n")},
+	{"v2 ipv4",2,tcp("1.2.3.4",5),tcp("10.0.0.1",443),
+		append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+			1,2,3,4, 10,0,0,1, 0,5, 1,187)},
+	{"v2 ipv6",2,tcp("2001:db8::1",5),tcp("::1",6),
+		append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24"),
+			0x20,0x01,0x0d,0xb8,0,0,0,0,0,0,0,0,0,0,0,1,
+			0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,
+			0,5, 0,6)},
+	{"v2 mixed",2,tcp("1.2.3.4",5),tcp("::1",6),
+		append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24"),
+			0,0,0,0,0,0,0,0,0,0,0xff,0xff,1,2,3,4,
+			0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,
+			0,5, 0,6)},
+	{"v2 local",2,nil,tcp("1.2.3.4",6),
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")},
+}
+
+func TestProxyHeader(t *testing.T) {
+	for _,c := range headerCases {
+		if b := proxyHeader(c.v,c.src,c.dst); !bytes.Equal(b,c.want) { t.Errorf("%s: %q, want %q",c.name,b,c.want) }
+	}
+}
@@ -0,0 +1,155 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "github.com/maxymania/sshproxy"
+import "net/http"
+import "net/http/httputil"
+import "encoding/base64"
+import "strings"
+import "context"
+import "errors"
+import "net"
+import "io"
+
+/*
+HTTP proxy frontend: CONNECT tunnels and absolute-URI requests, both
+through sshproxy.Dial. Host names are resolved at the exit.
+*/
+type HTTP struct{
+	/* If set, clients must authenticate with Basic proxy auth. */
+	Auth func(user, pass string) bool
+	
+	rp *httputil.ReverseProxy
+}
+
+func HTTPHandler() *HTTP {
+	h := new(HTTP)
+	tr := &http.Transport{
+		Proxy: nil,
+		DialContext: dialContext,
+	}
+	h.rp = &httputil.ReverseProxy{
+		Director: func(r *http.Request){
+			/* Don't reveal the client. */
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: tr,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, e error){
+			http.Error(w,e.Error(),status(e))
+		},
+	}
+	return h
+}
+
+type dialResult struct{
+	c net.Conn
+	e error
+}
+
+/*
+Like sshproxy.Dial, but gives up, once ctx is done (the client went away or
+the Transport timed out). A late connection is closed.
+*/
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	res := make(chan dialResult,1)
+	go func(){
+		c,e := sshproxy.Dial(network,addr)
+		res <- dialResult{c,e}
+	}()
+	select {
+	case r := <-res: return r.c,r.e
+	case <-ctx.Done():
+	}
+	go func(){
+		if r := <-res; r.e==nil { r.c.Close() }
+	}()
+	return nil,ctx.Err()
+}
+
+/* 504 for timeouts, 502 otherwise. */
+func status(e error) int {
+	var ne net.Error
+	if errors.As(e,&ne) && ne.Timeout() { return http.StatusGatewayTimeout }
+	return http.StatusBadGateway
+}
+
+func (h *HTTP) authorized(r *http.Request) bool {
+	if h.Auth==nil { return true }
+	a := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(a,"Basic ") { return false }
+	b,e := base64.StdEncoding.DecodeString(a[6:])
+	if e!=nil { return false }
+	u,p,ok := strings.Cut(string(b),":")
+	return ok && h.Auth(u,p)
+}
+
+func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("Proxy-Authenticate",`Basic realm="sotp"`)
+		http.Error(w,"Proxy authentication required",http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method==http.MethodConnect {
+		h.connect(w,r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme!="http" {
+		http.Error(w,"Absolute http URI required",http.StatusBadRequest)
+		return
+	}
+	h.rp.ServeHTTP(w,r)
+}
+
+func (h *HTTP) connect(w http.ResponseWriter, r *http.Request) {
+	hj,ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w,"Hijacking not supported",http.StatusInternalServerError)
+		return
+	}
+	rc,e := sshproxy.Dial("tcp",r.Host)
+	if e!=nil {
+		http.Error(w,e.Error(),status(e))
+		return
+	}
+	c,brw,e := hj.Hijack()
+	if e!=nil {
+		rc.Close()
+		return
+	}
+	_,e = io.WriteString(c,"HTTP/1.1 200 Connection established\r\n\r\n")
+	if e==nil && brw.Reader.Buffered()>0 {
+		/* The client might have sent data right after the request. */
+		b,_ := brw.Reader.Peek(brw.Reader.Buffered())
+		_,e = rc.Write(b)
+	}
+	if e!=nil {
+		c.Close()
+		rc.Close()
+		return
+	}
+	sshproxy.Relay.Relay(c,rc)
+}
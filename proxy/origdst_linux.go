@@ -0,0 +1,79 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "encoding/binary"
+import "syscall"
+import "unsafe"
+import "net"
+
+const (
+	so_ORIGINAL_DST = 80 /* linux/netfilter_ipv4.h */
+	ip6t_SO_ORIGINAL_DST = 80 /* linux/netfilter_ipv6/ip6_tables.h */
+	ipv6_TRANSPARENT = 75
+)
+
+/* Returns the destination of a connection before REDIRECT or DNAT. */
+func OriginalDst(c net.Conn) (*net.TCPAddr,error) {
+	tc,ok := c.(*net.TCPConn)
+	if !ok { return nil,E_NOT_SUPPORTED }
+	rc,e := tc.SyscallConn()
+	if e!=nil { return nil,e }
+	var dst *net.TCPAddr
+	var e2 error
+	e = rc.Control(func(fd uintptr){
+		if la,ok := tc.LocalAddr().(*net.TCPAddr); ok && la.IP.To4()==nil {
+			/* struct sockaddr_in6, read as the head of struct ip6_mtuinfo */
+			var mi *syscall.IPv6MTUInfo
+			mi,e2 = syscall.GetsockoptIPv6MTUInfo(int(fd),syscall.IPPROTO_IPV6,ip6t_SO_ORIGINAL_DST)
+			if e2!=nil { return }
+			p := (*[2]byte)(unsafe.Pointer(&mi.Addr.Port))
+			dst = &net.TCPAddr{IP:net.IP(append([]byte(nil),mi.Addr.Addr[:]...)),Port:int(binary.BigEndian.Uint16(p[:]))}
+			return
+		}
+		/* struct sockaddr_in, read as the head of struct ipv6_mreq */
+		var mr *syscall.IPv6Mreq
+		mr,e2 = syscall.GetsockoptIPv6Mreq(int(fd),syscall.IPPROTO_IP,so_ORIGINAL_DST)
+		if e2!=nil { return }
+		dst = &net.TCPAddr{IP:net.IPv4(mr.Multiaddr[4],mr.Multiaddr[5],mr.Multiaddr[6],mr.Multiaddr[7]),Port:int(binary.BigEndian.Uint16(mr.Multiaddr[2:4]))}
+	})
+	if e!=nil { return nil,e }
+	return dst,e2
+}
+
+func tproxyControl(network, address string, c syscall.RawConn) error {
+	var e2 error
+	e := c.Control(func(fd uintptr){
+		e2 = syscall.SetsockoptInt(int(fd),syscall.IPPROTO_IP,syscall.IP_TRANSPARENT,1)
+		if e2!=nil { return }
+		if network=="tcp6" || network=="tcp" {
+			/* Fails on IPv4 only sockets, that's fine. */
+			syscall.SetsockoptInt(int(fd),syscall.IPPROTO_IPV6,ipv6_TRANSPARENT,1)
+		}
+	})
+	if e!=nil { return e }
+	return e2
+}
@@ -37,6 +37,8 @@ func mydialer(ctx context.Context, network, addr string) (net.Conn, error) {
 type resolver struct{}
 func (r resolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
 	i,e := sshproxy.Resolve(name)
+	/* In path mode, the name is passed on to mydialer and the last hop resolves it. */
+	if e==sshproxy.E_PATH_MODE { return ctx,nil,nil }
 	return ctx,i,e
 }
 func Config() *socks5.Config{
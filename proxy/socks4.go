@@ -0,0 +1,155 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "github.com/armon/go-socks5"
+import "github.com/maxymania/sshproxy"
+import "encoding/binary"
+import "strconv"
+import "errors"
+import "bufio"
+import "net"
+import "io"
+
+/* SOCKS4 reply codes. */
+const (
+	s4_granted  = 90
+	s4_rejected = 91
+)
+
+var E_SOCKS_VERSION = errors.New("Unsupported SOCKS version")
+var E_SOCKS_FORMAT = errors.New("Malformed SOCKS request")
+
+/* A connection, whose first bytes have been read into r already. */
+type peekedConn struct{
+	net.Conn
+	r *bufio.Reader
+}
+func (p *peekedConn) Read(b []byte) (int,error) { return p.r.Read(b) }
+func (p *peekedConn) CloseWrite() error {
+	if cw,ok := p.Conn.(interface{ CloseWrite() error }); ok { return cw.CloseWrite() }
+	return p.Conn.Close()
+}
+
+/* Reads a null terminated string of at most 255 bytes. */
+func readString(r *bufio.Reader) (string,error) {
+	var b []byte
+	for len(b)<256 {
+		c,e := r.ReadByte()
+		if e!=nil { return "",e }
+		if c==0 { return string(b),nil }
+		b = append(b,c)
+	}
+	return "",E_SOCKS_FORMAT
+}
+
+func socks4reply(c net.Conn, code byte, a net.Addr) error {
+	var b [8]byte
+	b[1] = code
+	if ta,ok := a.(*net.TCPAddr); ok {
+		if ip4 := ta.IP.To4(); ip4!=nil {
+			binary.BigEndian.PutUint16(b[2:],uint16(ta.Port))
+			copy(b[4:],ip4)
+		}
+	}
+	_,e := c.Write(b[:])
+	return e
+}
+
+/* Serves one SOCKS4 or SOCKS4a (CONNECT only) request. The version byte has not been read yet. */
+func socks4(c net.Conn, r *bufio.Reader) error {
+	defer c.Close()
+	var h [8]byte
+	_,e := io.ReadFull(r,h[:])
+	if e!=nil { return e }
+	if h[0]!=4 { return E_SOCKS_VERSION }
+	_,e = readString(r) /* USERID, ignored */
+	if e!=nil { return e }
+	port := binary.BigEndian.Uint16(h[2:])
+	host := net.IP(h[4:8]).String()
+	if h[4]==0 && h[5]==0 && h[6]==0 && h[7]!=0 {
+		/* SOCKS4a: the host name follows, it is resolved at the exit. */
+		host,e = readString(r)
+		if e!=nil { return e }
+	}
+	if h[1]!=1 {
+		return socks4reply(c,s4_rejected,nil)
+	}
+	rc,e := sshproxy.Dial("tcp",net.JoinHostPort(host,strconv.Itoa(int(port))))
+	if e!=nil {
+		socks4reply(c,s4_rejected,nil)
+		return e
+	}
+	e = socks4reply(c,s4_granted,rc.RemoteAddr())
+	if e!=nil {
+		rc.Close()
+		return e
+	}
+	sshproxy.Relay.Relay(&peekedConn{c,r},rc)
+	return nil
+}
+
+/* Serves a SOCKS4 or SOCKS4a connection. */
+func ServeSOCKS4Conn(c net.Conn) error {
+	return socks4(c,bufio.NewReader(c))
+}
+
+/*
+Serves a SOCKS4, SOCKS4a or SOCKS5 connection, told apart by the version
+byte. SOCKS5 is served by s5.
+*/
+func ServeMixedConn(c net.Conn, s5 *socks5.Server) error {
+	r := bufio.NewReader(c)
+	v,e := r.Peek(1)
+	if e!=nil {
+		c.Close()
+		return e
+	}
+	switch v[0] {
+	case 4: return socks4(c,r)
+	case 5: return s5.ServeConn(&peekedConn{c,r})
+	}
+	c.Close()
+	return E_SOCKS_VERSION
+}
+
+/* Serves SOCKS4 and SOCKS4a on l. */
+func ServeSOCKS4(l net.Listener) error {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return e }
+		go ServeSOCKS4Conn(c)
+	}
+}
+
+/* Serves SOCKS4, SOCKS4a and SOCKS5 on l. */
+func ServeMixed(l net.Listener, s5 *socks5.Server) error {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return e }
+		go ServeMixedConn(c,s5)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package proxy
+
+import "github.com/maxymania/sshproxy"
+import "github.com/armon/go-socks5"
+import "golang.org/x/crypto/ssh"
+import "crypto/ed25519"
+import "crypto/rand"
+import "testing"
+import "bytes"
+import "sync"
+import "time"
+import "net"
+import "io"
+
+var exitOnce sync.Once
+
+/* Adds a local one hop cascade to the pool, the exit connects anywhere. */
+func exit(t *testing.T) {
+	exitOnce.Do(func(){
+		_,pk,_ := ed25519.GenerateKey(rand.Reader)
+		sg,e := ssh.NewSignerFromKey(pk)
+		if e!=nil { t.Fatal(e) }
+		cfg := &ssh.ServerConfig{NoClientAuth:true}
+		cfg.AddHostKey(sg)
+		l,e := net.Listen("tcp","127.0.0.1:0")
+		if e!=nil { t.Fatal(e) }
+		go func(){
+			for {
+				c,e := l.Accept()
+				if e!=nil { return }
+				go func(){
+					a,b,r,e := ssh.NewServerConn(c,cfg)
+					if e!=nil { return }
+					sshproxy.Handle(a,b,r)
+				}()
+			}
+		}()
+		sshproxy.Add(&sshproxy.Client{Net:"tcp",Addr:l.Addr().String(),Client:ssh.ClientConfig{User:"test",HostKeyCallback:ssh.InsecureIgnoreHostKey()}})
+		sshproxy.Level = 1
+	})
+}
+
+/* Listens on localhost and echoes. Returns the port. */
+func echo(t *testing.T) int {
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	go func(){
+		for {
+			c,e := l.Accept()
+			if e!=nil { return }
+			go func(){ io.Copy(c,c); c.Close() }()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+/* Returns both ends of a loopback TCP connection. */
+func pair(t *testing.T) (net.Conn,net.Conn) {
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	defer l.Close()
+	c,e := net.Dial("tcp",l.Addr().String())
+	if e!=nil { t.Fatal(e) }
+	s,e := l.Accept()
+	if e!=nil { t.Fatal(e) }
+	return c,s
+}
+
+/* A SOCKS4 request to the given port, the host of SOCKS4a is appended, if set. */
+func s4req(cmd byte, port int, ip []byte, host string) []byte {
+	b := []byte{4,cmd,byte(port>>8),byte(port)}
+	b = append(append(b,ip...),"user\x00"...)
+	if host!="" { b = append(append(b,host...),0) }
+	return b
+}
+
+var socks4Cases = []struct{
+	name  string
+	req   func(port int) []byte
+	code  byte /* zero, if no reply is expected */
+	err   error
+}{
+	{"socks4",func(p int) []byte { return s4req(1,p,[]byte{127,0,0,1},"") },s4_granted,nil},
+	{"socks4a",func(p int) []byte { return s4req(1,p,[]byte{0,0,0,1},"localhost") },s4_granted,nil},
+	{"bind",func(p int) []byte { return s4req(2,p,[]byte{127,0,0,1},"") },s4_rejected,nil},
+	{"refused",func(p int) []byte { return s4req(1,1,[]byte{127,0,0,1},"") },s4_rejected,nil},
+	{"version",func(p int) []byte { return []byte{6,1,0,80,127,0,0,1,0} },0,E_SOCKS_VERSION},
+	{"long user",func(p int) []byte { return append(s4req(1,p,[]byte{127,0,0,1},"")[:8],bytes.Repeat([]byte("u"),300)...) },0,E_SOCKS_FORMAT},
+	{"long host",func(p int) []byte { return append(s4req(1,p,[]byte{0,0,0,1},"")[:13],bytes.Repeat([]byte("h"),300)...) },0,E_SOCKS_FORMAT},
+	{"truncated",func(p int) []byte { return []byte{4,1,0} },0,io.ErrUnexpectedEOF},
+}
+
+func TestSOCKS4(t *testing.T) {
+	exit(t)
+	port := echo(t)
+	s5,_ := socks5.New(Config())
+	for _,c := range socks4Cases {
+		for _,mixed := range []bool{false,true} {
+			clt,srv := pair(t)
+			res := make(chan error,1)
+			go func(){
+				if mixed {
+					res <- ServeMixedConn(srv,s5)
+				} else {
+					res <- ServeSOCKS4Conn(srv)
+				}
+			}()
+			clt.Write(c.req(port))
+			if c.err==io.ErrUnexpectedEOF { clt.(*net.TCPConn).CloseWrite() }
+			clt.SetDeadline(time.Now().Add(5*time.Second))
+			rep := make([]byte,8)
+			_,e := io.ReadFull(clt,rep)
+			switch {
+			case c.code==0:
+				if e==nil { t.Errorf("%s: reply %v",c.name,rep) }
+			case e!=nil: t.Errorf("%s: %v",c.name,e)
+			case rep[0]!=0 || rep[1]!=c.code: t.Errorf("%s: reply %v",c.name,rep)
+			case c.code==s4_granted:
+				clt.Write([]byte("ping"))
+				io.ReadFull(clt,rep[:4])
+				if string(rep[:4])!="ping" { t.Errorf("%s: echo %q",c.name,rep[:4]) }
+			}
+			clt.Close()
+			if e := <-res; e!=c.err && !(c.err==nil && c.code==s4_rejected) { t.Errorf("%s: mixed=%v: %v",c.name,mixed,e) }
+		}
+	}
+}
+
+/* ServeMixedConn hands SOCKS5 to s5. */
+func TestSniffSOCKS5(t *testing.T) {
+	exit(t)
+	port := echo(t)
+	s5,_ := socks5.New(Config())
+	clt,srv := pair(t)
+	defer clt.Close()
+	go ServeMixedConn(srv,s5)
+	clt.SetDeadline(time.Now().Add(5*time.Second))
+	clt.Write([]byte{5,1,0})
+	rep := make([]byte,10)
+	if _,e := io.ReadFull(clt,rep[:2]); e!=nil || rep[0]!=5 || rep[1]!=0 { t.Fatal("method",rep[:2],e) }
+	clt.Write([]byte{5,1,0,1,127,0,0,1,byte(port>>8),byte(port)})
+	if _,e := io.ReadFull(clt,rep); e!=nil || rep[1]!=0 { t.Fatal("connect",rep,e) }
+	clt.Write([]byte("ping"))
+	io.ReadFull(clt,rep[:4])
+	if string(rep[:4])!="ping" { t.Errorf("echo %q",rep[:4]) }
+}
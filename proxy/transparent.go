@@ -0,0 +1,80 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package proxy
+
+import "github.com/maxymania/sshproxy"
+import "context"
+import "errors"
+import "net"
+import "log"
+
+var E_NOT_SUPPORTED = errors.New("Transparent proxying is not supported on this platform")
+
+/*
+Accepts connections, that have been redirected to l by the packet filter,
+and connects them to their original destination through sshproxy.Dial.
+
+Without TProxy, the connections have been redirected with REDIRECT (or
+DNAT) and the destination is recovered with SO_ORIGINAL_DST. With TProxy,
+l must have been created by ListenTProxy and the destination is the local
+address of the connection.
+*/
+func ServeTransparent(l net.Listener, tproxy bool) error {
+	for {
+		c,e := l.Accept()
+		if e!=nil { return e }
+		go transparent(c,tproxy)
+	}
+}
+
+func transparent(c net.Conn, tproxy bool) {
+	var dst *net.TCPAddr
+	var e error
+	if tproxy {
+		dst,_ = c.LocalAddr().(*net.TCPAddr)
+		if dst==nil { e = E_NOT_SUPPORTED }
+	} else {
+		dst,e = OriginalDst(c)
+	}
+	if e!=nil {
+		log.Println("transparent:",e)
+		c.Close()
+		return
+	}
+	rc,e := sshproxy.Dial("tcp",dst.String())
+	if e!=nil {
+		log.Println("transparent: Dial",dst,e)
+		c.Close()
+		return
+	}
+	sshproxy.Relay.Relay(c,rc)
+}
+
+/* Creates a listener for TPROXY rules (IP_TRANSPARENT). This needs CAP_NET_ADMIN. */
+func ListenTProxy(network, addr string) (net.Listener,error) {
+	lc := net.ListenConfig{Control:tproxyControl}
+	return lc.Listen(context.Background(),network,addr)
+}
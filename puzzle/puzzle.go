@@ -0,0 +1,126 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Hashcash-style client puzzles.
+
+A relay under load hands out a Challenge instead of doing the expensive
+key exchange. The client has to find a Solution, so that
+SHA-256(Nonce || Solution) starts with at least Bits zero bits.
+Solving costs about 2^Bits hash operations, verifying costs one.
+*/
+package puzzle
+
+import "crypto/sha256"
+import "encoding/binary"
+import "encoding/hex"
+import "errors"
+import "io"
+import "math/bits"
+import "strconv"
+import "strings"
+
+const NonceSize = 16
+const SolutionSize = 8
+
+/* The maximum difficulty. Solve searches 2^64 solutions at most. */
+const MaxBits = 64
+
+/* The prefix of a challenge, when it is sent as text. */
+const Prefix = "pow "
+
+var E_FORMAT = errors.New("puzzle: malformed challenge")
+
+type Challenge struct{
+	Bits  uint8
+	Nonce [NonceSize]byte
+}
+
+/* Creates a new Challenge with the given difficulty. The nonce is read from rnd. */
+func New(b uint8, rnd io.Reader) (*Challenge,error) {
+	if b>MaxBits { return nil,E_FORMAT }
+	c := &Challenge{Bits:b}
+	_,e := io.ReadFull(rnd,c.Nonce[:])
+	if e!=nil { return nil,e }
+	return c,nil
+}
+
+/* Encodes the challenge as "pow <bits> <hex nonce>". */
+func (c *Challenge) String() string {
+	return Prefix+strconv.Itoa(int(c.Bits))+" "+hex.EncodeToString(c.Nonce[:])
+}
+
+/* Returns true, if s looks like an encoded challenge. */
+func Is(s string) bool {
+	return strings.HasPrefix(s,Prefix)
+}
+
+/* Parses the output of String. */
+func Parse(s string) (*Challenge,error) {
+	if !Is(s) { return nil,E_FORMAT }
+	f := strings.Fields(s[len(Prefix):])
+	if len(f)!=2 { return nil,E_FORMAT }
+	b,e := strconv.ParseUint(f[0],10,8)
+	if e!=nil || b>MaxBits { return nil,E_FORMAT }
+	c := &Challenge{Bits:uint8(b)}
+	n,e := hex.DecodeString(f[1])
+	if e!=nil || len(n)!=NonceSize { return nil,E_FORMAT }
+	copy(c.Nonce[:],n)
+	return c,nil
+}
+
+func zeros(h *[sha256.Size]byte) int {
+	n := 0
+	for _,b := range h {
+		if b!=0 { return n+bits.LeadingZeros8(b) }
+		n += 8
+	}
+	return n
+}
+
+func (c *Challenge) hash(sol []byte) [sha256.Size]byte {
+	var buf [NonceSize+SolutionSize]byte
+	copy(buf[:],c.Nonce[:])
+	copy(buf[NonceSize:],sol)
+	return sha256.Sum256(buf[:])
+}
+
+/* Searches a solution. This takes about 2^Bits hash operations. */
+func (c *Challenge) Solve() []byte {
+	sol := make([]byte,SolutionSize)
+	for i := uint64(0);; i++ {
+		binary.BigEndian.PutUint64(sol,i)
+		h := c.hash(sol)
+		if zeros(&h)>=int(c.Bits) { return sol }
+	}
+}
+
+/* Checks a solution. */
+func (c *Challenge) Verify(sol []byte) bool {
+	if len(sol)!=SolutionSize { return false }
+	h := c.hash(sol)
+	return zeros(&h)>=int(c.Bits)
+}
+
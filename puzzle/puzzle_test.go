@@ -0,0 +1,106 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package puzzle
+
+import "testing"
+import "crypto/sha256"
+import "crypto/rand"
+import "bytes"
+
+/* Bit boundaries of the leading zero count. */
+var zeroCases = []struct{
+	head []byte
+	n    int
+}{
+	{[]byte{0x80},0},
+	{[]byte{0x40},1},
+	{[]byte{0x01},7},
+	{[]byte{0x00,0x80},8},
+	{[]byte{0x00,0x01},15},
+	{[]byte{0x00,0x00,0x00,0x00,0x00,0x00,0x00,0x00,0x10},67},
+	{nil,256},
+}
+
+func TestZeros(t *testing.T) {
+	for _,c := range zeroCases {
+		var h [sha256.Size]byte
+		copy(h[:],c.head)
+		if n := zeros(&h); n!=c.n { t.Errorf("%x: %d zeros, want %d",c.head,n,c.n) }
+	}
+}
+
+func TestSolve(t *testing.T) {
+	for _,b := range []uint8{0,1,7,8,9,16} {
+		p,e := New(b,rand.Reader)
+		if e!=nil { t.Fatal(e) }
+		sol := p.Solve()
+		if !p.Verify(sol) { t.Errorf("bits=%d: solution rejected",b) }
+		if p.Verify(sol[1:]) { t.Errorf("bits=%d: short solution accepted",b) }
+		h := p.hash(sol)
+		if zeros(&h)<int(b) { t.Errorf("bits=%d: too few zeros",b) }
+	}
+}
+
+/* A solution is bound to its nonce. */
+func TestVerifyNonce(t *testing.T) {
+	p,_ := New(16,rand.Reader)
+	q := *p
+	q.Nonce[0] ^= 1
+	if q.Verify(p.Solve()) { t.Error("solution of another nonce accepted") }
+}
+
+func TestMaxBits(t *testing.T) {
+	if _,e := New(MaxBits,rand.Reader); e!=nil { t.Error(e) }
+	if _,e := New(MaxBits+1,rand.Reader); e!=E_FORMAT { t.Error("New accepted",MaxBits+1,"bits") }
+}
+
+var parseCases = []struct{
+	s  string
+	ok bool
+}{
+	{"pow 16 000102030405060708090a0b0c0d0e0f",true},
+	{"pow 0 000102030405060708090a0b0c0d0e0f",true},
+	{"pow 64 000102030405060708090a0b0c0d0e0f",true},
+	{"pow 65 000102030405060708090a0b0c0d0e0f",false},
+	{"pow 256 000102030405060708090a0b0c0d0e0f",false},
+	{"pow -1 000102030405060708090a0b0c0d0e0f",false},
+	{"pow 16 000102030405060708090a0b0c0d0e",false},
+	{"pow 16 000102030405060708090a0b0c0d0e0f00",false},
+	{"pow 16 zz0102030405060708090a0b0c0d0e0f",false},
+	{"pow 16",false},
+	{"pow 16 000102030405060708090a0b0c0d0e0f x",false},
+	{"Busy!",false},
+}
+
+func TestParse(t *testing.T) {
+	for _,c := range parseCases {
+		p,e := Parse(c.s)
+		if (e==nil)!=c.ok { t.Errorf("%q: %v",c.s,e); continue }
+		if e==nil && p.String()!=c.s { t.Errorf("%q: round trip gave %q",c.s,p.String()) }
+	}
+	p,_ := New(12,rand.Reader)
+	q,e := Parse(p.String())
+	if e!=nil || q.Bits!=p.Bits || !bytes.Equal(q.Nonce[:],p.Nonce[:]) { t.Error("round trip",e) }
+}
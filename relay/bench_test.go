@@ -0,0 +1,90 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package relay
+
+import "testing"
+import "math/rand"
+import "bytes"
+import "net"
+import "io"
+
+const benchSize = 1<<20
+
+/*
+Relays between two pipes. Returns the far ends and a channel, that
+delivers the Stats, once the relay is done.
+*/
+func piped(c *Config) (a, b net.Conn, res chan *Stats) {
+	a,x := net.Pipe()
+	y,b := net.Pipe()
+	res = make(chan *Stats,1)
+	go func(){ res <- c.Relay(x,y) }()
+	return
+}
+
+/* Sends data from w to r, returns, what arrived. */
+func transfer(w io.Writer, r io.Reader, data []byte) []byte {
+	go w.Write(data)
+	got := make([]byte,len(data))
+	io.ReadFull(r,got)
+	return got
+}
+
+/* Bulk data in both directions at once arrives unchanged and is counted. */
+func TestBulk(t *testing.T) {
+	for _,c := range []Config{ {},{MaxDelay:1000} } {
+		a,b,res := piped(&c)
+		atob := make([]byte,benchSize)
+		btoa := make([]byte,benchSize/2+1)
+		rand.Read(atob)
+		rand.Read(btoa)
+		done := make(chan []byte)
+		go func(){ done <- transfer(b,a,btoa) }()
+		if got := transfer(a,b,atob); !bytes.Equal(got,atob) { t.Error("A to B corrupted",c) }
+		if got := <-done; !bytes.Equal(got,btoa) { t.Error("B to A corrupted",c) }
+		a.Close()
+		s := <-res
+		b.Close()
+		if s.AtoB!=int64(len(atob)) || s.BtoA!=int64(len(btoa)) { t.Error("stats",s.AtoB,s.BtoA,c) }
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	x,y,_ := piped(new(Config))
+	defer x.Close()
+	defer y.Close()
+	data := make([]byte,benchSize)
+	buf := make([]byte,bufSize)
+	b.SetBytes(benchSize)
+	b.ResetTimer()
+	for i := 0; i<b.N; i++ {
+		go x.Write(data)
+		for todo := benchSize; todo>0; {
+			n,e := y.Read(buf)
+			if e!=nil { b.Fatal(e) }
+			todo -= n
+		}
+	}
+}
@@ -0,0 +1,294 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+The copy engine, that relays a connection between two streams. It is used by
+all stations of the cascade, in order to stop both directions on any error,
+to close both sides exactly once and to enforce timeouts.
+*/
+package relay
+
+import "io"
+import "net"
+import "sync"
+import "sync/atomic"
+import "syscall"
+import "errors"
+import "time"
+import "math/rand"
+
+var E_RESET = errors.New("Connection reset by peer")
+var E_IDLE = errors.New("Connection idle for too long")
+var E_LIFETIME = errors.New("Connection lifetime exceeded")
+
+type cs_1 interface{
+	CloseWrite() error
+}
+type rs_1 interface{
+	Reset() error
+}
+
+/* The result of a relayed connection. */
+type Stats struct{
+	/* Bytes copied from A to B and from B to A. */
+	AtoB, BtoA int64
+	
+	/* Why the connection was torn down. nil means, both sides sent EOF. */
+	Reason error
+}
+
+/* Relay parameters. The zero value is ready to use and has no timeouts. */
+type Config struct{
+	/* Tear down the connection, if no data was copied for that long. */
+	Idle time.Duration
+	
+	/* Tear down the connection after that time. */
+	Lifetime time.Duration
+	
+	/* Called once both directions are done. */
+	OnClose func(s *Stats)
+	
+	/*
+	If set, every chunk is held back for a random time up to MaxDelay, in
+	order to blur the timing between input and output. The order of the
+	data is preserved.
+	*/
+	MaxDelay time.Duration
+	
+	/*
+	The total delay each direction may add over the connection's lifetime.
+	Once spent, data flows without delay. Zero means unlimited.
+	*/
+	Budget time.Duration
+}
+
+/* Returns true, if e indicates an abortive close. */
+func IsReset(e error) bool {
+	return errors.Is(e,E_RESET) || errors.Is(e,syscall.ECONNRESET)
+}
+
+/* Aborts c: RST for TCP, Reset() if available, Close() otherwise. */
+func Reset(c io.Closer) error {
+	switch v := c.(type) {
+	case *net.TCPConn:
+		v.SetLinger(0)
+		return v.Close()
+	case rs_1:
+		return v.Reset()
+	}
+	return c.Close()
+}
+
+const bufSize = 1<<15
+
+var bufPool = sync.Pool{New: func() interface{} { return new([bufSize]byte) }}
+
+/* Counts the bytes passing through and records the activity. Use either Read or Write. */
+type meter struct{
+	s *session
+	n *int64
+	r io.Reader
+	w io.Writer
+}
+func (m *meter) Read(b []byte) (int,error) {
+	n,e := m.r.Read(b)
+	if n>0 {
+		atomic.StoreInt64(&m.s.last,time.Now().UnixNano())
+		atomic.AddInt64(m.n,int64(n))
+	}
+	return n,e
+}
+func (m *meter) Write(b []byte) (int,error) {
+	atomic.StoreInt64(&m.s.last,time.Now().UnixNano())
+	n,e := m.w.Write(b)
+	atomic.AddInt64(m.n,int64(n))
+	return n,e
+}
+
+/*
+The fast paths of a *net.TCPConn only pay off between sockets, we never relay
+between two of them, so we rather use our own fast paths or the pooled buffer.
+*/
+func fast(x interface{}) bool {
+	_,ok := x.(*net.TCPConn)
+	return !ok
+}
+
+type session struct{
+	a,b io.ReadWriteCloser
+	c   *Config
+	
+	once   sync.Once
+	reason error
+	last   int64 /* unix nanos of the last activity */
+	
+	stats Stats
+}
+
+/* Closes both sides (exactly once). A reset is propagated as a reset. */
+func (s *session) teardown(reason error) {
+	s.once.Do(func(){
+		s.reason = reason
+		if IsReset(reason) {
+			Reset(s.a)
+			Reset(s.b)
+		} else {
+			s.a.Close()
+			s.b.Close()
+		}
+	})
+}
+
+func (s *session) copy(src io.Reader, dst io.Writer, n *int64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var e error
+	m := &meter{s:s,n:n,r:src,w:dst}
+	if s.c.MaxDelay>0 {
+		e = s.delayed(m,dst)
+	} else if wt,ok := src.(io.WriterTo); ok && fast(src) {
+		_,e = wt.WriteTo(m)
+	} else if rf,ok := dst.(io.ReaderFrom); ok && fast(dst) {
+		_,e = rf.ReadFrom(m)
+	} else {
+		b := bufPool.Get().(*[bufSize]byte)
+		_,e = io.CopyBuffer(struct{ io.Writer }{m},struct{ io.Reader }{src},b[:])
+		bufPool.Put(b)
+	}
+	if e==nil {
+		/* EOF */
+		if cw,ok := dst.(cs_1); ok {
+			if cw.CloseWrite()==nil { return }
+		}
+		/* dst can't be half-closed, so tear everything down. */
+		s.teardown(nil)
+		return
+	}
+	s.teardown(e)
+}
+
+type chunk struct{
+	b  *[bufSize]byte
+	n  int
+	at time.Time
+}
+
+/*
+Copies from m.r to dst, holding each chunk back for a random time (see
+Config.MaxDelay). A chunk is never released before its predecessor.
+*/
+func (s *session) delayed(m *meter, dst io.Writer) error {
+	q := make(chan chunk,16)
+	done := make(chan error,1)
+	go func(){
+		var e error
+		for ch := range q {
+			if e==nil {
+				time.Sleep(time.Until(ch.at))
+				_,e = dst.Write(ch.b[:ch.n])
+				if e!=nil { s.teardown(e) }
+			}
+			bufPool.Put(ch.b)
+		}
+		done <- e
+	}()
+	
+	var prev time.Time
+	var spent time.Duration
+	for {
+		b := bufPool.Get().(*[bufSize]byte)
+		n,e := m.Read(b[:])
+		if n>0 {
+			now := time.Now()
+			at := now
+			if s.c.Budget<=0 || spent<s.c.Budget {
+				at = now.Add(time.Duration(rand.Int63n(int64(s.c.MaxDelay))))
+			}
+			if at.Before(prev) { at = prev }
+			spent += at.Sub(now)
+			prev = at
+			q <- chunk{b,n,at}
+		} else {
+			bufPool.Put(b)
+		}
+		if e==nil { continue }
+		close(q)
+		if e!=io.EOF { return e }
+		/* Flush the queue, before the caller half-closes dst. */
+		return <-done
+	}
+}
+
+/*
+Relays between a and b until both directions reached EOF or an error occurred,
+then closes a and b. It blocks until both directions are done.
+*/
+func (c *Config) Relay(a, b io.ReadWriteCloser) *Stats {
+	var wg sync.WaitGroup
+	s := &session{a:a,b:b,c:c,last:time.Now().UnixNano()}
+	
+	if c.Lifetime>0 {
+		t := time.AfterFunc(c.Lifetime,func(){ s.teardown(E_LIFETIME) })
+		defer t.Stop()
+	}
+	if c.Idle>0 {
+		var t *time.Timer
+		var mutex sync.Mutex
+		done := false
+		mutex.Lock()
+		t = time.AfterFunc(c.Idle,func(){
+			mutex.Lock(); defer mutex.Unlock()
+			if done { return }
+			idle := time.Duration(time.Now().UnixNano()-atomic.LoadInt64(&s.last))
+			if idle>=c.Idle {
+				s.teardown(E_IDLE)
+				return
+			}
+			t.Reset(c.Idle-idle)
+		})
+		mutex.Unlock()
+		defer func(){
+			mutex.Lock(); defer mutex.Unlock()
+			done = true
+			t.Stop()
+		}()
+	}
+	
+	wg.Add(2)
+	go s.copy(a,b,&s.stats.AtoB,&wg)
+	go s.copy(b,a,&s.stats.BtoA,&wg)
+	wg.Wait()
+	
+	s.teardown(nil)
+	s.stats.Reason = s.reason
+	if c.OnClose!=nil { c.OnClose(&s.stats) }
+	return &s.stats
+}
+
+var defaultConfig Config
+
+/* Relays between a and b using the default Config (no timeouts). */
+func Relay(a, b io.ReadWriteCloser) *Stats {
+	return defaultConfig.Relay(a,b)
+}
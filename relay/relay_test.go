@@ -0,0 +1,156 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package relay
+
+import "testing"
+import "io/ioutil"
+import "strconv"
+import "bytes"
+import "time"
+import "net"
+
+/* Returns both ends of a loopback TCP connection. */
+func pair(t *testing.T) (*net.TCPConn,*net.TCPConn) {
+	l,e := net.Listen("tcp","127.0.0.1:0")
+	if e!=nil { t.Fatal(e) }
+	defer l.Close()
+	c,e := net.Dial("tcp",l.Addr().String())
+	if e!=nil { t.Fatal(e) }
+	s,e := l.Accept()
+	if e!=nil { t.Fatal(e) }
+	return c.(*net.TCPConn),s.(*net.TCPConn)
+}
+
+/*
+A relay case: the relay runs between A and B, the case drives the far ends
+a and b. The Stats of the relay are checked against Reason, AtoB and BtoA.
+*/
+type relayCase struct{
+	name   string
+	config Config
+	run    func(t *testing.T, a, b *net.TCPConn)
+	reason error
+	atob   int64
+	btoa   int64
+}
+
+var relayCases = []relayCase{
+	{name:"eof",run:func(t *testing.T, a, b *net.TCPConn){
+		a.Write([]byte("ping"))
+		a.CloseWrite()
+		if r,_ := ioutil.ReadAll(b); string(r)!="ping" { t.Error("b got",string(r)) }
+		b.Write([]byte("pong!"))
+		b.CloseWrite()
+		if r,_ := ioutil.ReadAll(a); string(r)!="pong!" { t.Error("a got",string(r)) }
+	},atob:4,btoa:5},
+	{name:"reset",run:func(t *testing.T, a, b *net.TCPConn){
+		a.Write([]byte("x"))
+		buf := make([]byte,1)
+		b.Read(buf)
+		Reset(a)
+		_,e := ioutil.ReadAll(b)
+		if !IsReset(e) { t.Error("reset not propagated:",e) }
+	},reason:E_RESET,atob:1},
+	{name:"idle",config:Config{Idle:50*time.Millisecond},run:func(t *testing.T, a, b *net.TCPConn){
+		if r,_ := ioutil.ReadAll(b); len(r)!=0 { t.Error("b got",string(r)) }
+	},reason:E_IDLE},
+	{name:"busy",config:Config{Idle:100*time.Millisecond},run:func(t *testing.T, a, b *net.TCPConn){
+		/* Traffic keeps the connection alive beyond Idle. */
+		for i := 0; i<10; i++ {
+			a.Write([]byte("x"))
+			time.Sleep(20*time.Millisecond)
+		}
+		a.CloseWrite()
+		b.CloseWrite()
+		if r,_ := ioutil.ReadAll(b); len(r)!=10 { t.Error("b got",len(r)) }
+		ioutil.ReadAll(a)
+	},atob:10},
+	{name:"lifetime",config:Config{Lifetime:50*time.Millisecond,Idle:time.Second},run:func(t *testing.T, a, b *net.TCPConn){
+		for i := 0; i<3; i++ {
+			a.Write([]byte("x"))
+			time.Sleep(10*time.Millisecond)
+		}
+		ioutil.ReadAll(b)
+	},reason:E_LIFETIME,atob:3},
+	{name:"delay",config:Config{MaxDelay:5*time.Millisecond,Budget:20*time.Millisecond},run:func(t *testing.T, a, b *net.TCPConn){
+		/* The order is preserved, while chunks are held back. */
+		var want bytes.Buffer
+		for i := 0; i<50; i++ {
+			s := strconv.Itoa(i)+","
+			want.WriteString(s)
+			a.Write([]byte(s))
+			time.Sleep(time.Millisecond)
+		}
+		a.CloseWrite()
+		b.CloseWrite()
+		if r,_ := ioutil.ReadAll(b); !bytes.Equal(r,want.Bytes()) { t.Error("b got",string(r)) }
+		ioutil.ReadAll(a)
+	},atob:140},
+}
+
+func TestRelay(t *testing.T) {
+	for _,c := range relayCases {
+		c := c
+		t.Run(c.name,func(t *testing.T){
+			a,ra := pair(t)
+			b,rb := pair(t)
+			defer a.Close()
+			defer b.Close()
+			closes := 0
+			c.config.OnClose = func(*Stats){ closes++ }
+			res := make(chan *Stats,1)
+			go func(){ res <- c.config.Relay(ra,rb) }()
+			c.run(t,a,b)
+			var s *Stats
+			select {
+			case s = <-res:
+			case <-time.After(5*time.Second): t.Fatal("relay didn't end")
+			}
+			if c.reason==E_RESET {
+				if !IsReset(s.Reason) { t.Error("reason",s.Reason) }
+			} else if s.Reason!=c.reason {
+				t.Error("reason",s.Reason)
+			}
+			if s.AtoB!=c.atob || s.BtoA!=c.btoa { t.Error("stats",s.AtoB,s.BtoA) }
+			if closes!=1 { t.Error("OnClose called",closes,"times") }
+		})
+	}
+}
+
+/* Closing one side tears the whole relay down, if the other can't be half-closed. */
+func TestTeardown(t *testing.T) {
+	a,ra := pair(t)
+	defer a.Close()
+	x,y := net.Pipe()
+	res := make(chan *Stats,1)
+	go func(){ res <- Relay(ra,y) }()
+	a.CloseWrite()
+	select {
+	case s := <-res:
+		if s.Reason!=nil { t.Error("reason",s.Reason) }
+	case <-time.After(5*time.Second): t.Fatal("relay didn't end")
+	}
+	if _,e := x.Write([]byte("x")); e==nil { t.Error("pipe still open") }
+}
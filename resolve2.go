@@ -25,59 +25,152 @@ SOFTWARE.
 
 package sshproxy
 
-import "github.com/davecgh/go-xdr/xdr2"
-import "golang.org/x/crypto/ssh"
-import "net"
+import "github.com/maxymania/sshproxy/anyproto"
+import "github.com/maxymania/sshproxy/scrambler"
+import "golang.org/x/net/dns/dnsmessage"
+import "encoding/binary"
+import "context"
 import "errors"
-import "log"
-import "io"
+import "math"
+import "sync"
+import "time"
+import "net"
 
-func ap1_resolve(ech2 io.ReadWriteCloser, ch2 ssh.Channel){
-	enc := xdr.NewEncoder(ech2)
-	dec := xdr.NewDecoder(ech2)
-	s,_,e := dec.DecodeString()
-	if e!=nil {
-		log.Println("xdr2.DecodeString",e)
-		ch2.Close()
+/*
+The lowest TTL of the DNS answers, a lookup received. net.Resolver doesn't
+report TTLs, so the responses are parsed, as they pass its connections.
+*/
+type ttlWatch struct{
+	mutex sync.Mutex
+	ttl   uint32
+	seen  bool
+}
+func (w *ttlWatch) parse(b []byte) {
+	var p dnsmessage.Parser
+	if _,e := p.Start(b); e!=nil { return }
+	if e := p.SkipAllQuestions(); e!=nil { return }
+	w.mutex.Lock(); defer w.mutex.Unlock()
+	for {
+		h,e := p.AnswerHeader()
+		if e!=nil { return }
+		if !w.seen || h.TTL<w.ttl { w.ttl = h.TTL }
+		w.seen = true
+		if p.SkipAnswer()!=nil { return }
+	}
+}
+func (w *ttlWatch) get() (uint32,bool) {
+	w.mutex.Lock(); defer w.mutex.Unlock()
+	return w.ttl,w.seen
+}
+
+/* A DNS connection over UDP, one Read is one response. It must stay a net.PacketConn. */
+type ttlPacketConn struct{
+	*net.UDPConn
+	w *ttlWatch
+}
+func (c *ttlPacketConn) Read(b []byte) (int,error) {
+	n,e := c.UDPConn.Read(b)
+	if n>0 { c.w.parse(b[:n]) }
+	return n,e
+}
+
+/* A DNS connection over TCP, the responses are length prefixed. */
+type ttlStreamConn struct{
+	net.Conn
+	w   *ttlWatch
+	buf []byte
+}
+func (c *ttlStreamConn) Read(b []byte) (int,error) {
+	n,e := c.Conn.Read(b)
+	c.buf = append(c.buf,b[:n]...)
+	for len(c.buf)>=2 {
+		l := 2+int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf)<l { break }
+		c.w.parse(c.buf[2:l])
+		c.buf = c.buf[l:]
+	}
+	return n,e
+}
+
+/* Like net.LookupIP, but also returns the lowest TTL of the DNS answers, if any. */
+func lookupTTL(name string) ([]net.IP,uint32,bool,error) {
+	w := new(ttlWatch)
+	r := &net.Resolver{PreferGo:true,Dial:func(ctx context.Context, network, addr string) (net.Conn,error){
+		var d net.Dialer
+		c,e := d.DialContext(ctx,network,addr)
+		if e!=nil { return nil,e }
+		if uc,ok := c.(*net.UDPConn); ok { return &ttlPacketConn{uc,w},nil }
+		return &ttlStreamConn{Conn:c,w:w},nil
+	}}
+	ips,e := r.LookupIP(context.Background(),"ip",name)
+	ttl,ok := w.get()
+	return ips,ttl,ok,e
+}
+
+/*
+Resolve request: tag_host. The apc_ok reply carries one tag_ip per address
+and the TTL in seconds (tag_ttl), if the exit got the addresses through DNS.
+*/
+func ap1_resolve(m *anyproto.Message, ech2 *scrambler.Conn){
+	defer ech2.Close()
+	name,ok := m.String(tag_host)
+	if !ok {
+		replyErr(ech2,EC_FAILED,"malformed request")
 		return
 	}
 	
-	addr, e := net.ResolveIPAddr("ip", s)
+	ips,ttl,ok,e := lookupTTL(name)
 	if e!=nil {
-		enc.EncodeBool(false)
-		enc.EncodeOpaque(make([]byte,16))
-	}else{
-		enc.EncodeBool(true)
-		enc.EncodeOpaque([]byte(addr.IP))
+		replyErr(ech2,errCode(e),"")
+		return
+	}
+	r := &anyproto.Message{Op:apc_ok}
+	for _,ip := range ips {
+		if ip4 := ip.To4(); ip4!=nil { ip = ip4 }
+		r.AddBytes(tag_ip,[]byte(ip))
 	}
-	ch2.Close()
+	if ok { r.AddUint(tag_ttl,uint64(ttl)) }
+	anyproto.WriteMessage(ech2,r)
 }
 
+/*
+Resolves name at the exit. Errors reported by the exit are of type *RemoteError.
+In path mode, it fails with E_PATH_MODE.
+*/
 func Resolve(name string) (net.IP, error){
-	ech2,e := chopen_anyproto1(ap_resolve)
-	if e!=nil { return nil,e }
-	
-	enc := xdr.NewEncoder(ech2)
-	dec := xdr.NewDecoder(ech2)
-	
-	_,e = enc.EncodeString(name)
-	if e!=nil { return nil,e }
-	
-	ok,_,e := dec.DecodeBool()
-	if e!=nil { return nil,e }
-	ipa,_,e := dec.DecodeOpaque()
+	ips,e := LookupIP(name)
 	if e!=nil { return nil,e }
+	return ips[0],nil
+}
+
+/* Like Resolve, but returns all addresses. */
+func LookupIP(name string) ([]net.IP, error){
+	ips,_,e := LookupIPTTL(name)
+	return ips,e
+}
+
+/*
+Like LookupIP, but also returns how long the addresses may be cached, as told
+by the DNS. It is zero, if the exit doesn't know (like for /etc/hosts).
+*/
+func LookupIPTTL(name string) ([]net.IP, time.Duration, error){
+	m := &anyproto.Message{Op:ap_resolve}
+	m.AddString(tag_host,name)
+	ech2,e := chopen_anyproto1(Level,m)
+	if e!=nil { return nil,0,e }
+	defer ech2.Close()
 	
-	ech2.Close()
-	
-	if !ok {
-		return nil,errors.New("No such name!")
-	}
+	r,e := readReply(ech2)
+	if e!=nil { return nil,0,e }
 	
-	switch len(ipa) {
-	case 4,16: return net.IP(ipa),e
-	default: return nil,errors.New("Invalid IP address format!")
+	var ips []net.IP
+	for _,ipa := range r.All(tag_ip,anyproto.TBytes) {
+		switch len(ipa) {
+		case 4,16: ips = append(ips,net.IP(ipa))
+		}
 	}
-	panic("unreachable")
+	if len(ips)==0 { return nil,0,errors.New("Invalid IP address format!") }
+	ttl,_ := r.Uint(tag_ttl)
+	if ttl>math.MaxInt32 { ttl = math.MaxInt32 }
+	return ips,time.Duration(ttl)*time.Second,nil
 }
-
@@ -0,0 +1,120 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package scrambler
+
+import "testing"
+import "strconv"
+import "net"
+import "io"
+
+/*
+Builds a cascade with n Intermediate stations. Returns both end points, the
+raw pipes at the Initiator's and at the Endpt's side and a function, that
+tears the cascade down.
+*/
+func cascade(c *Config, n int) (clt, srv *Conn, first, last net.Conn, stop func(), e error) {
+	var pipes []net.Conn
+	stop = func() {
+		for _,p := range pipes { p.Close() }
+	}
+	a,b := net.Pipe()
+	pipes = append(pipes,a,b)
+	first = a
+	errs := make(chan error,n+1)
+	for i := 0; i<n; i++ {
+		x,y := net.Pipe()
+		pipes = append(pipes,x,y)
+		go func(clt, srv net.Conn) { errs <- c.Intermediate(clt,srv) }(b,x)
+		b = y
+	}
+	last = b
+	go func() {
+		var e error
+		srv,e = c.Endpt(last)
+		errs <- e
+	}()
+	clt,e = c.Initiator(first)
+	if e!=nil { return }
+	for i := 0; i<=n; i++ {
+		if e = <-errs; e!=nil { return }
+	}
+	return
+}
+
+const benchSize = 1<<20
+
+/* Writes benchSize bytes to w and reads them from r, b.N times. */
+func pump(b *testing.B, w io.Writer, r io.Reader) {
+	data := make([]byte,benchSize)
+	done := make(chan error,1)
+	go func() {
+		buf := make([]byte,1<<15)
+		for {
+			todo := benchSize
+			for todo>0 {
+				m,e := r.Read(buf)
+				if e!=nil { done <- e; return }
+				todo -= m
+			}
+			done <- nil
+		}
+	}()
+	
+	b.SetBytes(benchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i<b.N; i++ {
+		_,e := w.Write(data)
+		if e!=nil { b.Fatal(e) }
+		if e = <-done; e!=nil { b.Fatal(e) }
+	}
+}
+
+/* The data path from the Initiator to the Endpt, end to end. */
+func BenchmarkCascade(b *testing.B) {
+	for _,n := range []int{0,1,2,3} {
+		b.Run("hops="+strconv.Itoa(n),func(b *testing.B) {
+			clt,srv,_,_,stop,e := cascade(new(Config),n)
+			defer stop()
+			if e!=nil { b.Fatal(e) }
+			pump(b,clt,srv)
+		})
+	}
+}
+
+/*
+One Intermediate station alone: the ciphertext is written to and read from
+its pipes directly, so the end points' ciphers don't count.
+*/
+func BenchmarkHop(b *testing.B) {
+	for _,l := range []Layout{DefaultLayout,{Keys:3,Blind:2},{Keys:4,Blind:4}} {
+		b.Run("keys="+strconv.Itoa(int(l.Keys))+",blind="+strconv.Itoa(int(l.Blind)),func(b *testing.B) {
+			_,_,first,last,stop,e := cascade(&Config{Layout:l},1)
+			defer stop()
+			if e!=nil { b.Fatal(e) }
+			pump(b,first,last)
+		})
+	}
+}
@@ -0,0 +1,234 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package scrambler
+
+import "io"
+import "net"
+import "sync"
+import "time"
+import "fmt"
+
+import "github.com/maxymania/sshproxy/relay"
+
+/*
+ * Once the handshake is done, the Initiator and the Endpt exchange frames
+ * over the session, which are transcrypted by the Intermediate stations like
+ * any other data:
+ *
+ *	Type uint8 | Length uint16 | Payload [Length]byte
+ *
+ * As the frames are end-to-end, a half-close (FIN) or an abortive close (RST)
+ * survives the whole cascade. A FIN is additionally signaled out-of-band
+ * (CloseWrite on the underlying stream), so the Intermediate stations can
+ * half-close their streams, too.
+ */
+const (
+	frData = iota
+	frFin
+	frRst
+)
+
+/*
+Maximum payload of a frame. A full frame fills exactly one SSH channel data
+packet (32 KiB).
+*/
+const maxFrame = 1<<15 - 3
+
+var framePool = sync.Pool{New: func() interface{} { return new([3+maxFrame]byte) }}
+
+/* Returned by Read, if the other end point called Reset. */
+var E_RESET = relay.E_RESET
+
+type dl_1 interface{
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type sessionAddr struct{}
+func (sessionAddr) Network() string { return "scrambler" }
+func (sessionAddr) String() string { return "scrambler" }
+
+/*
+A session, as returned by Initiator and Endpt. It implements net.Conn and
+supports half-close (CloseWrite) and abortive close (Reset).
+*/
+type Conn struct{
+	w *wrapper
+	
+	rmutex  sync.Mutex
+	remain  int
+	rerr    error
+	rhdr    [3]byte
+	
+	wmutex  sync.Mutex
+	wclosed bool
+}
+
+func newConn(w *wrapper) *Conn {
+	return &Conn{w:w}
+}
+
+func (c *Conn) Read(b []byte) (n int, e error) {
+	c.rmutex.Lock(); defer c.rmutex.Unlock()
+	hdr := c.rhdr[:]
+	for c.remain==0 {
+		if c.rerr!=nil { return 0,c.rerr }
+		_,e = io.ReadFull(&c.w.StreamReader,hdr[:])
+		if e==io.EOF {
+			/* The underlying stream ended without FIN or RST. */
+			e = io.ErrUnexpectedEOF
+		}
+		if e!=nil { c.rerr = e; return }
+		switch hdr[0] {
+		case frData: c.remain = int(hdr[1])<<8|int(hdr[2])
+		case frFin: c.rerr = io.EOF
+		case frRst: c.rerr = E_RESET
+		default: c.rerr = fmt.Errorf("Invalid frame type %d",hdr[0])
+		}
+	}
+	if len(b)>c.remain { b = b[:c.remain] }
+	n,e = c.w.StreamReader.Read(b)
+	c.remain -= n
+	if e==io.EOF { e = io.ErrUnexpectedEOF }
+	if e!=nil { c.rerr = e }
+	return
+}
+
+/*
+Sends a frame, whose payload is already in place (f[3:]). The frame is
+encrypted in place. Must be called with wmutex held.
+*/
+func (c *Conn) sendFrame(t byte, f []byte) error {
+	if c.wclosed { return io.ErrClosedPipe }
+	p := len(f)-3
+	f[0],f[1],f[2] = t,byte(p>>8),byte(p)
+	c.w.StreamWriter.S.XORKeyStream(f,f)
+	_,e := c.w.StreamWriter.W.Write(f)
+	return e
+}
+
+/* Must be called with wmutex held. */
+func (c *Conn) frame(t byte, p []byte) error {
+	f := framePool.Get().(*[3+maxFrame]byte)
+	defer framePool.Put(f)
+	return c.sendFrame(t,f[:3+copy(f[3:],p)])
+}
+
+func (c *Conn) Write(b []byte) (n int, e error) {
+	c.wmutex.Lock(); defer c.wmutex.Unlock()
+	for len(b)>0 {
+		p := b
+		if len(p)>maxFrame { p = p[:maxFrame] }
+		e = c.frame(frData,p)
+		if e!=nil { return }
+		n += len(p)
+		b = b[len(p):]
+	}
+	return
+}
+
+/* Implements io.ReaderFrom: Reads directly into the frame buffer. */
+func (c *Conn) ReadFrom(r io.Reader) (n int64, e error) {
+	f := framePool.Get().(*[3+maxFrame]byte)
+	defer framePool.Put(f)
+	for {
+		m,re := r.Read(f[3:])
+		if m>0 {
+			c.wmutex.Lock()
+			e = c.sendFrame(frData,f[:3+m])
+			c.wmutex.Unlock()
+			if e!=nil { return }
+			n += int64(m)
+		}
+		if re==io.EOF { return }
+		if re!=nil { e = re; return }
+	}
+}
+
+/* Implements io.WriterTo: Copies the payload until FIN (or RST). */
+func (c *Conn) WriteTo(w io.Writer) (n int64, e error) {
+	f := framePool.Get().(*[3+maxFrame]byte)
+	defer framePool.Put(f)
+	for {
+		m,re := c.Read(f[:maxFrame])
+		if m>0 {
+			m,e = w.Write(f[:m])
+			n += int64(m)
+			if e!=nil { return }
+		}
+		if re==io.EOF { return }
+		if re!=nil { e = re; return }
+	}
+}
+
+/* Sends a FIN to the other end point. Reading is still possible. */
+func (c *Conn) CloseWrite() error {
+	c.wmutex.Lock(); defer c.wmutex.Unlock()
+	e := c.frame(frFin,nil)
+	c.wclosed = true
+	if e!=nil { return e }
+	if cw,ok := c.w.C.(cs_1); ok { return cw.CloseWrite() }
+	return nil
+}
+
+/*
+Aborts the session. The other end point's Read will fail with E_RESET, it
+should abort the connection it is relaying to (if any) as well.
+*/
+func (c *Conn) Reset() error {
+	c.wmutex.Lock()
+	if !c.wclosed { c.frame(frRst,nil) }
+	c.wclosed = true
+	c.wmutex.Unlock()
+	return c.w.Close()
+}
+
+/* Closes the session. A FIN is sent, unless CloseWrite or Reset was called before. */
+func (c *Conn) Close() error {
+	c.wmutex.Lock()
+	if !c.wclosed { c.frame(frFin,nil) }
+	c.wclosed = true
+	c.wmutex.Unlock()
+	return c.w.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr { return sessionAddr{} }
+func (c *Conn) RemoteAddr() net.Addr { return sessionAddr{} }
+
+/* Deadlines are supported, if the underlying stream supports them. */
+func (c *Conn) SetDeadline(t time.Time) error {
+	if d,ok := c.w.C.(dl_1); ok { return d.SetDeadline(t) }
+	return nil
+}
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if d,ok := c.w.C.(dl_1); ok { return d.SetReadDeadline(t) }
+	return nil
+}
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if d,ok := c.w.C.(dl_1); ok { return d.SetWriteDeadline(t) }
+	return nil
+}
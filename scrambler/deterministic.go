@@ -0,0 +1,56 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package scrambler
+
+import "io"
+import "golang.org/x/crypto/sha3"
+
+/*
+Deterministic mode
+
+For reproducible sessions, every party of a session gets its own entropy
+source (Config.Rand), which is the SHAKE256 output stream over
+
+	seed || 0x00 || label
+
+The labels are "initiator", "endpt" and "intermediate-<n>", where <n> is the
+decimal position of the Intermediate station, starting with 0 at the
+Initiator's side. Every party reads its randomness strictly in protocol order:
+56 bytes per x448 private key (the Initiator and the Endpt one per slot, the
+Intermediate station CLTK, SRVK and then the salts in slot order), followed by
+64 bytes for the ML-KEM-768 key pair (Initiator) or 32 bytes for the
+encapsulation (Endpt) in hybrid mode. The known-answer vectors in
+testdata/vectors.json are generated this way.
+
+NEVER use this outside of tests.
+*/
+func NewDeterministicReader(seed []byte, label string) io.Reader {
+	h := sha3.NewShake256()
+	h.Write(seed)
+	h.Write([]byte{0})
+	h.Write([]byte(label))
+	return h
+}
@@ -26,23 +26,37 @@ SOFTWARE.
 package scrambler
 
 import "io"
+import "crypto/cipher"
 
 type cs_1 interface{
 	CloseWrite() error
 }
 
-func dispatch(r io.Reader, w io.Writer){
-	b := make([]byte,1<<13)
-	for{
-		n,e := r.Read(b)
-		if e==io.EOF {
-			if c1,ok := w.(cs_1); ok {
-				c1.CloseWrite()
-			} else if c2,ok := w.(io.Closer); ok {
-				c2.Close()
-			}
-			break
+/*
+One side of an Intermediate station, as seen by the relay engine: Reading
+transcrypts the data coming in, Writing passes the already transcrypted
+data from the other side on.
+*/
+type station struct{
+	cipher.StreamReader
+	io.WriteCloser
+}
+/* Implements io.WriterTo: Transcrypts in place, using a pooled buffer. */
+func (s *station) WriteTo(w io.Writer) (n int64, e error) {
+	f := framePool.Get().(*[3+maxFrame]byte)
+	defer framePool.Put(f)
+	for {
+		m,re := s.StreamReader.Read(f[:])
+		if m>0 {
+			m,e = w.Write(f[:m])
+			n += int64(m)
+			if e!=nil { return }
 		}
-		if n>0 { w.Write(b[:n]) }
+		if re==io.EOF { return }
+		if re!=nil { e = re; return }
 	}
 }
+func (s *station) CloseWrite() error {
+	if c1,ok := s.WriteCloser.(cs_1); ok { return c1.CloseWrite() }
+	return s.WriteCloser.Close()
+}
@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package scrambler
+
+import "io"
+import "crypto/cipher"
+import "golang.org/x/crypto/sha3"
+import "github.com/cloudflare/circl/kem/mlkem/mlkem768"
+
+/*
+ * The hybrid mode adds an ML-KEM-768 key exchange between the Initiator and
+ * the Endpt. It can not be part of the CryptoRecord, as the Intermediate
+ * stations can not blind a KEM public key, so the Intermediate station's input
+ * and output could be associated by it. Instead, it is performed as the first
+ * exchange over the freshly established session, where it is transcrypted by
+ * every Intermediate station like any other data.
+ *
+ * Both sides then derive an additional ChaCha20 key from the KEM secret and
+ * the x448 secrets of the blind slots (which are the ones, that are always
+ * shared between Initiator and Endpt) and add it as an extra layer to their
+ * streams. A direction is rekeyed right after its KEM message was sent.
+ */
+
+const ivHybrid = "sshproxy hybrid x448+ML-KEM-768"
+
+func hybridKey(ss []byte, blind [][56]byte) *[56]byte {
+	var key [56]byte
+	h := sha3.NewShake256()
+	h.Write([]byte(ivHybrid))
+	h.Write(ss)
+	for i := range blind {
+		h.Write(blind[i][:])
+	}
+	h.Read(key[:])
+	return &key
+}
+
+func (w *wrapper) rekeyReader(s cipher.Stream) {
+	w.StreamReader.S.(*multiStream).add(s)
+}
+func (w *wrapper) rekeyWriter(s cipher.Stream) {
+	w.StreamWriter.S.(*multiStream).add(s)
+}
+
+func (w *wrapper) hybridInitiator(rnd io.Reader, blind [][56]byte) error {
+	var pkb [mlkem768.PublicKeySize]byte
+	var ct [mlkem768.CiphertextSize]byte
+	var ss [mlkem768.SharedKeySize]byte
+	
+	pk,sk,e := mlkem768.GenerateKeyPair(rnd)
+	if e!=nil { return e }
+	pk.Pack(pkb[:])
+	
+	_,e = w.StreamWriter.Write(pkb[:])
+	if e!=nil { return e }
+	_,e = io.ReadFull(w.StreamReader,ct[:])
+	if e!=nil { return e }
+	
+	sk.DecapsulateTo(ss[:],ct[:])
+	key := hybridKey(ss[:],blind)
+	
+	/*
+	 * We can't rekey c2s right after sending the public key, as we don't have
+	 * the key then. But as we didn't send anything since, it is the same
+	 * position in the stream.
+	 */
+	w.rekeyWriter(c2sChaCha(key))
+	w.rekeyReader(s2cChaCha(key))
+	return nil
+}
+
+func (w *wrapper) hybridEndpt(rnd io.Reader, blind [][56]byte) error {
+	var pkb [mlkem768.PublicKeySize]byte
+	var ct [mlkem768.CiphertextSize]byte
+	var ss [mlkem768.SharedKeySize]byte
+	var seed [mlkem768.EncapsulationSeedSize]byte
+	var pk mlkem768.PublicKey
+	
+	_,e := io.ReadFull(w.StreamReader,pkb[:])
+	if e!=nil { return e }
+	e = pk.Unpack(pkb[:])
+	if e!=nil { return e }
+	
+	_,e = io.ReadFull(rnd,seed[:])
+	if e!=nil { return e }
+	pk.EncapsulateTo(ct[:],ss[:],seed[:])
+	key := hybridKey(ss[:],blind)
+	
+	/* The client switches c2s right after its public key. */
+	w.rekeyReader(c2sChaCha(key))
+	
+	_,e = w.StreamWriter.Write(ct[:])
+	if e!=nil { return e }
+	w.rekeyWriter(s2cChaCha(key))
+	return nil
+}
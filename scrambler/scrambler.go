@@ -30,11 +30,11 @@ SOFTWARE.
  handshake without braking it and it scrambles the communicated data without
  breaking it. The Intermediate station's input and output can not be associated
  with each other (to identify a Session), except with a 448-bit brute force attack.
+ Optionally, the end points combine x448 with the post-quantum ML-KEM-768.
 */
 package scrambler
 
 import "io"
-import "encoding/binary"
 
 import "git.schwanenlied.me/yawning/x448.git"
 // XXX: Use this in production, in case the above passes away.
@@ -53,6 +53,8 @@ import "crypto/rand"
 import "crypto/cipher"
 import "fmt"
 
+import "github.com/maxymania/sshproxy/relay"
+
 const (
 	ivC2S = "Client-to-Server"
 	ivS2C = "Server-to-Client"
@@ -63,9 +65,172 @@ func hex(i interface{}) string{
 	return fmt.Sprintf("%X",i)
 }
 
+/*
+Describes the key slot layout of a session. The first Keys slots are rotated
+through the cascade: every Intermediate station consumes slot 0, shifts the
+remaining rotating slots down by one (salting them on the way) and fills the
+last rotating slot with a fresh key of its own. The Blind slots are never
+rotated, but salted by every station; they are always shared between the
+Initiator and the Endpt.
+
+The layout is chosen by the Initiator and sent in front of the first
+CryptoRecord (see header), so every station learns it from the handshake
+itself.
+*/
+type Layout struct{
+	Keys  uint8
+	Blind uint8
+}
+
+/* The classic [A,B,X] layout: two rotating slots and one blind slot. */
+var DefaultLayout = Layout{Keys:2,Blind:1}
+
+/* Default upper bound for the number of slots a station accepts. */
+const MaxSlots = 16
+
+var E_LAYOUT = fmt.Errorf("Handshake failed due to an unsupported slot layout")
+var E_VERSION = fmt.Errorf("Handshake failed due to an unsupported protocol version (old peer?)")
+var E_HYBRID = fmt.Errorf("Handshake failed due to missing hybrid key exchange")
+
+func (l Layout) Slots() int { return int(l.Keys)+int(l.Blind) }
+
+func (l Layout) check(max int) error {
+	if l.Keys<2 || l.Slots()>max { return E_LAYOUT }
+	return nil
+}
+
+const (
+	/* The session uses the hybrid x448 + ML-KEM-768 key exchange. */
+	flagHybrid = 1<<iota
+)
+
+/*
+The version of the handshake. Peers of version 1 sent no header and used
+the fixed [A,B,X] layout; they are detected with a probability of 255/256,
+as their first byte is random.
+*/
+const Version = 2
+
+/*
+The handshake header, that precedes the first CryptoRecord:
+
+	Version(1) Keys(1) Blind(1) Flags(1)
+*/
+type header struct{
+	Layout
+	Flags uint8
+}
+func (h header) bytes() []byte {
+	return []byte{Version,h.Keys,h.Blind,h.Flags}
+}
+
 type CryptoRecord struct{
-	Array [3][56]byte
+	Array [][56]byte
+}
+func newRecord(l Layout) *CryptoRecord {
+	return &CryptoRecord{make([][56]byte,l.Slots())}
 }
+func (r *CryptoRecord) read(src io.Reader) error {
+	b := make([]byte,56*len(r.Array))
+	_,e := io.ReadFull(src,b)
+	if e!=nil { return e }
+	for i := range r.Array {
+		copy(r.Array[i][:],b[i*56:])
+	}
+	return nil
+}
+func (r *CryptoRecord) write(dst io.Writer) error {
+	return r.writeAfter(dst,nil)
+}
+/* Writes prefix and the record with one Write. */
+func (r *CryptoRecord) writeAfter(dst io.Writer, prefix []byte) error {
+	b := make([]byte,0,len(prefix)+56*len(r.Array))
+	b = append(b,prefix...)
+	for i := range r.Array {
+		b = append(b,r.Array[i][:]...)
+	}
+	_,e := dst.Write(b)
+	return e
+}
+
+/*
+Handshake parameters. The zero value is ready to use and selects
+DefaultLayout and MaxSlots.
+*/
+type Config struct{
+	/* The slot layout the Initiator requests. */
+	Layout Layout
+	
+	/* The maximum number of slots an Intermediate or Endpt accepts. */
+	MaxSlots int
+	
+	/*
+	If set, the Initiator performs the hybrid x448 + ML-KEM-768 key exchange
+	and Intermediate and Endpt reject sessions, that don't.
+	*/
+	Hybrid bool
+	
+	/*
+	The entropy source for all keys. If nil, crypto/rand.Reader is used.
+	See NewDeterministicReader for reproducible sessions.
+	*/
+	Rand io.Reader
+	
+	/* Copy engine parameters of an Intermediate station. If nil, no timeouts apply. */
+	Relay *relay.Config
+	
+	/*
+	If set, an Intermediate calls Hold after it processed the client's record
+	and before it sends anything to the server. A mixing relay blocks here,
+	until the round is released, and may open the server connection only then.
+	The header and the record are sent with one Write afterwards.
+	*/
+	Hold func() error
+}
+
+func (c *Config) relay() *relay.Config {
+	if c.Relay==nil { return new(relay.Config) }
+	return c.Relay
+}
+
+func (c *Config) rand() io.Reader {
+	if c.Rand==nil { return rand.Reader }
+	return c.Rand
+}
+
+func (c *Config) layout() Layout {
+	if c.Layout.Slots()==0 { return DefaultLayout }
+	return c.Layout
+}
+func (c *Config) maxSlots() int {
+	if c.MaxSlots<=0 { return MaxSlots }
+	return c.MaxSlots
+}
+
+func (c *Config) header() (h header) {
+	h.Layout = c.layout()
+	if c.Hybrid { h.Flags |= flagHybrid }
+	return
+}
+
+/* Reads the handshake header and checks it against the configured bounds. */
+func (c *Config) readHeader(src io.Reader) (h header,e error) {
+	var b [4]byte
+	_,e = io.ReadFull(src,b[:])
+	if e!=nil { return }
+	if b[0]!=Version { e = E_VERSION; return }
+	h.Keys,h.Blind,h.Flags = b[1],b[2],b[3]
+	e = h.check(c.maxSlots())
+	if e!=nil { return }
+	if h.Flags&flagHybrid!=0 {
+		if h.Blind==0 { e = E_LAYOUT }
+	} else if c.Hybrid {
+		e = E_HYBRID
+	}
+	return
+}
+
+var defaultConfig Config
 
 type wrapper struct{
 	C io.Closer
@@ -108,22 +273,68 @@ func mustChaCha(c *chacha20.Cipher,e error) *chacha20.Cipher {
 
 var E_ECDH_FAILED = fmt.Errorf("Handshake failed due to x448")
 
+/* Generates a private key t and its public key pub. */
+func keygen(rnd io.Reader, t, pub *[56]byte) error {
+	for {
+		_,e := io.ReadFull(rnd,t[:])
+		if e!=nil { return e }
+		if x448.ScalarBaseMult(pub,t) == 0 { return nil } // Kick out broken private keys.
+	}
+}
+
+func c2sStreams(keys [][56]byte) *multiStream {
+	m := new(multiStream)
+	for i := range keys {
+		m.add(c2sChaCha(&(keys[i])))
+	}
+	return m
+}
+func s2cStreams(keys [][56]byte) *multiStream {
+	m := new(multiStream)
+	for i := range keys {
+		m.add(s2cChaCha(&(keys[i])))
+	}
+	return m
+}
+
+/* Client side function to start a session, using the default Config. */
+func Initiator(srv io.ReadWriteCloser) (*Conn,error){
+	return defaultConfig.Initiator(srv)
+}
+
+/*
+Intermediate station function to start a session, using the default Config.
+If an error is returned, please close the connections, otherwise, don't.
+*/
+func Intermediate(clt io.ReadWriteCloser,srv io.ReadWriteCloser) error{
+	return defaultConfig.Intermediate(clt,srv)
+}
+
+/* Server side function to start a session, using the default Config. */
+func Endpt(clt io.ReadWriteCloser) (*Conn,error) {
+	return defaultConfig.Endpt(clt)
+}
+
 /* Client side function to start a session. */
-func Initiator(srv io.ReadWriteCloser) (io.ReadWriteCloser,error){
-	var t [3][56]byte
-	var r CryptoRecord
+func (c *Config) Initiator(srv io.ReadWriteCloser) (*Conn,error){
+	h := c.header()
+	l := h.Layout
+	e := l.check(c.maxSlots())
+	if e!=nil { return nil,e }
+	if c.Hybrid && l.Blind==0 { return nil,E_LAYOUT }
+	
+	t := make([][56]byte,l.Slots())
+	r := newRecord(l)
 	
 	fail := 0
 	for i := range t {
-restart:
-		rand.Read(t[i][:])
-		if x448.ScalarBaseMult(&(r.Array[i]),&(t[i])) != 0 { goto restart } // Kick out broken private keys.
+		e = keygen(c.rand(),&(t[i]),&(r.Array[i]))
+		if e!=nil { return nil,e }
 	}
-	//if fail!=0 { return nil,E_ECDH_FAILED } // If an error occours afterwarts, fail.
 	
-	e := binary.Write(srv,binary.BigEndian,r)
+	e = r.writeAfter(srv,h.bytes())
 	if e!=nil { return nil,e }
-	e = binary.Read(srv,binary.BigEndian,&r)
+	e = r.read(srv)
 	if e!=nil { return nil,e }
 	
 	
@@ -134,133 +345,133 @@ restart:
 	
 	//------------------------------------------------------------
 	
-	c2s := make(multiStream,3)
-	for i := range r.Array {
-		c2s[i] = c2sChaCha(&(r.Array[i]))
+	w := &wrapper{
+		srv,
+		cipher.StreamReader{S:s2cStreams(r.Array),R:srv},
+		cipher.StreamWriter{S:c2sStreams(r.Array),W:srv},
 	}
-	
-	s2c := make(multiStream,3)
-	for i := range r.Array {
-		s2c[i] = s2cChaCha(&(r.Array[i]))
+	if c.Hybrid {
+		e = w.hybridInitiator(c.rand(),r.Array[l.Keys:])
+		if e!=nil { return nil,e }
 	}
-	
-	return &wrapper{
-		srv,
-		cipher.StreamReader{s2c,srv},
-		cipher.StreamWriter{c2s,srv,nil},
-	},nil
+	return newConn(w),nil
 }
 
 /*
 Intermediate station function to start a session.
 If an error is returned, please close the connections, otherwise, don't.
 */
-func Intermediate(clt io.ReadWriteCloser,srv io.ReadWriteCloser) error{
+func (c *Config) Intermediate(clt io.ReadWriteCloser,srv io.ReadWriteCloser) error{
 	const (
-		SALT = iota
-		SALT2
-		CLTK
+		CLTK = iota
 		SRVK
-		N_Ts /* Number of t-Keys */
+		N_Ts /* Number of fixed t-Keys */
 	)
 	
-	var t [N_Ts][56]byte
-	var K [2][56]byte
-	var r CryptoRecord
+	h,e := c.readHeader(clt)
+	if e!=nil { return e }
+	l := h.Layout
+	
+	/*
+	 * Besides CLTK and SRVK, we need one SALT for every rotating slot, that
+	 * is passed on to the server (all but A), and one for every blind slot.
+	 */
+	K := int(l.Keys)
+	t := make([][56]byte,N_Ts+l.Slots()-1)
+	salt := t[N_Ts:]
+	var K2 [2][56]byte
 	var test [56]byte
+	r := newRecord(l)
 	
 	fail := 0
 	for i := range t {
-restart:
-		rand.Read(t[i][:])
-		if x448.ScalarBaseMult(&test,&(t[i])) != 0 { goto restart } // Kick out broken private keys.
+		e = keygen(c.rand(),&(t[i]),&test)
+		if e!=nil { return e }
 	}
 	
-	//if fail!=0 { return E_ECDH_FAILED } // If an error occours afterwarts, fail.
-	
 	//-------------------------------------------------------
 	
-	/*  [A,B,X] -> [B,C,X]  */
+	/*  [A,B,...,X...] -> [B,...,C,X...]  */
 	
-	e := binary.Read(clt,binary.BigEndian,&r)
+	e = r.read(clt)
 	if e!=nil { return e }
 	
-	//fail = 0
-	
-	fail |= x448.ScalarMult(&(K[0]),&(t[CLTK]),&(r.Array[0]))
-	r.Array[0] = r.Array[1]
-	fail |= x448.ScalarBaseMult(&(r.Array[1]),&(t[SRVK]))
+	fail |= x448.ScalarMult(&(K2[0]),&(t[CLTK]),&(r.Array[0]))
+	copy(r.Array[:K-1],r.Array[1:K])
+	fail |= x448.ScalarBaseMult(&(r.Array[K-1]),&(t[SRVK]))
 	
-	/* Scramble B and X */
+	/* Scramble B... and X... (salt[i] belongs to the rotating slot i+1) */
 	
-	fail |= x448.ScalarMult(&(r.Array[0]),&(t[SALT]),&(r.Array[0]))
-	fail |= x448.ScalarMult(&(r.Array[2]),&(t[SALT2]),&(r.Array[2]))
+	for i := 0; i<K-1; i++ {
+		fail |= x448.ScalarMult(&(r.Array[i]),&(salt[i]),&(r.Array[i]))
+	}
+	for i := K; i<len(r.Array); i++ {
+		fail |= x448.ScalarMult(&(r.Array[i]),&(salt[i-1]),&(r.Array[i]))
+	}
 	
 	if fail!=0 { return E_ECDH_FAILED } // If an error occours afterwarts, fail.
 	
-	e = binary.Write(srv,binary.BigEndian,r)
+	if c.Hold!=nil {
+		e = c.Hold()
+		if e!=nil { return e }
+	}
+	
+	e = r.writeAfter(srv,h.bytes())
 	if e!=nil { return e }
 	
 	//-------------------------------------------------------
 	
-	/*  [B,C,X] -> [A,B,X]  */
+	/*  [B,...,C,X...] -> [A,B,...,X...]  */
 	
-	e = binary.Read(srv,binary.BigEndian,&r)
+	e = r.read(srv)
 	if e!=nil { return e }
 	
-	//fail = 0
-	
-	fail |= x448.ScalarMult(&(K[1]),&(t[SRVK]),&(r.Array[1]))
-	r.Array[1] = r.Array[0]
+	fail |= x448.ScalarMult(&(K2[1]),&(t[SRVK]),&(r.Array[K-1]))
+	copy(r.Array[1:K],r.Array[:K-1])
 	fail |= x448.ScalarBaseMult(&(r.Array[0]),&(t[CLTK]))
 	
-	/* Scramble B and X */
+	/* Scramble B... and X..., but skip A */
 	
-	fail |= x448.ScalarMult(&(r.Array[1]),&(t[SALT]),&(r.Array[1]))
-	fail |= x448.ScalarMult(&(r.Array[2]),&(t[SALT2]),&(r.Array[2]))
+	for i := 1; i<K; i++ {
+		fail |= x448.ScalarMult(&(r.Array[i]),&(salt[i-1]),&(r.Array[i]))
+	}
+	for i := K; i<len(r.Array); i++ {
+		fail |= x448.ScalarMult(&(r.Array[i]),&(salt[i-1]),&(r.Array[i]))
+	}
 	
 	if fail!=0 { return E_ECDH_FAILED } // If an error occours afterwarts, fail.
 	
-	e = binary.Write(clt,binary.BigEndian,r)
+	e = r.write(clt)
 	if e!=nil { return e }
 	
 	//-------------------------------------------------------
 	
 	/* Apply Transcryption (A and C) */
 	
+	eclt := &station{cipher.StreamReader{S:c2sStreams(K2[:]),R:clt},clt}
+	esrv := &station{cipher.StreamReader{S:s2cStreams(K2[:]),R:srv},srv}
 	
-	c2s := make(multiStream,2)
-	for i := range K {
-		c2s[i] = c2sChaCha(&(K[i]))
-	}
-	
-	s2c := make(multiStream,2)
-	for i := range K {
-		s2c[i] = s2cChaCha(&(K[i]))
-	}
-	
-	eclt := cipher.StreamReader{c2s,clt}
-	esrv := cipher.StreamReader{s2c,srv}
-	
-	go dispatch(eclt,srv)
-	go dispatch(esrv,clt)
+	go c.relay().Relay(eclt,esrv)
 	
 	return nil
 }
 
 /* Server side function to start a session. */
-func Endpt(clt io.ReadWriteCloser) (io.ReadWriteCloser,error) {
-	var t [3][56]byte
-	var r,r2 CryptoRecord
+func (c *Config) Endpt(clt io.ReadWriteCloser) (*Conn,error) {
+	h,e := c.readHeader(clt)
+	if e!=nil { return nil,e }
+	l := h.Layout
+	
+	t := make([][56]byte,l.Slots())
+	r,r2 := newRecord(l),newRecord(l)
 	
 	fail := 0
 	for i := range t {
-restart:
-		rand.Read(t[i][:])
-		if x448.ScalarBaseMult(&(r2.Array[i]),&(t[i])) != 0 { goto restart } // Kick out broken private keys.
+		e = keygen(c.rand(),&(t[i]),&(r2.Array[i]))
+		if e!=nil { return nil,e }
 	}
 	
-	e := binary.Read(clt,binary.BigEndian,&r)
+	e = r.read(clt)
 	if e!=nil { return nil,e }
 	
 	for i := range t {
@@ -268,26 +479,20 @@ restart:
 	}
 	if fail!=0 { return nil,E_ECDH_FAILED } // If an error occours afterwarts, fail.
 	
-	e = binary.Write(clt,binary.BigEndian,r2)
+	e = r2.write(clt)
 	if e!=nil { return nil,e }
 	
 	
 	//-------------------------------------------------------
 	
-	c2s := make(multiStream,3)
-	for i := range r.Array {
-		c2s[i] = c2sChaCha(&(r.Array[i]))
+	w := &wrapper{
+		clt,
+		cipher.StreamReader{S:c2sStreams(r.Array),R:clt},
+		cipher.StreamWriter{S:s2cStreams(r.Array),W:clt},
 	}
-	
-	s2c := make(multiStream,3)
-	for i := range r.Array {
-		s2c[i] = s2cChaCha(&(r.Array[i]))
+	if h.Flags&flagHybrid!=0 {
+		e = w.hybridEndpt(c.rand(),r.Array[l.Keys:])
+		if e!=nil { return nil,e }
 	}
-	
-	return &wrapper{
-		clt,
-		cipher.StreamReader{c2s,clt},
-		cipher.StreamWriter{s2c,clt,nil},
-	},nil
+	return newConn(w),nil
 }
-
@@ -26,15 +26,37 @@ SOFTWARE.
 package scrambler
 
 import "crypto/cipher"
+import "crypto/subtle"
 
-type multiStream []cipher.Stream
-func (m multiStream) XORKeyStream(dst, src []byte) {
-	for i,k := range m {
-		if i==0 {
-			k.XORKeyStream(dst,src)
-		}else{
-			k.XORKeyStream(dst,dst)
+/* Size of the key stream chunks, that are combined before they are applied. */
+const ksChunk = 1<<12
+
+/*
+Applies several key streams in one pass over the data: The key streams are
+combined in a small, cache-resident buffer first, which is then XORed over
+the data at once.
+*/
+type multiStream struct{
+	streams []cipher.Stream
+	ks      [ksChunk]byte
+}
+func (m *multiStream) add(s cipher.Stream) {
+	m.streams = append(m.streams,s)
+}
+func (m *multiStream) XORKeyStream(dst, src []byte) {
+	if len(m.streams)==1 {
+		m.streams[0].XORKeyStream(dst,src)
+		return
+	}
+	for len(src)>0 {
+		n := len(src)
+		if n>ksChunk { n = ksChunk }
+		ks := m.ks[:n]
+		clear(ks)
+		for _,k := range m.streams {
+			k.XORKeyStream(ks,ks)
 		}
+		subtle.XORBytes(dst[:n],src[:n],ks)
+		dst,src = dst[n:],src[n:]
 	}
 }
-
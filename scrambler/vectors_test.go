@@ -0,0 +1,182 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package scrambler
+
+import "testing"
+import "encoding/json"
+import "io/ioutil"
+import "io"
+import "net"
+import "sync"
+import "bytes"
+import ehex "encoding/hex"
+import "strconv"
+import "flag"
+
+var update = flag.Bool("update",false,"regenerate testdata/vectors.json")
+
+const vectorFile = "testdata/vectors.json"
+
+/* The plaintext, that is sent (as one data frame) in both directions after the handshake. */
+const vectorProbe = "sshproxy scrambler test vector"
+
+/* A known-answer test vector for one session over a cascade. */
+type Vector struct{
+	Seed   string `json:"seed"` /* hex */
+	Keys   uint8  `json:"keys"`
+	Blind  uint8  `json:"blind"`
+	Hybrid bool   `json:"hybrid"`
+	Hops   int    `json:"hops"`
+	
+	/* Links[0] is Initiator-to-first-station, the last one ends at the Endpt. */
+	Links  []VectorLink `json:"links"`
+}
+
+/*
+The complete transcript of one link: The handshake, followed by the probe
+(vectorProbe), once sent from the Initiator to the Endpt and then back.
+*/
+type VectorLink struct{
+	C2S string `json:"c2s"` /* hex */
+	S2C string `json:"s2c"` /* hex */
+}
+
+/* The sessions, the vectors cover. */
+var vectorCases = []Vector{
+	{Seed:"00",Keys:2,Blind:1,Hops:0},
+	{Seed:"01",Keys:2,Blind:1,Hops:1},
+	{Seed:"02",Keys:2,Blind:1,Hops:3},
+	{Seed:"03",Keys:3,Blind:2,Hops:2},
+	{Seed:"04",Keys:2,Blind:0,Hops:2},
+	{Seed:"05",Keys:2,Blind:1,Hybrid:true,Hops:2},
+}
+
+type recorder struct{
+	net.Conn
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+func (r *recorder) Write(b []byte) (int,error) {
+	r.mutex.Lock()
+	r.buf.Write(b)
+	r.mutex.Unlock()
+	return r.Conn.Write(b)
+}
+/* Our own end might get closed under the Intermediate station's feet. */
+func (r *recorder) Read(b []byte) (int,error) {
+	n,e := r.Conn.Read(b)
+	if e==io.ErrClosedPipe { e = io.EOF }
+	return n,e
+}
+func (r *recorder) String() string {
+	r.mutex.Lock(); defer r.mutex.Unlock()
+	return ehex.EncodeToString(r.buf.Bytes())
+}
+
+/* Runs a deterministic session over an in-memory cascade of c.Hops Intermediate stations. */
+func generateVector(c Vector) (*Vector,error) {
+	seed,e := ehex.DecodeString(c.Seed)
+	if e!=nil { return nil,e }
+	l := Layout{Keys:c.Keys,Blind:c.Blind}
+	hops := c.Hops
+	c2s := make([]*recorder,hops+1)
+	s2c := make([]*recorder,hops+1)
+	for i := range c2s {
+		a,b := net.Pipe()
+		c2s[i] = &recorder{Conn:a}
+		s2c[i] = &recorder{Conn:b}
+	}
+	defer func(){
+		for i := range c2s { c2s[i].Close(); s2c[i].Close() }
+	}()
+	
+	config := func(label string) *Config {
+		return &Config{Layout:l,Hybrid:c.Hybrid,Rand:NewDeterministicReader(seed,label)}
+	}
+	
+	errs := make(chan error,hops+1)
+	for i := 0; i<hops; i++ {
+		go func(i int) {
+			errs <- config("intermediate-"+strconv.Itoa(i)).Intermediate(s2c[i],c2s[i+1])
+		}(i)
+	}
+	var srv io.ReadWriteCloser
+	go func() {
+		var e error
+		srv,e = config("endpt").Endpt(s2c[hops])
+		errs <- e
+	}()
+	clt,e := config("initiator").Initiator(c2s[0])
+	if e!=nil { return nil,e }
+	for i := 0; i<=hops; i++ {
+		if e = <-errs; e!=nil { return nil,e }
+	}
+	
+	probe := make([]byte,len(vectorProbe))
+	go clt.Write([]byte(vectorProbe))
+	_,e = io.ReadFull(srv,probe)
+	if e!=nil { return nil,e }
+	if string(probe)!=vectorProbe { return nil,E_ECDH_FAILED }
+	go srv.Write([]byte(vectorProbe))
+	_,e = io.ReadFull(clt,probe)
+	if e!=nil { return nil,e }
+	if string(probe)!=vectorProbe { return nil,E_ECDH_FAILED }
+	
+	v := c
+	v.Links = make([]VectorLink,hops+1)
+	for i := range v.Links {
+		v.Links[i] = VectorLink{C2S:c2s[i].String(),S2C:s2c[i].String()}
+	}
+	return &v,nil
+}
+
+func TestVectors(t *testing.T) {
+	if *update {
+		var vs []*Vector
+		for _,c := range vectorCases {
+			v,e := generateVector(c)
+			if e!=nil { t.Fatal(e) }
+			vs = append(vs,v)
+		}
+		b,e := json.MarshalIndent(vs,"","\t")
+		if e!=nil { t.Fatal(e) }
+		e = ioutil.WriteFile(vectorFile,append(b,'\n'),0644)
+		if e!=nil { t.Fatal(e) }
+	}
+	b,e := ioutil.ReadFile(vectorFile)
+	if e!=nil { t.Fatal(e) }
+	var vs []*Vector
+	e = json.Unmarshal(b,&vs)
+	if e!=nil { t.Fatal(e) }
+	if len(vs)!=len(vectorCases) { t.Fatalf("%s has %d vectors, expected %d",vectorFile,len(vs),len(vectorCases)) }
+	for i,v := range vs {
+		w,e := generateVector(*v)
+		if e!=nil { t.Fatalf("vector %d: %v",i,e) }
+		for j := range v.Links {
+			if v.Links[j].C2S!=w.Links[j].C2S { t.Errorf("vector %d: mismatch at link %d (c2s)",i,j) }
+			if v.Links[j].S2C!=w.Links[j].S2C { t.Errorf("vector %d: mismatch at link %d (s2c)",i,j) }
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "github.com/maxymania/sshproxy"
+import "github.com/maxymania/sshproxy/directory"
+import "golang.org/x/crypto/ssh"
+import "encoding/base64"
+import "errors"
+import "net/http"
+import "net"
+import "log"
+
+/* A listener's descriptor, published to the directory authorities. */
+type Publish struct{
+	Nickname  string   `confl:"nickname"`
+	
+	/* The address clients connect to. Defaults to the listener's address. */
+	Addr      string   `confl:"address"`
+	Bandwidth int64    `confl:"bandwidth"`
+	Identity  string   `confl:"identity"` /* base64 */
+	Policy    []string `confl:"policy"`   /* e.g. "accept *:443", "reject *:*"; enforced, none means no exit */
+	
+	Authorities []string `confl:"authorities"`
+	Interval    string   `confl:"interval"`
+}
+func (p *Publish) Transfer(s *Server, d *directory.Publisher) (e error) {
+	d.Authorities = p.Authorities
+	e = duration(p.Interval,&d.Interval)
+	if e!=nil { return }
+	d.Key,e = s.hostKey()
+	if e!=nil { return }
+	dd := &d.Descriptor
+	dd.Nickname = p.Nickname
+	if dd.Nickname=="" { dd.Nickname = "sotpd" }
+	dd.Net,dd.Addr = s.Net,p.Addr
+	if dd.Addr=="" { dd.Addr = s.Addr }
+	if p.Bandwidth>0 { dd.Bandwidth = uint64(p.Bandwidth) }
+	dd.Identity,e = base64.StdEncoding.DecodeString(p.Identity)
+	if e!=nil { return }
+	if len(dd.Identity)>directory.MaxIdentity { return directory.E_FIELD }
+	for _,ps := range p.Policy {
+		r,e := directory.ParseRule(ps)
+		if e!=nil { return e }
+		dd.Policy = append(dd.Policy,r)
+	}
+	return
+}
+
+/* The first host key of the listener, which signs its descriptor. */
+func (c *Server) hostKey() (ssh.Signer,error) {
+	k := c.PrivKey
+	if k=="" && len(c.PrivKeys)!=0 { k = c.PrivKeys[0] }
+	if k=="" { return nil,errors.New("publish: the listener has no host key") }
+	return ssh.ParsePrivateKey([]byte(k))
+}
+
+type Peer struct{
+	Addr string `confl:"address"`
+	Key  string `confl:"key"` /* authorized_keys format */
+}
+func (p *Peer) Transfer(d *directory.Peer) (e error) {
+	d.Addr = p.Addr
+	d.Key,_,_,_,e = ssh.ParseAuthorizedKey([]byte(p.Key))
+	return
+}
+func peers(ps []Peer) ([]directory.Peer,error) {
+	r := make([]directory.Peer,len(ps))
+	for i := range ps {
+		e := ps[i].Transfer(&r[i])
+		if e!=nil { return nil,e }
+	}
+	return r,nil
+}
+
+/* Runs a directory authority. */
+type Authority struct{
+	Net     string `confl:"net"`
+	Addr    string `confl:"address"`
+	PrivKey string `confl:"privatekey"`
+	Peers   []Peer `confl:"peers"`
+	
+	Interval string `confl:"interval"`
+	Delay    string `confl:"delay"`
+	MaxAge   string `confl:"max_age"`
+}
+func (a *Authority) Transfer(d *directory.Authority) (e error) {
+	d.Key,e = ssh.ParsePrivateKey([]byte(a.PrivKey))
+	if e!=nil { return }
+	d.Peers,e = peers(a.Peers)
+	if e!=nil { return }
+	for _,e = range []error{
+		duration(a.Interval,&d.Interval),
+		duration(a.Delay,&d.Delay),
+		duration(a.MaxAge,&d.MaxAge),
+	}{
+		if e!=nil { return }
+	}
+	return
+}
+func (a *Authority) Serve() {
+	d := new(directory.Authority)
+	e := a.Transfer(d)
+	if e!=nil { fail(e) }
+	if a.Net=="" { a.Net="tcp" }
+	l,e := net.Listen(a.Net,a.Addr)
+	if e!=nil { fail(e) }
+	log.Println("Directory authority",ssh.FingerprintSHA256(d.Key.PublicKey()),"on",l.Addr())
+	go d.Run()
+	log.Println(http.Serve(l,d))
+}
+
+/*
+Builds the connections from the consensus of the directory authorities.
+The consensus is fetched over the connections given in the config, unless
+direct = "on". As it replaces the whole pool, dns connections are rejected.
+*/
+type Directory struct{
+	Authorities []Peer `confl:"authorities"`
+	Threshold   int    `confl:"threshold"`
+	Interval    string `confl:"interval"`
+	Direct      string `confl:"direct"`
+	
+	/* User and authentication for the relays. The address and host key are ignored. */
+	Relays Client `confl:"relays"`
+}
+func (c *Directory) Transfer(d *directory.Client) (e error) {
+	d.Authorities,e = peers(c.Authorities)
+	if e!=nil { return }
+	d.Threshold = c.Threshold
+	e = duration(c.Interval,&d.Interval)
+	if e!=nil { return }
+	if c.Direct=="on" { d.Dial = net.Dial }
+	d.New = func(dd *directory.Descriptor) (*sshproxy.Client,error) {
+		cl := new(sshproxy.Client)
+		e := c.Relays.Transfer(cl)
+		if e!=nil { return nil,e }
+		cl.Net,cl.Addr = dd.Net,dd.Addr
+		cl.Client.HostKeyCallback = ssh.FixedHostKey(dd.HostKey)
+		return cl,nil
+	}
+	return
+}
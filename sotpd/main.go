@@ -30,11 +30,20 @@ import "github.com/lytics/confl"
 import "github.com/maxymania/sshproxy"
 import "golang.org/x/crypto/ssh"
 import "github.com/maxymania/sshproxy/proxy"
+import "github.com/maxymania/sshproxy/scrambler"
+import "github.com/maxymania/sshproxy/relay"
 import "github.com/armon/go-socks5"
 import "fmt"
+import "flag"
 import "net"
+import "strings"
 import "os"
 import "io/ioutil"
+import "log"
+import "net/http"
+import "crypto/subtle"
+import "github.com/maxymania/sshproxy/directory"
+import "github.com/maxymania/sshproxy/discovery"
 
 type Client struct{
 	Net string `confl:"net"`
@@ -44,9 +53,25 @@ type Client struct{
 	Hkfp string `confl:"hostkey"`
 	PrivKey string `confl:"privatekey"`
 	PrivKeys []string `confl:"privatekeys"`
+	Hybrid string `confl:"hybrid"`
+	MaxPowBits int `confl:"max_pow_bits"`
+	
+	/*
+	If set, the connections are the relays of this domain, found in its
+	SRV and TXT records (see package discovery). address and hostkey are
+	ignored then.
+	*/
+	DNS       string `confl:"dns"`
+	DNSServer string `confl:"dns_server"`
 }
 
 func (c *Client) Transfer(s *sshproxy.Client) error{
+	s.MaxPowBits = c.MaxPowBits
+	if c.Hybrid=="on" {
+		sc := sshproxy.Scrambler
+		sc.Hybrid = true
+		s.Scrambler = &sc
+	}
 	s.Net = c.Net
 	if c.Net=="" { s.Net="tcp" }
 	s.Addr = c.Addr
@@ -80,6 +105,19 @@ func (c *Client) Transfer(s *sshproxy.Client) error{
 	return nil
 }
 
+func (c *Client) Discovery(d *discovery.DNS) {
+	d.Name = c.DNS
+	d.Server = c.DNSServer
+	d.New = func(addr string, fps []string) (*sshproxy.Client,error) {
+		cl := new(sshproxy.Client)
+		e := c.Transfer(cl)
+		if e!=nil { return nil,e }
+		cl.Addr = addr
+		cl.Client.HostKeyCallback = discovery.HostKeyCallback(fps)
+		return cl,nil
+	}
+}
+
 type Server struct{
 	Net string `confl:"net"`
 	Addr string `confl:"address"`
@@ -90,6 +128,38 @@ type Server struct{
 	
 	PrivKey string `confl:"privatekey"`
 	PrivKeys []string `confl:"privatekeys"`
+	Hybrid string `confl:"hybrid"`
+	
+	OpenTimeout      string `confl:"open_timeout"`
+	HandshakeTimeout string `confl:"handshake_timeout"`
+	CommandTimeout   string `confl:"command_timeout"`
+	MaxPendingConn   int    `confl:"max_pending_conn"`
+	MaxPendingAddr   int    `confl:"max_pending_addr"`
+	MaxHandshakes    int    `confl:"max_handshakes"`
+	MaxQueue         int    `confl:"max_queue"`
+	PowThreshold     int    `confl:"pow_threshold"`
+	PowBits          int    `confl:"pow_bits"`
+	MixBatch         int    `confl:"mix_batch"`
+	MixTimeout       string `confl:"mix_timeout"`
+	MaxDelay         string `confl:"max_delay"`
+	LatencyBudget    string `confl:"latency_budget"`
+	
+	Level       int    `confl:"level"`
+	DirectTCPIP string `confl:"direct_tcpip"`
+	RemoteForward string `confl:"remote_forward"`
+	ExitListen  string `confl:"exit_listen"`
+	
+	Jump   []string `confl:"jump"`
+	JumpTo Client   `confl:"jump_to"`
+	
+	Rendezvous string `confl:"rendezvous"`
+	
+	Publish Publish `confl:"publish"`
+}
+func duration(s string, d *time.Duration) (e error) {
+	if s=="" { return }
+	*d,e = time.ParseDuration(s)
+	return
 }
 func (c *Server) checkAddr(usr string, na net.Addr) error {
 	ip := net.IP{}
@@ -136,6 +206,18 @@ func (c *Server) checkSigner(usr string, pk ssh.PublicKey) error {
 	
 	return fmt.Errorf("Authentication failed '%s':%s:%s",usr,pk.Type(),ssh.FingerprintLegacyMD5(pk))
 }
+/*
+auth.<user>.forward = "on" permits direct-tcpip channels and tcpip-forward requests.
+auth.<user>.jump = "on" permits the jump channels.
+*/
+func (c *Server) permissions(usr string) *ssh.Permissions {
+	p := new(ssh.Permissions)
+	p.Extensions = make(map[string]string)
+	o := c.Auth[usr]
+	if o["forward"]=="on" { p.Extensions[sshproxy.PermitForwarding] = "" }
+	if o["jump"]=="on" { p.Extensions[sshproxy.PermitJumping] = "" }
+	return p
+}
 func (c *Server) Transfer(s *ssh.ServerConfig) error{
 	if c.Net=="" { c.Net="tcp" }
 	if c.PrivKey!="" {
@@ -155,14 +237,14 @@ func (c *Server) Transfer(s *ssh.ServerConfig) error{
 		if e!=nil { return nil,e }
 		e = c.checkPass(conn.User(),string(password))
 		if e!=nil { return nil,e }
-		return new(ssh.Permissions),nil
+		return c.permissions(conn.User()),nil
 	}
 	s.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 		e := c.checkAddr(conn.User(),conn.RemoteAddr())
 		if e!=nil { return nil,e }
 		e = c.checkSigner(conn.User(),key)
 		if e!=nil { return nil,e }
-		return new(ssh.Permissions),nil
+		return c.permissions(conn.User()),nil
 	}
 	s.NoClientAuth = c.NoAuth=="on"
 	
@@ -175,6 +257,86 @@ func (c *Server) Serve() {
 		fmt.Println(e)
 		os.Exit(1)
 	}
+	srv := new(sshproxy.Server)
+	if c.Hybrid=="on" {
+		sc := sshproxy.Scrambler
+		sc.Hybrid = true
+		srv.Scrambler = &sc
+	}
+	for _,e = range []error{
+		duration(c.OpenTimeout,&srv.OpenTimeout),
+		duration(c.HandshakeTimeout,&srv.HandshakeTimeout),
+		duration(c.CommandTimeout,&srv.CommandTimeout),
+		duration(c.MixTimeout,&srv.MixTimeout),
+	}{
+		if e!=nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+	}
+	srv.MaxPendingConn = c.MaxPendingConn
+	srv.MaxPendingAddr = c.MaxPendingAddr
+	srv.MaxHandshakes = c.MaxHandshakes
+	srv.MaxQueue = c.MaxQueue
+	srv.PowThreshold = c.PowThreshold
+	srv.PowBits = c.PowBits
+	srv.MixBatch = c.MixBatch
+	srv.Level = c.Level
+	switch c.DirectTCPIP {
+	case "all":
+		srv.PermitDirect = func(conn ssh.Conn, host string, port uint32) bool { return true }
+		fallthrough
+	case "on":
+		srv.HandleChannel("direct-tcpip",srv.DirectTCPIP)
+	}
+	switch c.RemoteForward {
+	case "all":
+		srv.PermitListen = func(conn ssh.Conn, host string, port uint32) bool { return true }
+		fallthrough
+	case "on":
+		srv.HandleRequest("tcpip-forward",srv.TCPIPForward)
+		srv.HandleRequest("cancel-tcpip-forward",srv.CancelTCPIPForward)
+	}
+	if len(c.Jump)!=0 {
+		srv.Upstream = new(sshproxy.Client)
+		e = c.JumpTo.Transfer(srv.Upstream)
+		if e!=nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+		for _,ct := range c.Jump { srv.HandleChannel(ct,srv.Jump) }
+	}
+	srv.Rendezvous = c.Rendezvous=="on"
+	if len(c.Publish.Authorities)!=0 {
+		p := new(directory.Publisher)
+		e = c.Publish.Transfer(c,p)
+		if e!=nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+		/* Enforce the advertised exit policy. */
+		d := &p.Descriptor
+		srv.PermitExit = func(host string, port uint32) bool { return port<=0xffff && d.Allows(host,uint16(port)) }
+		go p.Run()
+	}
+	if c.ExitListen=="on" {
+		srv.PermitExitListen = func(host string, port uint32) bool { return true }
+	}
+	if c.MaxDelay=="" && c.LatencyBudget!="" {
+		/* The budget limits the delays of max_delay, it means nothing alone. */
+		fmt.Println("latency_budget requires max_delay")
+		os.Exit(1)
+	}
+	if c.MaxDelay!="" {
+		rc := sshproxy.Relay
+		e = duration(c.MaxDelay,&rc.MaxDelay)
+		if e==nil { e = duration(c.LatencyBudget,&rc.Budget) }
+		if e!=nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+		srv.Relay = &rc
+	}
 	l,e := net.Listen(c.Net,c.Addr)
 	if e!=nil {
 		fmt.Println(e)
@@ -183,64 +345,353 @@ func (c *Server) Serve() {
 	for {
 		conn,e := l.Accept()
 		if e!=nil { continue }
-		c1,c2,c3,e := ssh.NewServerConn(conn,s)
-		if e!=nil { conn.Close(); continue }
-		go sshproxy.Handle(c1,c2,c3)
+		go c.handshake(srv,s,conn)
 	}
 }
 
+/* Performs the SSH handshake, bounded by HandshakeTimeout, so a slow client can't stall Accept. */
+func (c *Server) handshake(srv *sshproxy.Server, s *ssh.ServerConfig, conn net.Conn) {
+	if srv.HandshakeTimeout>0 { conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout)) }
+	c1,c2,c3,e := ssh.NewServerConn(conn,s)
+	if e!=nil { conn.Close(); return }
+	conn.SetDeadline(time.Time{})
+	srv.Handle(c1,c2,c3)
+}
+
 type Socks struct{
 	Net string `confl:"net"`
 	Addr string `confl:"address"`
+	
+	/* "5" (default), "4" (SOCKS4 and 4a) or "any". */
+	Version string `confl:"version"`
 }
 func (s *Socks) Transfer() {
 	if s.Net=="" { s.Net="tcp" }
 }
+func (s *Socks) Serve(s5 *socks5.Server) {
+	l,e := net.Listen(s.Net,s.Addr)
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	switch s.Version {
+	case "4": e = proxy.ServeSOCKS4(l)
+	case "any": e = proxy.ServeMixed(l,s5)
+	default: e = s5.Serve(l)
+	}
+	log.Println(e)
+}
+
+type HTTP struct{
+	Net   string            `confl:"net"`
+	Addr  string            `confl:"address"`
+	Users map[string]string `confl:"users"`
+}
+func (h *HTTP) Serve() {
+	if h.Net=="" { h.Net="tcp" }
+	p := proxy.HTTPHandler()
+	if len(h.Users)!=0 {
+		p.Auth = func(user, pass string) bool {
+			pw,ok := h.Users[user]
+			return ok && subtle.ConstantTimeCompare([]byte(pw),[]byte(pass))==1
+		}
+	}
+	l,e := net.Listen(h.Net,h.Addr)
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	log.Println(http.Serve(l,p))
+}
+
+type Transparent struct{
+	Net    string `confl:"net"`
+	Addr   string `confl:"address"`
+	TProxy string `confl:"tproxy"`
+}
+func (t *Transparent) Serve() {
+	if t.Net=="" { t.Net="tcp" }
+	var l net.Listener
+	var e error
+	if t.TProxy=="on" {
+		l,e = proxy.ListenTProxy(t.Net,t.Addr)
+	} else {
+		l,e = net.Listen(t.Net,t.Addr)
+	}
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	log.Println(proxy.ServeTransparent(l,t.TProxy=="on"))
+}
+
+type DNS struct{
+	Net  string `confl:"net"`
+	Addr string `confl:"address"`
+}
+/* Serves UDP on net (default "udp") and TCP on the same address. */
+func (d *DNS) Serve() {
+	if d.Net=="" { d.Net="udp" }
+	pc,e := net.ListenPacket(d.Net,d.Addr)
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	l,e := net.Listen(strings.Replace(d.Net,"udp","tcp",1),pc.LocalAddr().String())
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	go func(){ log.Println(proxy.ServeDNSTCP(l)) }()
+	log.Println(proxy.ServeDNS(pc))
+}
+
+type Forward struct{
+	Net    string `confl:"net"`
+	Addr   string `confl:"address"`
+	Target string `confl:"target"`
+	Level  int    `confl:"level"`
+	Proxy  int    `confl:"proxy_protocol"`
+}
+func (f *Forward) Serve() {
+	if f.Net=="" { f.Net="tcp" }
+	if f.Proxy<0 || f.Proxy>2 {
+		fmt.Println("proxy_protocol must be 0, 1 or 2")
+		os.Exit(1)
+	}
+	l,e := net.Listen(f.Net,f.Addr)
+	if e!=nil {
+		fmt.Println(e)
+		os.Exit(1)
+	}
+	pf := &proxy.Forward{Target:f.Target,Level:f.Level,ProxyProtocol:f.Proxy}
+	log.Println(pf.Serve(l))
+}
+
+type Scrambler struct{
+	Keys     int `confl:"keys"`
+	Blind    int `confl:"blind"`
+	MaxSlots int `confl:"maxslots"`
+}
+func (s *Scrambler) Transfer(c *scrambler.Config) {
+	if s.Keys!=0 {
+		c.Layout = scrambler.Layout{Keys:uint8(s.Keys),Blind:uint8(s.Blind)}
+	}
+	c.MaxSlots = s.MaxSlots
+}
+
+type Relay struct{
+	Idle     string `confl:"idle"`
+	Lifetime string `confl:"lifetime"`
+	Log      string `confl:"log"`
+}
+func (r *Relay) Transfer(c *relay.Config) (e error) {
+	if r.Idle!="" {
+		c.Idle,e = time.ParseDuration(r.Idle)
+		if e!=nil { return }
+	}
+	if r.Lifetime!="" {
+		c.Lifetime,e = time.ParseDuration(r.Lifetime)
+		if e!=nil { return }
+	}
+	if r.Log=="on" {
+		c.OnClose = func(s *relay.Stats) {
+			log.Printf("relay: %d bytes out, %d bytes in, reason: %v",s.AtoB,s.BtoA,s.Reason)
+		}
+	}
+	return
+}
+
+type Decoy struct{
+	Interval string   `confl:"interval"`
+	Volume   int64    `confl:"volume"`
+	Targets  []string `confl:"targets"`
+	DailyCap int64    `confl:"daily_cap"`
+}
+func (d *Decoy) Transfer(s *sshproxy.Decoy) error {
+	s.Volume = d.Volume
+	s.Targets = d.Targets
+	s.DailyCap = d.DailyCap
+	return duration(d.Interval,&s.Interval)
+}
+
+type Hidden struct{
+	PrivKey  string `confl:"privatekey"`
+	Local    string `confl:"local"`
+	Replicas int    `confl:"replicas"`
+}
+func (h *Hidden) Transfer(s *sshproxy.HiddenService) error {
+	sig,e := ssh.ParsePrivateKey([]byte(h.PrivKey))
+	if e!=nil { return e }
+	s.Key = sig
+	s.Local = h.Local
+	s.Replicas = h.Replicas
+	return nil
+}
 
 type Config struct{
+	Scrambler Scrambler `confl:"scrambler"`
+	Relay     Relay     `confl:"relay"`
 	Clients []Client `confl:"connections"`
 	Servers []Server `confl:"listeners"`
 	Socks   []Socks  `confl:"socks"`
+	HTTP    []HTTP   `confl:"http"`
+	Transparent []Transparent `confl:"transparent"`
+	DNS     []DNS    `confl:"dns"`
+	Forwards []Forward `confl:"forwards"`
+	Decoy   Decoy    `confl:"decoy"`
+	Hidden  []Hidden `confl:"hidden"`
+	
+	/* The rendezvous points for hidden services (sshproxy.RendezvousPoints). */
+	RendezvousPoints []string `confl:"rendezvous_points"`
+	
+	/* "path": the connections are the ordered hops of a Path, see sshproxy.SetPath. */
+	Mode    string   `confl:"mode"`
+	
+	/* The level for outgoing circuits (sshproxy.Level). */
+	Level   int      `confl:"level"`
+	
+	Directory   Directory   `confl:"directory"`
+	Authorities []Authority `confl:"authorities"`
+	
+	directory *directory.Client
+	discovery []*discovery.DNS
 }
-func (c *Config) Apply() {
+
+/* Prints to stderr and exits. Stdout is reserved for the data in stdio mode. */
+func fail(v ...interface{}) {
+	fmt.Fprintln(os.Stderr,v...)
+	os.Exit(exitConfig)
+}
+
+/* Applies the global settings and the connections, without starting anything. */
+func (c *Config) applyClients() {
+	c.Scrambler.Transfer(&sshproxy.Scrambler)
+	e := c.Relay.Transfer(&sshproxy.Relay)
+	if e!=nil { fail(e) }
+	if c.Level>0 { sshproxy.Level = c.Level }
+	sshproxy.RendezvousPoints = c.RendezvousPoints
+	var p *sshproxy.Path
+	switch c.Mode {
+	case "","cascade":
+	case "path": p = new(sshproxy.Path)
+	default: fail("Unknown mode:",c.Mode)
+	}
 	for _,cc := range c.Clients {
+		if cc.DNS!="" {
+			cc := cc
+			if p!=nil { fail("dns connections need mode \"cascade\"") }
+			/* The directory replaces the whole pool. */
+			if len(c.Directory.Authorities)!=0 { fail("dns connections and a directory exclude each other") }
+			d := new(discovery.DNS)
+			cc.Discovery(d)
+			_,e := d.Update()
+			if e!=nil { log.Println("Discovery:",cc.DNS,e) }
+			c.discovery = append(c.discovery,d)
+			continue
+		}
 		spc := new(sshproxy.Client)
 		e := cc.Transfer(spc)
-		if e!=nil { fmt.Println(e); os.Exit(1) }
-		sshproxy.Add(spc)
+		if e!=nil { fail(e) }
+		if p!=nil {
+			p.Hops = append(p.Hops,spc)
+		} else {
+			sshproxy.Add(spc)
+		}
+	}
+	if p!=nil {
+		/* These need a cascade of sshproxy nodes. */
+		switch {
+		case len(c.DNS)!=0: fail("dns listeners need mode \"cascade\"")
+		case len(c.Hidden)!=0: fail("hidden services need mode \"cascade\"")
+		case c.Decoy.Interval!="": fail("decoy traffic needs mode \"cascade\"")
+		case len(c.Directory.Authorities)!=0: fail("directory needs mode \"cascade\"")
+		}
+		sshproxy.SetPath(p)
+	}
+	if len(c.Directory.Authorities)!=0 {
+		c.directory = new(directory.Client)
+		e = c.Directory.Transfer(c.directory)
+		if e!=nil { fail(e) }
+		e = c.directory.Update()
+		if e!=nil { log.Println("Directory:",e) }
+	}
+}
+func (c *Config) Apply() {
+	var e error
+	c.applyClients()
+	if c.directory!=nil { go c.directory.Run() }
+	for _,d := range c.discovery {
+		go d.Run()
+	}
+	for _,ca := range c.Authorities {
+		go ca.Serve()
 	}
 	for _,cs := range c.Servers {
 		go cs.Serve()
 	}
+	for _,ch := range c.Hidden {
+		hs := new(sshproxy.HiddenService)
+		e = ch.Transfer(hs)
+		if e!=nil { fmt.Println(e); os.Exit(1) }
+		log.Println("Hidden service",hs.Name()+sshproxy.HiddenSuffix,"->",hs.Local)
+		go hs.Run()
+	}
+	if c.Decoy.Interval!="" {
+		d := new(sshproxy.Decoy)
+		e = c.Decoy.Transfer(d)
+		if e!=nil { fmt.Println(e); os.Exit(1) }
+		go d.Run(nil)
+	}
+	for _,ch := range c.HTTP {
+		go ch.Serve()
+	}
+	for _,ct := range c.Transparent {
+		go ct.Serve()
+	}
+	for _,cd := range c.DNS {
+		go cd.Serve()
+	}
+	for _,cf := range c.Forwards {
+		go cf.Serve()
+	}
 	if len(c.Socks)!=0 {
 		proco      := proxy.Config()
 		prose, err := socks5.New(proco)
 		if err!=nil { panic(err) }
 		for _,so := range c.Socks {
 			so.Transfer()
-			go prose.ListenAndServe(so.Net, so.Addr)
+			go so.Serve(prose)
 		}
 	}
 }
 
+func usage() {
+	fmt.Fprintln(os.Stderr,"Usage:",os.Args[0],"[-c] <config-file>")
+	fmt.Fprintln(os.Stderr,"      ",os.Args[0],"-c <config-file> -W <host:port> [-L <level>]")
+	flag.PrintDefaults()
+}
+
 func main() {
 	var conf Config
-	if len(os.Args) < 2 {
-		fmt.Println("Usage:",os.Args[0],"<config-file>")
-		return
-	}
-	fc,e := ioutil.ReadFile(os.Args[1])
-	if e!=nil {
-		fmt.Println("Usage:",os.Args[0],"<config-file>")
-		fmt.Println(e)
-		return
+	cfile  := flag.String("c","","the config file")
+	target := flag.String("W","","connect stdin and stdout to host:port through the connections and exit")
+	level  := flag.Int("L",0,"the level for -W (default: from the config)")
+	flag.Usage = usage
+	flag.Parse()
+	if *cfile=="" && flag.NArg()==1 { *cfile = flag.Arg(0) }
+	if *cfile=="" || flag.NArg()>1 {
+		usage()
+		os.Exit(exitConfig)
 	}
+	fc,e := ioutil.ReadFile(*cfile)
+	if e!=nil { fail(e) }
 	
 	e = confl.Unmarshal(fc,&conf)
-	if e!=nil {
-		fmt.Println("Usage:",os.Args[0],"<config-file>")
-		fmt.Println(e)
-		return
+	if e!=nil { fail(e) }
+	
+	if *target!="" {
+		os.Exit(stdio(&conf,*target,*level))
 	}
 	
 	conf.Apply()
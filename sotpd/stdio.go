@@ -0,0 +1,72 @@
+/*
+MIT License
+
+Copyright (c) 2017 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "os"
+import "log"
+import "errors"
+import "github.com/maxymania/sshproxy"
+
+/* Exit codes of the stdio mode (-W). */
+const (
+	exitOK      = 0 /* Both sides reached EOF. */
+	exitConfig  = 1 /* Usage or configuration error. */
+	exitConnect = 2 /* The circuit could not be built. */
+	exitRemote  = 3 /* The exit could not reach the target. */
+	exitBroken  = 4 /* The circuit failed during the session. */
+)
+
+/* Stdin and stdout as one connection. */
+type stdioConn struct{}
+func (stdioConn) Read(b []byte) (int,error) { return os.Stdin.Read(b) }
+func (stdioConn) Write(b []byte) (int,error) { return os.Stdout.Write(b) }
+func (stdioConn) CloseWrite() error { return os.Stdout.Close() }
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+/*
+Connects stdin and stdout to target through the connections of the config,
+as in "ProxyCommand sotpd -c <config> -W %h:%p". Returns the exit code.
+*/
+func stdio(c *Config, target string, level int) int {
+	c.applyClients()
+	if level>0 { sshproxy.Level = level }
+	
+	conn,e := sshproxy.Dial("tcp",target)
+	if e!=nil {
+		log.Println("Dial",target,e)
+		var re *sshproxy.RemoteError
+		if errors.As(e,&re) { return exitRemote }
+		return exitConnect
+	}
+	st := sshproxy.Relay.Relay(stdioConn{},conn)
+	if st.Reason!=nil {
+		log.Println("Relay",target,st.Reason)
+		return exitBroken
+	}
+	return exitOK
+}